@@ -24,13 +24,21 @@ func configure(app *cli.App) {
 	app.Flags = s.RegisterCommonFlags(app.Flags)
 	app.Flags = k8s.RegisterEndpointsFlags(app.Flags)
 	app.Flags = k8s.RegisterNodesStatFlags(app.Flags)
+	app.Flags = k8s.RegisterJobsFlags(app.Flags)
 	app.Flags = s.RegisterAPIFlags(app.Flags)
 	app.Flags = s.RegisterServicesConfigFlags(app.Flags)
 	app.Flags = s.RegisterHTTPProxyFlags(app.Flags)
+	app.Flags = s.RegisterHealthCheckerFlags(app.Flags)
+	app.Flags = s.RegisterCircuitBreakerFlags(app.Flags)
 	app.Flags = s.RegisterSessionLimiterFlags(app.Flags)
 	app.Flags = s.RegisterFileSizeCacheFlags(app.Flags)
+	app.Flags = s.RegisterAdsFlags(app.Flags)
+	app.Flags = s.RegisterRejectionsFlags(app.Flags)
 
 	app.Action = run
+	app.Commands = []cli.Command{
+		makeSignURLCMD(),
+	}
 }
 
 func run(c *cli.Context) error {
@@ -42,6 +50,7 @@ func run(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	defer config.Close()
 
 	// Setting URL Parser
 	urlParser := s.NewURLParser(config)
@@ -63,17 +72,32 @@ func run(c *cli.Context) error {
 	// Setting Kubernetes client
 	k8sClient := k8s.NewClient()
 
-	// Setting K8SEndpoints
-	endpointsPool := k8s.NewEndpoints(c, k8sClient)
+	// Setting K8SEndpoints (watch-based EndpointSlices or polling Endpoints)
+	var endpointsPool k8s.EndpointsGetter
+	if c.Bool(k8s.EndpointsWatchFlag) {
+		endpointSlices := k8s.NewEndpointSlices(c, k8sClient)
+		defer endpointSlices.Close()
+		endpointsPool = endpointSlices
+	} else {
+		endpointsPool = k8s.NewEndpoints(c, k8sClient)
+	}
 
 	// Setting K8SNodeStats
 	nodeStatsPool := k8s.NewNodesStat(c, k8sClient)
 
+	// Setting K8SPodStats
+	podStatsPool := k8s.NewPodsStat(c, k8sClient)
+
+	// Setting K8SJobs
+	jobsPool := k8s.NewJobs(c, k8sClient)
+	defer jobsPool.Close()
+
 	// Setting HTTP Client
 	cl := http.DefaultClient
 
 	// Setting ServiceLocation
-	svcLocPool := s.NewServiceLocationPool(c, cl, nodeStatsPool, endpointsPool)
+	svcLocPool := s.NewServiceLocationPool(c, cl, nodeStatsPool, podStatsPool, endpointsPool, jobsPool)
+	defer svcLocPool.Close()
 
 	// Setting Resolver
 	resolver := s.NewResolver(config, svcLocPool)
@@ -106,7 +130,11 @@ func run(c *cli.Context) error {
 	httpProxy := s.NewHTTPProxy(c, resolver, retryDelay, fileSizeCache)
 
 	// Setting Claims
-	claims := s.NewClaims(c)
+	claims, err := s.NewClaims(c, rc)
+	if err != nil {
+		return err
+	}
+	defer claims.Close()
 
 	var clickHouse *s.ClickHouse
 
@@ -126,12 +154,32 @@ func run(c *cli.Context) error {
 	accessHistory := s.NewAccessHistory()
 
 	// Setting SessionLimiter
-	sessionLimiter := s.NewSessionLimiter(c)
+	sessionLimiter := s.NewSessionLimiter(c, rc)
+	defer sessionLimiter.Close()
 	sessionLimiter.SetSizeLookup(fileSizeCache.Get)
 
+	// Setting QuotaLimiter
+	quotaLimiter := s.NewQuotaLimiter(c, rc)
+	defer quotaLimiter.Close()
+
+	// Setting ByteQuotas
+	byteQuotas := s.NewByteQuotas(rc)
+
+	// Setting Ads
+	ads, err := s.NewAdsConfig(c)
+	if err != nil {
+		return err
+	}
+
+	// Setting Rejections
+	rejections, err := s.NewRejections(c)
+	if err != nil {
+		return err
+	}
+
 	// Setting WebService
 	web := s.NewWeb(c, urlParser, resolver, httpProxy, claims,
-		bucket, clickHouse, accessHistory, sessionLimiter)
+		bucket, clickHouse, accessHistory, sessionLimiter, quotaLimiter, byteQuotas, rejections, ads)
 	servers = append(servers, web)
 	defer web.Close()
 
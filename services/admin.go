@@ -0,0 +1,141 @@
+package services
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const adminTokenFlag = "admin-token"
+
+// registerAdmin adds the admin API to mux. It is served only with an admin
+// token configured.
+func (s *Web) registerAdmin(mux *http.ServeMux) {
+	if s.adminToken == "" {
+		return
+	}
+	mux.HandleFunc("/admin/revocations", s.adminAuth(s.handleRevocations))
+	mux.HandleFunc("/admin/sessions", s.adminAuth(s.handleSessions))
+	mux.HandleFunc("/admin/sessions/", s.adminAuth(s.handleSession))
+}
+
+// adminAuth lets through requests carrying the admin token as a bearer
+// token.
+func (s *Web) adminAuth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+type revocationRequest struct {
+	Revocation
+	// TTL sets ExpiresAt relative to now, in seconds.
+	TTL int `json:"ttl"`
+}
+
+// handleRevocations lists revocations on GET and adds one on POST.
+func (s *Web) handleRevocations(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.claims.revoked.List())
+	case http.MethodPost:
+		var req revocationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "failed to parse revocation", http.StatusBadRequest)
+			return
+		}
+		rev := req.Revocation
+		if req.TTL > 0 {
+			rev.ExpiresAt = time.Now().Add(time.Duration(req.TTL) * time.Second).UTC()
+		}
+		if err := rev.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.claims.revoked.Add(rev); err != nil {
+			logrus.WithError(err).Error("failed to add revocation")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		logrus.WithField("kind", rev.Kind).WithField("value", rev.Value).Info("revocation added")
+		writeJSON(w, http.StatusCreated, rev)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+type sessionsResponse struct {
+	// Source is "redis" for sessions of all replicas, "local" for those of
+	// the replica serving the request.
+	Source   string        `json:"source"`
+	Sessions []SessionInfo `json:"sessions"`
+}
+
+// handleSessions lists sessions of the session limiter.
+func (s *Web) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if s.sl == nil {
+		writeJSON(w, http.StatusOK, sessionsResponse{Source: "local", Sessions: []SessionInfo{}})
+		return
+	}
+	sessions, source := s.sl.Sessions("")
+	writeJSON(w, http.StatusOK, sessionsResponse{Source: source, Sessions: sessions})
+}
+
+// handleSession shows a session on GET /admin/sessions/<id>, evicts it on
+// DELETE and resets its counters on POST /admin/sessions/<id>/reset.
+func (s *Web) handleSession(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/admin/sessions/")
+	reset := strings.HasSuffix(id, "/reset")
+	id = strings.TrimSuffix(id, "/reset")
+	if id == "" || s.sl == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	logger := logrus.WithField("session_id", id)
+	switch {
+	case reset && r.Method == http.MethodPost:
+		if err := s.sl.Reset(id); err != nil {
+			logger.WithError(err).Error("failed to reset session")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		logger.Info("session reset")
+		w.WriteHeader(http.StatusNoContent)
+	case !reset && r.Method == http.MethodGet:
+		sessions, source := s.sl.Sessions(id)
+		if len(sessions) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, sessionsResponse{Source: source, Sessions: sessions})
+	case !reset && r.Method == http.MethodDelete:
+		if err := s.sl.Evict(id); err != nil {
+			logger.WithError(err).Error("failed to evict session")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		logger.Info("session evicted")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
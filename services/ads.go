@@ -0,0 +1,236 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	adsConfigFlag = "ads-config"
+
+	tagDiscontinuity   = "#EXT-X-DISCONTINUITY"
+	tagDateRange       = "#EXT-X-DATERANGE:"
+	tagProgramDateTime = "#EXT-X-PROGRAM-DATE-TIME:"
+	tagKey             = "#EXT-X-KEY:"
+	tagMap             = "#EXT-X-MAP:"
+
+	// adDateRangeClass marks the EXT-X-DATERANGE of inserted ad pods, players
+	// report impressions by it and RewriteManifest skips the pods.
+	adDateRangeClass = "com.webtor.ad"
+)
+
+func RegisterAdsFlags(f []cli.Flag) []cli.Flag {
+	return append(f,
+		cli.StringFlag{
+			Name:   adsConfigFlag,
+			Usage:  "path to the YAML file of ad pods inserted into playlists of tokens with ads=true",
+			EnvVar: "ADS_CONFIG",
+		},
+	)
+}
+
+// AdSegment is a single segment of an ad pod. URI must be absolute, it is
+// served by the ad server, not by the proxy.
+type AdSegment struct {
+	URI      string  `yaml:"uri"`
+	Duration float64 `yaml:"duration"`
+}
+
+// AdPod is a break of one or more ad segments inserted at Offset seconds of
+// movie time. Map is the init segment of fMP4 ads, if any. Segments must not
+// be longer than the target duration of the playlists they go into.
+type AdPod struct {
+	ID       string      `yaml:"id"`
+	Offset   float64     `yaml:"offset"`
+	Map      string      `yaml:"map"`
+	Segments []AdSegment `yaml:"segments"`
+}
+
+func (s *AdPod) duration() float64 {
+	d := 0.0
+	for _, seg := range s.Segments {
+		d += seg.Duration
+	}
+	return d
+}
+
+// AdsConfig is the list of ad pods, ordered by offset.
+type AdsConfig struct {
+	Pods []AdPod `yaml:"pods"`
+}
+
+// NewAdsConfig loads the ads config file, ads are off without it.
+func NewAdsConfig(c *cli.Context) (*AdsConfig, error) {
+	f := c.String(adsConfigFlag)
+	if f == "" {
+		return nil, nil
+	}
+	return LoadAdsConfig(f)
+}
+
+func LoadAdsConfig(file string) (*AdsConfig, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read ads config %s", file)
+	}
+	s := &AdsConfig{}
+	if err := yaml.Unmarshal(data, s); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse ads config %s", file)
+	}
+	ids := map[string]bool{}
+	for i := range s.Pods {
+		p := &s.Pods[i]
+		if p.ID == "" {
+			p.ID = fmt.Sprintf("pod-%d", i)
+		}
+		if ids[p.ID] {
+			return nil, errors.Errorf("duplicate ad pod %s in %s", p.ID, file)
+		}
+		ids[p.ID] = true
+		if p.Offset < 0 {
+			return nil, errors.Errorf("negative offset of ad pod %s in %s", p.ID, file)
+		}
+		if len(p.Segments) == 0 {
+			return nil, errors.Errorf("no segments in ad pod %s in %s", p.ID, file)
+		}
+		for _, seg := range p.Segments {
+			if seg.URI == "" || seg.Duration <= 0 {
+				return nil, errors.Errorf("bad segment of ad pod %s in %s", p.ID, file)
+			}
+		}
+	}
+	sort.SliceStable(s.Pods, func(i, j int) bool {
+		return s.Pods[i].Offset < s.Pods[j].Offset
+	})
+	return s, nil
+}
+
+// insertAds is the response-rule handler registered in rules.go for tokens
+// with `ads=true`, the claim StatRecord accounts. It inserts the configured
+// ad pods into HLS variant playlists.
+func insertAds(r *http.Response, rc *RulesContext) error {
+	if r.Request == nil || r.Body == nil || !strings.HasSuffix(r.Request.URL.Path, ".m3u8") {
+		return nil
+	}
+	if ads, _ := rc.Claims["ads"].(bool); !ads || rc.Ads == nil || len(rc.Ads.Pods) == 0 {
+		return nil
+	}
+	streamBody(r, InsertAds(r.Body, rc.Ads))
+	return nil
+}
+
+// InsertAds inserts ad pods into an HLS variant playlist streamed from src.
+// A pod goes before the first segment starting at or past its offset of movie
+// time, accounted the same way as in RewriteManifest. Pods before the
+// #EXT-X-SESSION-OFFSET are skipped, a resumed session doesn't replay them,
+// and pods past the end of the playlist are never inserted.
+//
+// Each pod is wrapped in #EXT-X-DISCONTINUITY tags and starts with an
+// #EXT-X-DATERANGE of class com.webtor.ad for impression reporting. Dates
+// come from #EXT-X-PROGRAM-DATE-TIME tags counting playlist time from the
+// epoch, as the spec requires them along with date ranges. Encryption and
+// the init segment of the content are reset for the pod and restored after
+// it.
+//
+// Master playlists carry no #EXTINF and pass through unchanged.
+func InsertAds(src io.Reader, ads *AdsConfig) io.Reader {
+	movieTime := 0.0
+	playlistTime := 0.0
+	pendingExtinf := 0.0
+	next := 0
+	var lastKey, lastMap []byte
+
+	return newLineReader(src, func(dst []byte, line []byte) []byte {
+		trimmed := bytes.TrimRight(line, "\r\n")
+		stripped := bytes.TrimLeft(trimmed, " \t")
+
+		switch {
+		case bytes.HasPrefix(stripped, []byte(tagSessionOffset)):
+			movieTime = parseSessionOffset(stripped)
+			for next < len(ads.Pods) && ads.Pods[next].Offset < movieTime {
+				next++
+			}
+		case bytes.HasPrefix(stripped, []byte(tagKey)):
+			lastKey = append(lastKey[:0], stripped...)
+			if bytes.Contains(stripped, []byte("METHOD=NONE")) {
+				lastKey = lastKey[:0]
+			}
+		case bytes.HasPrefix(stripped, []byte(tagMap)):
+			lastMap = append(lastMap[:0], stripped...)
+		case bytes.HasPrefix(stripped, []byte(tagExtinf)):
+			eol := line[len(trimmed):]
+			if len(eol) == 0 {
+				eol = []byte("\n")
+			}
+			for next < len(ads.Pods) && ads.Pods[next].Offset <= movieTime {
+				pod := &ads.Pods[next]
+				dst = appendAdPod(dst, pod, playlistTime, lastKey, lastMap, eol)
+				playlistTime += pod.duration()
+				next++
+			}
+			if d, ok := parseExtinf(stripped); ok {
+				pendingExtinf = d
+			}
+		case len(stripped) == 0 || stripped[0] == '#':
+		default:
+			movieTime += pendingExtinf
+			playlistTime += pendingExtinf
+			pendingExtinf = 0
+		}
+		return append(dst, line...)
+	})
+}
+
+// appendAdPod appends pod starting at playlistTime, with the key and init
+// segment of the content restored after it.
+func appendAdPod(dst []byte, pod *AdPod, playlistTime float64, key []byte, initMap []byte, eol []byte) []byte {
+	line := func(parts ...string) {
+		for _, p := range parts {
+			dst = append(dst, p...)
+		}
+		dst = append(dst, eol...)
+	}
+	start := adDate(playlistTime)
+	line(tagDiscontinuity)
+	line(tagDateRange, `ID="`, pod.ID, `",CLASS="`, adDateRangeClass, `",START-DATE="`, start,
+		`",DURATION=`, formatSeconds(pod.duration()))
+	line(tagProgramDateTime, start)
+	if len(key) > 0 {
+		line(tagKey, "METHOD=NONE")
+	}
+	if pod.Map != "" {
+		line(tagMap, `URI="`, pod.Map, `"`)
+	}
+	for _, seg := range pod.Segments {
+		line(tagExtinf, formatSeconds(seg.Duration), ",")
+		line(seg.URI)
+	}
+	line(tagDiscontinuity)
+	if len(key) > 0 {
+		line(string(key))
+	}
+	if len(initMap) > 0 {
+		line(string(initMap))
+	}
+	line(tagProgramDateTime, adDate(playlistTime+pod.duration()))
+	return dst
+}
+
+func adDate(sec float64) string {
+	return time.Unix(0, 0).UTC().Add(time.Duration(sec * float64(time.Second))).Format("2006-01-02T15:04:05.000Z07:00")
+}
+
+func formatSeconds(sec float64) string {
+	return strconv.FormatFloat(sec, 'f', -1, 64)
+}
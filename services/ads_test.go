@@ -0,0 +1,121 @@
+package services
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func loadTestAds(t *testing.T) *AdsConfig {
+	t.Helper()
+	ads, err := LoadAdsConfig("testdata/ads/ads.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ads
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "ads", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestLoadAdsConfig(t *testing.T) {
+	ads := loadTestAds(t)
+	if len(ads.Pods) != 2 || ads.Pods[0].ID != "preroll" || ads.Pods[1].ID != "midroll" {
+		t.Fatalf("expected pods ordered by offset, got %+v", ads.Pods)
+	}
+	if d := ads.Pods[0].duration(); d != 10 {
+		t.Errorf("expected preroll of 10s, got %v", d)
+	}
+}
+
+func TestLoadAdsConfig_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"no segments": "pods:\n  - id: a\n    offset: 0\n",
+		"no duration": "pods:\n  - offset: 0\n    segments:\n      - uri: https://ads.example.com/0.ts\n",
+		"duplicate":   "pods:\n  - id: a\n    segments: [{uri: x.ts, duration: 1}]\n  - id: a\n    segments: [{uri: y.ts, duration: 1}]\n",
+		"negative":    "pods:\n  - offset: -1\n    segments: [{uri: x.ts, duration: 1}]\n",
+	}
+	for name, data := range cases {
+		f := filepath.Join(t.TempDir(), "ads.yaml")
+		if err := os.WriteFile(f, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadAdsConfig(f); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestInsertAds_Fixtures(t *testing.T) {
+	ads := loadTestAds(t)
+	for _, name := range []string{"vod", "resumed", "encrypted"} {
+		t.Run(name, func(t *testing.T) {
+			got := readTestManifest(t, InsertAds(bytes.NewReader(readFixture(t, name+".m3u8")), ads))
+			want := string(readFixture(t, name+"_ads.m3u8"))
+			if got != want {
+				t.Fatalf("want:\n%s\ngot:\n%s", want, got)
+			}
+		})
+	}
+}
+
+func TestInsertAds_Master(t *testing.T) {
+	body := readFixture(t, "master.m3u8")
+	if got := readTestManifest(t, InsertAds(bytes.NewReader(body), loadTestAds(t))); got != string(body) {
+		t.Fatalf("expected pass-through, got:\n%s", got)
+	}
+}
+
+func TestInsertAds_Handler(t *testing.T) {
+	ads := loadTestAds(t)
+	body := readFixture(t, "vod.m3u8")
+	for _, c := range []struct {
+		claims jwt.MapClaims
+		want   bool
+	}{
+		{jwt.MapClaims{"ads": true}, true},
+		{jwt.MapClaims{"ads": false}, false},
+		{jwt.MapClaims{}, false},
+	} {
+		resp := &http.Response{
+			Request: httptest.NewRequest("GET", "/index.m3u8", nil),
+			Header:  http.Header{},
+			Body:    io.NopCloser(bytes.NewReader(body)),
+		}
+		if err := insertAds(resp, &RulesContext{Claims: c.claims, Ads: ads}); err != nil {
+			t.Fatal(err)
+		}
+		got := readTestManifest(t, resp.Body)
+		if strings.Contains(got, adDateRangeClass) != c.want {
+			t.Errorf("claims %v: expected ads %v, got:\n%s", c.claims, c.want, got)
+		}
+	}
+}
+
+func TestRewriteManifest_SkipsAdPods(t *testing.T) {
+	// Grace covers the first 2 segments of the movie, the 10s preroll
+	// doesn't count.
+	body := strings.ReplaceAll(string(readFixture(t, "vod_ads.m3u8")), ".ts\n", ".ts?token="+primaryJWT+"\n")
+	got := string(rewriteTestManifest(t, []byte(body), claimsWithGrace(12), primaryJWT))
+	for _, s := range []string{"v0-0.ts", "v0-1.ts"} {
+		if !strings.Contains(got, s+"?token="+graceJWT) {
+			t.Errorf("%s should swap, got:\n%s", s, got)
+		}
+	}
+	if !strings.Contains(got, "v0-2.ts?token="+primaryJWT) {
+		t.Errorf("v0-2 should keep primary token, got:\n%s", got)
+	}
+}
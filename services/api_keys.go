@@ -0,0 +1,175 @@
+package services
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const apiKeysFileCheckInterval = 5 * time.Second
+
+// APIKey is the policy of a single tenant. Empty Domains or Edges allow any.
+// Quota is shared by all streams of the key, DomainQuotas by those of a
+// domain claim.
+type APIKey struct {
+	Secret       string            `yaml:"secret"`
+	Enabled      *bool             `yaml:"enabled"`
+	Domains      []string          `yaml:"domains"`
+	Rate         string            `yaml:"rate"`
+	Edges        []string          `yaml:"edges"`
+	Quota        *Quota            `yaml:"quota"`
+	DomainQuotas map[string]*Quota `yaml:"domainQuotas"`
+}
+
+// IsEnabled reports whether the key may be used, keys are enabled unless
+// stated otherwise.
+func (s *APIKey) IsEnabled() bool {
+	return s.Enabled == nil || *s.Enabled
+}
+
+// Apply checks claims of a request to src against the policy and fills in
+// the default rate.
+func (s *APIKey) Apply(claims jwt.MapClaims, src *Source) error {
+	if len(s.Domains) > 0 {
+		domain, _ := claims["domain"].(string)
+		if !contains(s.Domains, domain) {
+			return errors.Errorf("domain %q is not allowed", domain)
+		}
+	}
+	if len(s.Edges) > 0 && !contains(s.Edges, src.GetEdgeName()) {
+		return errors.Errorf("edge %q is not allowed", src.GetEdgeName())
+	}
+	if _, ok := claims["rate"].(string); !ok && s.Rate != "" {
+		claims["rate"] = s.Rate
+	}
+	return nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeys is the keystore of tenants, loaded from a YAML file mapping API
+// keys to their policies. The file is re-read when it changes.
+type APIKeys struct {
+	file      string
+	interval  time.Duration
+	mux       sync.RWMutex
+	keys      map[string]*APIKey
+	modTime   time.Time
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+func NewAPIKeys(file string) (*APIKeys, error) {
+	s := &APIKeys{
+		file:     file,
+		interval: apiKeysFileCheckInterval,
+		closeCh:  make(chan struct{}),
+	}
+	if _, err := s.reload(); err != nil {
+		return nil, err
+	}
+	go s.watch()
+	return s, nil
+}
+
+// reload re-reads the file if its modification time changed.
+func (s *APIKeys) reload() (bool, error) {
+	st, err := os.Stat(s.file)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to stat api keys file %s", s.file)
+	}
+	s.mux.RLock()
+	same := st.ModTime().Equal(s.modTime)
+	s.mux.RUnlock()
+	if same {
+		return false, nil
+	}
+	data, err := os.ReadFile(s.file)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read api keys file %s", s.file)
+	}
+	keys := map[string]*APIKey{}
+	if err := yaml.Unmarshal(data, &keys); err != nil {
+		return false, errors.Wrapf(err, "failed to parse api keys file %s", s.file)
+	}
+	for name, k := range keys {
+		if k == nil || k.Secret == "" {
+			return false, errors.Errorf("no secret for api key %s in %s", name, s.file)
+		}
+		if k.Rate != "" {
+			if _, err := bytefmt.ToBytes(k.Rate); err != nil {
+				return false, errors.Wrapf(err, "failed to parse rate of api key %s in %s", name, s.file)
+			}
+		}
+		quotas := []*Quota{k.Quota}
+		for _, q := range k.DomainQuotas {
+			quotas = append(quotas, q)
+		}
+		for _, q := range quotas {
+			if q == nil {
+				continue
+			}
+			for _, v := range []string{q.MaxRate, q.DailyBytes, q.MonthlyBytes} {
+				if v == "" {
+					continue
+				}
+				if _, err := bytefmt.ToBytes(v); err != nil {
+					return false, errors.Wrapf(err, "failed to parse quota of api key %s in %s", name, s.file)
+				}
+			}
+		}
+	}
+	s.mux.Lock()
+	s.keys = keys
+	s.modTime = st.ModTime()
+	s.mux.Unlock()
+	return true, nil
+}
+
+func (s *APIKeys) watch() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case <-ticker.C:
+		}
+		changed, err := s.reload()
+		if err != nil {
+			// Keep the keys we have, a half-written file must not lock
+			// every tenant out.
+			log.WithError(err).Warn("failed to reload api keys")
+			continue
+		}
+		if changed {
+			log.Infof("api keys reloaded from %s", s.file)
+		}
+	}
+}
+
+// Get returns the policy of the key, or nil if there is none.
+func (s *APIKeys) Get(key string) *APIKey {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return s.keys[key]
+}
+
+func (s *APIKeys) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+	})
+}
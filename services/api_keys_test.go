@@ -0,0 +1,138 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const testAPIKeysYAML = `
+tenant-a:
+  secret: secret-a
+  domains: [a.example.com]
+  rate: 10M
+  edges: [default, hls]
+tenant-b:
+  secret: secret-b
+  enabled: false
+`
+
+func writeAPIKeys(t *testing.T, path string, data string, mt time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mt, mt); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestAPIKeysClaims(t *testing.T) (*Claims, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "api-keys.yaml")
+	writeAPIKeys(t, path, testAPIKeysYAML, time.Now())
+	keys, err := NewAPIKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(keys.Close)
+	return &Claims{
+		apiKey:    "legacy",
+		apiSecret: "legacy-secret",
+		keys:      keys,
+	}, path
+}
+
+func TestClaims_APIKeys(t *testing.T) {
+	c, _ := newTestAPIKeysClaims(t)
+	for _, tc := range []struct {
+		name   string
+		apiKey string
+		secret string
+		ok     bool
+	}{
+		{"own secret", "tenant-a", "secret-a", true},
+		{"secret of another tenant", "tenant-a", "secret-b", false},
+		{"global secret", "tenant-a", "legacy-secret", false},
+		{"disabled key", "tenant-b", "secret-b", false},
+		{"legacy key", "legacy", "legacy-secret", true},
+		{"unknown key", "tenant-c", "legacy-secret", false},
+	} {
+		_, err := c.Get(signTestToken(t, jwt.SigningMethodHS256, "", []byte(tc.secret)), tc.apiKey)
+		if tc.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+	}
+}
+
+func TestAPIKey_Apply(t *testing.T) {
+	c, _ := newTestAPIKeysClaims(t)
+	k := c.GetAPIKey("tenant-a")
+	if k == nil {
+		t.Fatal("expected api key")
+	}
+	hls := &Source{Name: "default", Mod: &Mod{Name: "hls"}}
+	claims := jwt.MapClaims{"domain": "a.example.com"}
+	if err := k.Apply(claims, hls); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if claims["rate"] != "10M" {
+		t.Fatalf("expected default rate, got %v", claims["rate"])
+	}
+	claims = jwt.MapClaims{"domain": "a.example.com", "rate": "2M"}
+	if err := k.Apply(claims, hls); err != nil || claims["rate"] != "2M" {
+		t.Fatalf("expected rate of token to stay, got %v, %v", claims["rate"], err)
+	}
+	if err := k.Apply(jwt.MapClaims{"domain": "b.example.com"}, hls); err == nil {
+		t.Fatal("expected foreign domain to be rejected")
+	}
+	if err := k.Apply(jwt.MapClaims{}, hls); err == nil {
+		t.Fatal("expected missing domain to be rejected")
+	}
+	vtt := &Source{Name: "default", Mod: &Mod{Name: "vtt"}}
+	if err := k.Apply(jwt.MapClaims{"domain": "a.example.com"}, vtt); err == nil {
+		t.Fatal("expected edge outside of the list to be rejected")
+	}
+	// Keys without lists allow everything.
+	open := &APIKey{Secret: "s"}
+	if err := open.Apply(jwt.MapClaims{}, vtt); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestAPIKeys_Reload(t *testing.T) {
+	c, path := newTestAPIKeysClaims(t)
+	token := signTestToken(t, jwt.SigningMethodHS256, "", []byte("secret-b"))
+	if _, err := c.Get(token, "tenant-b"); err == nil {
+		t.Fatal("expected disabled key to be rejected")
+	}
+	writeAPIKeys(t, path, "tenant-b:\n  secret: secret-b\n", time.Now().Add(time.Second))
+	if changed, err := c.keys.reload(); err != nil || !changed {
+		t.Fatalf("expected api keys to reload, got %v, %v", changed, err)
+	}
+	if _, err := c.Get(token, "tenant-b"); err != nil {
+		t.Fatalf("expected enabled key to pass: %v", err)
+	}
+	if c.GetAPIKey("tenant-a") != nil {
+		t.Fatal("expected removed key to be gone")
+	}
+
+	// A broken file keeps the last good keys.
+	writeAPIKeys(t, path, "tenant-b:\n  enabled: true\n", time.Now().Add(2*time.Second))
+	if _, err := c.keys.reload(); err == nil {
+		t.Fatal("expected error for key without secret")
+	}
+	if _, err := c.Get(token, "tenant-b"); err != nil {
+		t.Fatalf("expected last good keys to stay: %v", err)
+	}
+	writeAPIKeys(t, path, "tenant-b:\n  secret: s\n  rate: fast\n", time.Now().Add(3*time.Second))
+	if _, err := c.keys.reload(); err == nil {
+		t.Fatal("expected error for bad rate")
+	}
+}
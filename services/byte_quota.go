@@ -0,0 +1,415 @@
+package services
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	byteQuotaKeyPrefix = "thp:bytes:"
+
+	// byteQuotaRemainingHeader carries the least remaining bytes of the
+	// quotas a response counts toward.
+	byteQuotaRemainingHeader = "X-Quota-Bytes-Remaining"
+
+	// byteQuotaFlushBytes is how many bytes a response reserves from the
+	// counters in Redis at once.
+	byteQuotaFlushBytes = 1 << 20
+)
+
+var errByteQuotaExhausted = errors.New("byte quota exhausted")
+
+// byteQuotaWindow is a rolling window of buckets, usage of a window is the
+// sum of its last n buckets.
+type byteQuotaWindow struct {
+	name   string
+	bucket time.Duration
+	n      int64
+}
+
+var byteQuotaWindows = []byteQuotaWindow{
+	{"daily", time.Hour, 24},
+	{"monthly", 24 * time.Hour, 30},
+}
+
+// ByteQuotaScope is a byte quota along with what it's shared by: a session
+// ("session:<id>") or a quota scope of an API key. Zero limits mean
+// unlimited.
+type ByteQuotaScope struct {
+	Scope   string
+	Daily   int64
+	Monthly int64
+}
+
+func (s *ByteQuotaScope) limit(window string) int64 {
+	if window == "daily" {
+		return s.Daily
+	}
+	return s.Monthly
+}
+
+// byteQuotaScopes returns the byte quotas of a request: those of the session
+// from the daily_bytes and monthly_bytes claims and those of the quotas of
+// the API key.
+func byteQuotaScopes(claims jwt.MapClaims, quotas []QuotaScope) []ByteQuotaScope {
+	var res []ByteQuotaScope
+	if sid, _ := claims["sessionID"].(string); sid != "" {
+		daily, _ := claims["daily_bytes"].(float64)
+		monthly, _ := claims["monthly_bytes"].(float64)
+		if daily > 0 || monthly > 0 {
+			res = append(res, ByteQuotaScope{"session:" + sid, int64(daily), int64(monthly)})
+		}
+	}
+	for _, q := range quotas {
+		// Sizes are validated on reload of the api keys.
+		daily, _ := bytefmt.ToBytes(q.Quota.DailyBytes)
+		monthly, _ := bytefmt.ToBytes(q.Quota.MonthlyBytes)
+		if daily > 0 || monthly > 0 {
+			res = append(res, ByteQuotaScope{q.Scope, int64(daily), int64(monthly)})
+		}
+	}
+	return res
+}
+
+// ByteQuotaUsage is the state of a window of a byte quota. RetryAfter is set
+// once the quota is exhausted, it's the seconds until enough of the window
+// rolls out.
+type ByteQuotaUsage struct {
+	Scope      string `json:"scope"`
+	Window     string `json:"window"`
+	Limit      int64  `json:"limit"`
+	Used       int64  `json:"used"`
+	Remaining  int64  `json:"remaining"`
+	RetryAfter int64  `json:"retry_after,omitempty"`
+}
+
+func (s *ByteQuotaUsage) Exhausted() bool {
+	return s.Remaining <= 0
+}
+
+// ByteQuotas tracks bytes served per scope in Redis, in hourly buckets for
+// the daily window and daily buckets for the monthly one.
+type ByteQuotas struct {
+	rc  redis.UniversalClient
+	now func() time.Time
+}
+
+// NewByteQuotas returns nil without Redis, byte quotas are off then.
+func NewByteQuotas(rc redis.UniversalClient) *ByteQuotas {
+	if rc == nil {
+		return nil
+	}
+	return &ByteQuotas{
+		rc:  rc,
+		now: time.Now,
+	}
+}
+
+// key groups keys of a scope in one hash slot, so that they are read by a
+// single MGET on Redis Cluster.
+func (s *ByteQuotas) key(scope string, w byteQuotaWindow, idx int64) string {
+	return byteQuotaKeyPrefix + "{" + scope + "}:" + w.name + ":" + strconv.FormatInt(idx, 10)
+}
+
+func (w byteQuotaWindow) index(t time.Time) int64 {
+	return t.Unix() / int64(w.bucket/time.Second)
+}
+
+// Usage returns the usage of every limited window of scopes.
+func (s *ByteQuotas) Usage(ctx context.Context, scopes []ByteQuotaScope) ([]ByteQuotaUsage, error) {
+	now := s.now()
+	var res []ByteQuotaUsage
+	var windows []byteQuotaWindow
+	var cmds []*redis.SliceCmd
+	_, err := s.rc.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, sc := range scopes {
+			for _, w := range byteQuotaWindows {
+				limit := sc.limit(w.name)
+				if limit <= 0 {
+					continue
+				}
+				cur := w.index(now)
+				keys := make([]string, 0, w.n)
+				for i := cur - w.n + 1; i <= cur; i++ {
+					keys = append(keys, s.key(sc.Scope, w, i))
+				}
+				res = append(res, ByteQuotaUsage{Scope: sc.Scope, Window: w.name, Limit: limit})
+				windows = append(windows, w)
+				cmds = append(cmds, p.MGet(ctx, keys...))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get byte quotas")
+	}
+	for i, cmd := range cmds {
+		u, w := &res[i], windows[i]
+		buckets := make([]int64, len(cmd.Val()))
+		for j, v := range cmd.Val() {
+			if v, ok := v.(string); ok {
+				buckets[j], _ = strconv.ParseInt(v, 10, 64)
+			}
+			u.Used += buckets[j]
+		}
+		u.Remaining = max(u.Limit-u.Used, 0)
+		if !u.Exhausted() {
+			continue
+		}
+		// Buckets are oldest first, the quota frees up once the usage
+		// of those rolled out drops below the limit.
+		first := w.index(now) - w.n + 1
+		used := u.Used
+		for j, b := range buckets {
+			used -= b
+			if used < u.Limit {
+				free := time.Unix((first+int64(j)+w.n)*int64(w.bucket/time.Second), 0)
+				u.RetryAfter = int64(math.Ceil(free.Sub(now).Seconds()))
+				break
+			}
+		}
+	}
+	return res, nil
+}
+
+// Add counts n bytes toward every limited window of scopes.
+func (s *ByteQuotas) Add(ctx context.Context, scopes []ByteQuotaScope, n int64) error {
+	now := s.now()
+	_, err := s.rc.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, sc := range scopes {
+			for _, w := range byteQuotaWindows {
+				if sc.limit(w.name) <= 0 {
+					continue
+				}
+				k := s.key(sc.Scope, w, w.index(now))
+				p.IncrBy(ctx, k, n)
+				p.Expire(ctx, k, time.Duration(w.n+1)*w.bucket)
+			}
+		}
+		return nil
+	})
+	return errors.Wrap(err, "failed to add to byte quotas")
+}
+
+// luaReserveBytes takes up to want bytes from the windows of a scope, as many
+// as the most used window has left, so that concurrent responses can't take
+// more than the limit together.
+// KEYS: buckets of every window, oldest first.
+// ARGV: [1] want, then per window: limit, number of buckets, ttl seconds.
+// Returns: bytes taken, counted in the last bucket of every window.
+var luaReserveBytes = redis.NewScript(`
+local grant = tonumber(ARGV[1])
+local current = {}
+local k = 1
+for i = 2, #ARGV, 3 do
+    local limit, n = tonumber(ARGV[i]), tonumber(ARGV[i+1])
+    local used = 0
+    for _, v in ipairs(redis.call("MGET", unpack(KEYS, k, k+n-1))) do
+        if v then
+            used = used + tonumber(v)
+        end
+    end
+    grant = math.min(grant, limit - used)
+    table.insert(current, {KEYS[k+n-1], ARGV[i+2]})
+    k = k + n
+end
+if grant <= 0 then
+    return 0
+end
+for _, c in ipairs(current) do
+    redis.call("INCRBY", c[1], grant)
+    redis.call("EXPIRE", c[1], c[2])
+end
+return grant
+`)
+
+// Reserve takes up to n bytes from every limited window of scopes, as many as
+// the most used one has left, and returns how many were taken.
+func (s *ByteQuotas) Reserve(ctx context.Context, scopes []ByteQuotaScope, n int64) (int64, error) {
+	now := s.now()
+	grant := n
+	grants := make([]int64, len(scopes))
+	for i, sc := range scopes {
+		var keys []string
+		var args []any
+		args = append(args, grant)
+		for _, w := range byteQuotaWindows {
+			limit := sc.limit(w.name)
+			if limit <= 0 {
+				continue
+			}
+			cur := w.index(now)
+			for j := cur - w.n + 1; j <= cur; j++ {
+				keys = append(keys, s.key(sc.Scope, w, j))
+			}
+			args = append(args, limit, w.n, int64(time.Duration(w.n+1)*w.bucket/time.Second))
+		}
+		g, err := luaReserveBytes.Run(ctx, s.rc, keys, args...).Int64()
+		if err != nil {
+			s.refund(ctx, scopes[:i], grants[:i], 0)
+			return 0, errors.Wrap(err, "failed to reserve byte quotas")
+		}
+		grants[i] = g
+		grant = g
+		if grant == 0 {
+			break
+		}
+	}
+	// Scopes reserved earlier may have taken more than the later ones let.
+	s.refund(ctx, scopes, grants, grant)
+	return grant, nil
+}
+
+// refund gives back what scopes took beyond grant.
+func (s *ByteQuotas) refund(ctx context.Context, scopes []ByteQuotaScope, grants []int64, grant int64) {
+	for i, sc := range scopes {
+		if grants[i] <= grant {
+			continue
+		}
+		if err := s.Add(ctx, []ByteQuotaScope{sc}, grant-grants[i]); err != nil {
+			logrus.WithError(err).WithField("scope", sc.Scope).Warn("failed to refund byte quota")
+		}
+	}
+}
+
+// exhaustedByteQuota returns the exhausted window with the latest
+// RetryAfter, or nil if none is exhausted. The remaining bytes are the least
+// of all windows.
+func exhaustedByteQuota(usage []ByteQuotaUsage) (exhausted *ByteQuotaUsage, remaining int64) {
+	remaining = -1
+	for i := range usage {
+		u := &usage[i]
+		if remaining < 0 || u.Remaining < remaining {
+			remaining = u.Remaining
+		}
+		if u.Exhausted() && (exhausted == nil || u.RetryAfter > exhausted.RetryAfter) {
+			exhausted = u
+		}
+	}
+	return exhausted, remaining
+}
+
+// byteQuotaStatus is the status of requests over quota: the monthly volume
+// is what plans are sold by, so exhausting it asks for payment, running out
+// of the daily one is a matter of waiting.
+func byteQuotaStatus(u *ByteQuotaUsage) int {
+	if u.Window == "monthly" {
+		return http.StatusPaymentRequired
+	}
+	return http.StatusTooManyRequests
+}
+
+func byteQuotaRejectCode(u *ByteQuotaUsage) string {
+	if u.Window == "monthly" {
+		return rejectByteQuotaMonthly
+	}
+	return rejectByteQuotaDaily
+}
+
+// byteQuotaCounter counts bytes of a response, see
+// ResponseWriterInterceptor. Bytes are reserved in Redis in chunks before
+// they are written, so that concurrent responses share what's left, and the
+// response is cut once nothing is. The unused reservation is given back on
+// Close.
+type byteQuotaCounter struct {
+	q        *ByteQuotas
+	scopes   []ByteQuotaScope
+	reserved int64
+}
+
+func (s *ByteQuotas) newCounter(scopes []ByteQuotaScope) *byteQuotaCounter {
+	return &byteQuotaCounter{
+		q:      s,
+		scopes: scopes,
+	}
+}
+
+func (s *byteQuotaCounter) add(n int) error {
+	for s.reserved < int64(n) {
+		if err := s.reserve(max(byteQuotaFlushBytes, int64(n)-s.reserved)); err != nil {
+			return err
+		}
+	}
+	s.reserved -= int64(n)
+	return nil
+}
+
+func (s *byteQuotaCounter) reserve(n int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	granted, err := s.q.Reserve(ctx, s.scopes, n)
+	if err != nil {
+		// Serve uncounted while Redis is down, like requests starting
+		// then are.
+		logrus.WithError(err).Warn("failed to reserve bytes")
+		granted = n
+	}
+	if granted <= 0 {
+		return errByteQuotaExhausted
+	}
+	s.reserved += granted
+	return nil
+}
+
+func (s *byteQuotaCounter) Close() {
+	if s.reserved <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.q.Add(ctx, s.scopes, -s.reserved); err != nil {
+		logrus.WithError(err).Warn("failed to give back reserved bytes")
+		return
+	}
+	s.reserved = 0
+}
+
+type byteQuotaResponse struct {
+	Quotas []ByteQuotaUsage `json:"quotas"`
+}
+
+// handleByteQuota serves the byte quotas of the session and the API key of a
+// token, params are token and api-key.
+func (s *Web) handleByteQuota(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	apiKey := r.FormValue("api-key")
+	claims, err := s.claims.Get(r.FormValue("token"), apiKey)
+	if err != nil {
+		reason := claimsErrorReason(err)
+		promTokenRejections.WithLabelValues(reason).Inc()
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"api_key": apiKey,
+			"reason":  reason,
+		}).Warn("failed to get claims for byte quota")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	var quotas []QuotaScope
+	if k := s.claims.GetAPIKey(apiKey); k != nil {
+		quotas = k.Quotas(apiKey, claims)
+	}
+	res := byteQuotaResponse{Quotas: []ByteQuotaUsage{}}
+	if scopes := byteQuotaScopes(claims, quotas); s.bq != nil && len(scopes) > 0 {
+		usage, err := s.bq.Usage(r.Context(), scopes)
+		if err != nil {
+			logrus.WithError(err).Error("failed to get byte quota")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		res.Quotas = usage
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,193 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestByteQuotas(t *testing.T, now *time.Time) *ByteQuotas {
+	t.Helper()
+	rc := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { _ = rc.Close() })
+	q := NewByteQuotas(rc)
+	q.now = func() time.Time { return *now }
+	return q
+}
+
+func TestByteQuotaScopes(t *testing.T) {
+	claims := jwt.MapClaims{"sessionID": "s1", "daily_bytes": float64(100)}
+	quotas := []QuotaScope{
+		{"key:a", &Quota{MonthlyBytes: "1K"}},
+		{"domain:a|a.example.com", &Quota{MaxStreams: 1}},
+	}
+	got := byteQuotaScopes(claims, quotas)
+	want := []ByteQuotaScope{{"session:s1", 100, 0}, {"key:a", 0, 1024}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestByteQuotas_RollingWindow(t *testing.T) {
+	now := time.Date(2026, 1, 1, 10, 30, 0, 0, time.UTC)
+	q := newTestByteQuotas(t, &now)
+	ctx := context.Background()
+	scopes := []ByteQuotaScope{{Scope: "session:s1", Daily: 100}}
+
+	if err := q.Add(ctx, scopes, 60); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Hour)
+	if err := q.Add(ctx, scopes, 50); err != nil {
+		t.Fatal(err)
+	}
+	usage, err := q.Usage(ctx, scopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := usage[0]
+	if u.Used != 110 || u.Remaining != 0 || !u.Exhausted() {
+		t.Fatalf("expected exhausted quota, got %+v", u)
+	}
+	// The 60 bytes of 10:00 roll out at 10:00 the next day.
+	if want := int64(21*3600 + 1800); u.RetryAfter != want {
+		t.Fatalf("expected retry after %d, got %d", want, u.RetryAfter)
+	}
+
+	now = now.Add(22 * time.Hour)
+	usage, err = q.Usage(ctx, scopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := usage[0]; u.Used != 50 || u.Remaining != 50 || u.RetryAfter != 0 {
+		t.Fatalf("expected 50 bytes remaining, got %+v", u)
+	}
+}
+
+func TestExhaustedByteQuota(t *testing.T) {
+	usage := []ByteQuotaUsage{
+		{Scope: "session:s1", Window: "daily", Remaining: 0, RetryAfter: 60},
+		{Scope: "key:a", Window: "monthly", Remaining: 0, RetryAfter: 3600},
+		{Scope: "key:a", Window: "daily", Remaining: 10},
+	}
+	u, remaining := exhaustedByteQuota(usage)
+	if u == nil || u.Window != "monthly" || remaining != 0 {
+		t.Fatalf("expected monthly window, got %+v %d", u, remaining)
+	}
+	if byteQuotaStatus(u) != http.StatusPaymentRequired || byteQuotaStatus(&usage[0]) != http.StatusTooManyRequests {
+		t.Fatal("unexpected statuses")
+	}
+	if u, remaining := exhaustedByteQuota(usage[2:]); u != nil || remaining != 10 {
+		t.Fatalf("expected 10 bytes remaining, got %+v %d", u, remaining)
+	}
+}
+
+func TestByteQuotaCounter(t *testing.T) {
+	now := time.Now()
+	q := newTestByteQuotas(t, &now)
+	scopes := []ByteQuotaScope{{Scope: "key:a", Monthly: byteQuotaFlushBytes * 2}}
+	c := q.newCounter(scopes)
+
+	wi := NewResponseWrtierInterceptor(httptest.NewRecorder())
+	wi.countBytes = c.add
+	chunk := make([]byte, byteQuotaFlushBytes/2)
+	for i := 0; i < 4; i++ {
+		if _, err := wi.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := wi.Write([]byte("x")); err != errByteQuotaExhausted {
+		t.Fatalf("expected response to be cut, got %v", err)
+	}
+	c.Close()
+
+	usage, err := q.Usage(context.Background(), scopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := usage[0]; u.Used != byteQuotaFlushBytes*2 {
+		t.Fatalf("expected written bytes counted, got %+v", u)
+	}
+}
+
+// TestByteQuotaCounter_Concurrent checks that concurrent responses share the
+// quota rather than each serving what was left when it started.
+func TestByteQuotaCounter_Concurrent(t *testing.T) {
+	now := time.Now()
+	q := newTestByteQuotas(t, &now)
+	scopes := []ByteQuotaScope{
+		{Scope: "session:s1", Daily: byteQuotaFlushBytes * 3 / 2},
+		{Scope: "key:a", Monthly: byteQuotaFlushBytes * 4},
+	}
+	a, b := q.newCounter(scopes), q.newCounter(scopes)
+	if err := a.add(byteQuotaFlushBytes); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.add(byteQuotaFlushBytes / 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.add(byteQuotaFlushBytes / 2); err != errByteQuotaExhausted {
+		t.Fatalf("expected second response to be cut, got %v", err)
+	}
+	a.Close()
+	b.Close()
+
+	usage, err := q.Usage(context.Background(), scopes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := int64(byteQuotaFlushBytes * 5 / 4)
+	for _, u := range usage {
+		if u.Used != want {
+			t.Fatalf("expected %d bytes counted, got %+v", want, u)
+		}
+	}
+}
+
+func TestWeb_ByteQuota(t *testing.T) {
+	now := time.Now()
+	s := &Web{
+		claims: &Claims{apiKey: "key", apiSecret: "secret"},
+		bq:     newTestByteQuotas(t, &now),
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"exp":         time.Now().Add(time.Hour).Unix(),
+		"sessionID":   "s1",
+		"daily_bytes": 1000,
+	}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scopes := []ByteQuotaScope{{Scope: "session:s1", Daily: 1000}}
+	if err := s.bq.Add(context.Background(), scopes, 400); err != nil {
+		t.Fatal(err)
+	}
+
+	q := url.Values{"token": {token}, "api-key": {"key"}}
+	w := httptest.NewRecorder()
+	s.handleByteQuota(w, httptest.NewRequest("GET", "/quota?"+q.Encode(), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var res byteQuotaResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Quotas) != 1 || res.Quotas[0].Remaining != 600 {
+		t.Fatalf("expected 600 bytes remaining, got %+v", res.Quotas)
+	}
+
+	w = httptest.NewRecorder()
+	s.handleByteQuota(w, httptest.NewRequest("GET", "/quota?api-key=key&token=bad", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", w.Code)
+	}
+}
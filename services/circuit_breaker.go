@@ -0,0 +1,257 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	CircuitBreakerFailuresFlag         = "circuit-breaker-failures"
+	CircuitBreakerOpenTimeFlag         = "circuit-breaker-open-time"
+	CircuitBreakerHalfOpenRequestsFlag = "circuit-breaker-half-open-requests"
+)
+
+// breakerIdleTTL is how long a closed breaker of an upstream that gets no
+// requests is kept.
+const breakerIdleTTL = 10 * time.Minute
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+var (
+	promBreakerTransitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webtor_http_proxy_circuit_breaker_transitions_total",
+		Help: "Total number of upstream circuit breaker state transitions",
+	}, []string{"state"})
+	promBreakerFallbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webtor_http_proxy_circuit_breaker_fallbacks_total",
+		Help: "Total number of requests routed away from an upstream with an open circuit breaker",
+	}, []string{"outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(promBreakerTransitions, promBreakerFallbacks)
+}
+
+func RegisterCircuitBreakerFlags(f []cli.Flag) []cli.Flag {
+	return append(f,
+		cli.IntFlag{
+			Name:   CircuitBreakerFailuresFlag,
+			Usage:  "consecutive failed requests to open the circuit breaker of an upstream (0 disables breakers)",
+			Value:  5,
+			EnvVar: "CIRCUIT_BREAKER_FAILURES",
+		},
+		cli.IntFlag{
+			Name:   CircuitBreakerOpenTimeFlag,
+			Usage:  "time in seconds an open circuit breaker waits before letting trial requests through",
+			Value:  30,
+			EnvVar: "CIRCUIT_BREAKER_OPEN_TIME",
+		},
+		cli.IntFlag{
+			Name:   CircuitBreakerHalfOpenRequestsFlag,
+			Usage:  "concurrent trial requests of a half-open circuit breaker",
+			Value:  1,
+			EnvVar: "CIRCUIT_BREAKER_HALF_OPEN_REQUESTS",
+		},
+	)
+}
+
+// CircuitBreaker guards a single upstream. It opens after consecutive
+// failures and rejects requests for the open time, then lets a limited
+// number of trial requests through. A successful trial closes it, a failed
+// one opens it again.
+type CircuitBreaker struct {
+	key         string
+	maxFailures int
+	openTime    time.Duration
+	maxTrials   int
+	mux         sync.Mutex
+	state       BreakerState
+	failures    int
+	trials      int
+	openedAt    time.Time
+	used        time.Time
+}
+
+// Allow reports whether a request may go to the upstream. A request allowed
+// while half-open takes a trial slot, it is given back by Done.
+func (s *CircuitBreaker) Allow() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.used = time.Now()
+	if s.state == BreakerOpen && time.Since(s.openedAt) >= s.openTime {
+		s.setState(BreakerHalfOpen)
+		s.trials = 0
+	}
+	switch s.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if s.trials >= s.maxTrials {
+			return false
+		}
+		s.trials++
+	}
+	return true
+}
+
+// Done records the result of a request. Requests canceled by the client
+// tell nothing about the upstream and only give back their trial slot.
+func (s *CircuitBreaker) Done(err error, code int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.state == BreakerHalfOpen && s.trials > 0 {
+		s.trials--
+	}
+	if err != nil && errors.Is(err, context.Canceled) {
+		return
+	}
+	if err != nil || code >= 500 {
+		s.failures++
+		if s.state == BreakerHalfOpen || (s.state == BreakerClosed && s.failures >= s.maxFailures) {
+			s.openedAt = time.Now()
+			s.setState(BreakerOpen)
+		}
+		return
+	}
+	s.failures = 0
+	if s.state == BreakerHalfOpen {
+		s.setState(BreakerClosed)
+	}
+}
+
+// setState must be called with mux held.
+func (s *CircuitBreaker) setState(state BreakerState) {
+	if s.state == state {
+		return
+	}
+	log.Infof("circuit breaker of upstream %s %s", s.key, state)
+	promBreakerTransitions.WithLabelValues(string(state)).Inc()
+	s.state = state
+}
+
+// CircuitBreakerStatus is a snapshot of a breaker for the debug endpoint.
+type CircuitBreakerStatus struct {
+	Key      string
+	State    BreakerState
+	Failures int
+	OpenedAt time.Time
+}
+
+func (s *CircuitBreaker) Status() CircuitBreakerStatus {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return CircuitBreakerStatus{
+		Key:      s.key,
+		State:    s.state,
+		Failures: s.failures,
+		OpenedAt: s.openedAt,
+	}
+}
+
+// CircuitBreakers holds breakers by upstream "host:port".
+type CircuitBreakers struct {
+	maxFailures int
+	openTime    time.Duration
+	maxTrials   int
+	mux         sync.Mutex
+	breakers    map[string]*CircuitBreaker
+}
+
+func NewCircuitBreakers(c *cli.Context) *CircuitBreakers {
+	s := &CircuitBreakers{
+		maxFailures: c.Int(CircuitBreakerFailuresFlag),
+		openTime:    time.Duration(c.Int(CircuitBreakerOpenTimeFlag)) * time.Second,
+		maxTrials:   c.Int(CircuitBreakerHalfOpenRequestsFlag),
+		breakers:    map[string]*CircuitBreaker{},
+	}
+	if s.maxTrials <= 0 {
+		s.maxTrials = 1
+	}
+	return s
+}
+
+// Get returns the breaker of the upstream, or nil if breakers are disabled.
+func (s *CircuitBreakers) Get(key string) *CircuitBreaker {
+	if s.maxFailures <= 0 {
+		return nil
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	b, ok := s.breakers[key]
+	if ok {
+		return b
+	}
+	s.prune()
+	b = &CircuitBreaker{
+		key:         key,
+		maxFailures: s.maxFailures,
+		openTime:    s.openTime,
+		maxTrials:   s.maxTrials,
+		state:       BreakerClosed,
+		used:        time.Now(),
+	}
+	s.breakers[key] = b
+	return b
+}
+
+// prune drops closed breakers of upstreams that are gone. Must be called with
+// mux held.
+func (s *CircuitBreakers) prune() {
+	for k, b := range s.breakers {
+		b.mux.Lock()
+		idle := b.state == BreakerClosed && time.Since(b.used) > breakerIdleTTL
+		b.mux.Unlock()
+		if idle {
+			delete(s.breakers, k)
+		}
+	}
+}
+
+// Status returns snapshots of all breakers sorted by key.
+func (s *CircuitBreakers) Status() []CircuitBreakerStatus {
+	s.mux.Lock()
+	bs := make([]*CircuitBreaker, 0, len(s.breakers))
+	for _, b := range s.breakers {
+		bs = append(bs, b)
+	}
+	s.mux.Unlock()
+	res := make([]CircuitBreakerStatus, 0, len(bs))
+	for _, b := range bs {
+		res = append(res, b.Status())
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Key < res[j].Key
+	})
+	return res
+}
+
+// breakerTransport reports results of requests to the upstream to its
+// breaker. Like outlierTransport it sits under redirectFollowingTransport.
+type breakerTransport struct {
+	http.RoundTripper
+	breaker *CircuitBreaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		t.breaker.Done(err, 0)
+		return nil, err
+	}
+	t.breaker.Done(nil, resp.StatusCode)
+	return resp, nil
+}
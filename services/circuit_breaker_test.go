@@ -0,0 +1,151 @@
+package services
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+func newTestCircuitBreaker(t *testing.T) *CircuitBreaker {
+	t.Helper()
+	bs := NewCircuitBreakers(newTestContext(RegisterCircuitBreakerFlags))
+	bs.openTime = 50 * time.Millisecond
+	return bs.Get("10.0.0.1:8080")
+}
+
+func TestCircuitBreaker_Opens(t *testing.T) {
+	b := newTestCircuitBreaker(t)
+	for i := 0; i < b.maxFailures-1; i++ {
+		if !b.Allow() {
+			t.Fatal("expected closed breaker to allow requests")
+		}
+		b.Done(nil, http.StatusGatewayTimeout)
+	}
+	// Canceled requests don't count.
+	b.Done(context.Canceled, 0)
+	if b.Status().State != BreakerClosed {
+		t.Fatal("expected breaker to stay closed")
+	}
+	b.Done(errors.New("dial tcp 10.0.0.1:8080: i/o timeout"), 0)
+	if st := b.Status(); st.State != BreakerOpen || st.Failures != b.maxFailures {
+		t.Fatalf("expected open breaker, got %+v", st)
+	}
+	if b.Allow() {
+		t.Fatal("expected open breaker to reject requests")
+	}
+}
+
+func TestCircuitBreaker_HalfOpen(t *testing.T) {
+	b := newTestCircuitBreaker(t)
+	open := func() {
+		for i := 0; i < b.maxFailures; i++ {
+			b.Done(nil, http.StatusBadGateway)
+		}
+	}
+	open()
+	time.Sleep(b.openTime)
+
+	// A single trial request goes through, the rest wait for its result.
+	if !b.Allow() {
+		t.Fatal("expected trial request to be allowed")
+	}
+	if b.Status().State != BreakerHalfOpen {
+		t.Fatal("expected half-open breaker")
+	}
+	if b.Allow() {
+		t.Fatal("expected only one trial request")
+	}
+	b.Done(nil, http.StatusBadGateway)
+	if b.Status().State != BreakerOpen || b.Allow() {
+		t.Fatal("expected failed trial to open breaker again")
+	}
+
+	time.Sleep(b.openTime)
+	if !b.Allow() {
+		t.Fatal("expected trial request to be allowed")
+	}
+	b.Done(nil, http.StatusPartialContent)
+	if st := b.Status(); st.State != BreakerClosed || st.Failures != 0 {
+		t.Fatalf("expected successful trial to close breaker, got %+v", st)
+	}
+	if !b.Allow() || !b.Allow() {
+		t.Fatal("expected closed breaker to allow requests")
+	}
+}
+
+func TestBreakerTransport(t *testing.T) {
+	b := newTestCircuitBreaker(t)
+	tr := &breakerTransport{roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Body:       io.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	}), b}
+	for i := 0; i < b.maxFailures; i++ {
+		req, _ := http.NewRequest("GET", "http://10.0.0.1:8080/file", nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+	}
+	if b.Status().State != BreakerOpen {
+		t.Fatal("expected 5xx responses to open breaker")
+	}
+}
+
+func TestHTTPProxy_OpenBreakerFallsBack(t *testing.T) {
+	cfg := testStaticConfig(t, Hash,
+		StaticEndpoint{Address: "10.0.0.1:8080"},
+		StaticEndpoint{Address: "10.0.0.2:8080"},
+	)
+	defer cfg.Static.endpoints.Close()
+	sl := NewServiceLocationPool(newTestContext(), nil, nil, nil, nil, nil)
+	defer sl.Close()
+	r := NewResolver(&ServicesConfig{"default": cfg}, sl)
+	p := NewHTTPProxy(newTestContext(func(f []cli.Flag) []cli.Flag {
+		return RegisterCircuitBreakerFlags(RegisterHTTPProxyFlags(f))
+	}), r, 0, nil)
+	src := &Source{Type: "default", InfoHash: "08ada5a7a6183aae1e09d831df6748d566095a10"}
+	logger := logrus.WithField("test", true)
+
+	loc, err := r.Resolve(src, nil, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.breakerLocation(src, nil, loc, logger); got != loc {
+		t.Fatalf("expected closed breaker to keep location, got %+v", got)
+	}
+	open := func(l *Location) {
+		b := p.breakers.Get(l.IP.String() + ":8080")
+		for i := 0; i < b.maxFailures; i++ {
+			b.Done(nil, http.StatusBadGateway)
+		}
+	}
+	open(loc)
+	fb := p.breakerLocation(src, nil, loc, logger)
+	if fb.Unavailable || fb.IP.Equal(loc.IP) {
+		t.Fatalf("expected fallback location, got %+v", fb)
+	}
+	open(fb)
+	if got := p.breakerLocation(src, nil, loc, logger); !got.Unavailable {
+		t.Fatalf("expected unavailable location with all breakers open, got %+v", got)
+	}
+	var opened int
+	for _, st := range p.breakers.Status() {
+		if st.State == BreakerOpen {
+			opened++
+		}
+	}
+	if opened != 2 {
+		t.Fatalf("expected both breakers open in status, got %+v", p.breakers.Status())
+	}
+}
@@ -3,15 +3,21 @@ package services
 import (
 	"context"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
 	"github.com/urfave/cli"
 )
 
 const (
-	apiKeyFlag    = "api-key"
-	apiSecretFlag = "api-secret"
+	apiKeyFlag         = "api-key"
+	apiSecretFlag      = "api-secret"
+	apiJWKSFileFlag    = "api-jwks-file"
+	apiJWKSOverlapFlag = "api-jwks-overlap"
+	apiKeysFileFlag    = "api-keys-file"
 )
 
 func RegisterAPIFlags(flags []cli.Flag) []cli.Flag {
@@ -26,20 +32,42 @@ func RegisterAPIFlags(flags []cli.Flag) []cli.Flag {
 			Usage:  "API secret for authentication",
 			EnvVar: "API_SECRET",
 		},
+		cli.StringFlag{
+			Name:   apiJWKSFileFlag,
+			Usage:  "JWKS file with keys for tokens carrying kid, re-read on change",
+			EnvVar: "API_JWKS_FILE",
+		},
+		cli.IntFlag{
+			Name:   apiJWKSOverlapFlag,
+			Usage:  "time in seconds a key removed from the JWKS file stays valid",
+			Value:  86400,
+			EnvVar: "API_JWKS_OVERLAP",
+		},
+		cli.StringFlag{
+			Name:   apiKeysFileFlag,
+			Usage:  "YAML file with API keys and their secrets and policies, re-read on change",
+			EnvVar: "API_KEYS_FILE",
+		},
 	)
 }
 
 type Claims struct {
 	apiKey    string
 	apiSecret string
+	jwks      *JWKS
+	keys      *APIKeys
+	revoked   *Revocations
 }
 // Rule describes an optional policy attached to a primary token. The grace
 // rule is the first kind: it carries a separate signed token that THP swaps
-// in on segment URLs while movie-time falls within DurationSec.
+// in on segment URLs while movie-time falls within DurationSec. The preview
+// rule limits anonymous roles to the first DurationSec of the movie, TotalSec
+// is the movie duration, used to cap progressive files.
 type Rule struct {
 	Kind        string `json:"kind"`
 	Scope       string `json:"scope"`
 	DurationSec int    `json:"duration_sec"`
+	TotalSec    int    `json:"total_sec,omitempty"`
 	Token       string `json:"token"`
 }
 
@@ -57,11 +85,18 @@ type rulesCtxKey struct{}
 // RulesContext is the per-request bundle that downstream rule-driven hooks
 // (manifest rewriting, future kinds) read from the request context. It carries
 // the validated claims plus the request inputs they need to apply rules
-// without re-parsing — primary token (for swaps) and infohash (for binding).
+// without re-parsing — primary token and api key (for swaps and injection)
+// and infohash (for binding) — the mod of the source, nil when the file
+// itself is requested, the ads config and the key signing segment URLs of
+// previews.
 type RulesContext struct {
 	Claims       jwt.MapClaims
 	PrimaryToken string
+	APIKey       string
 	InfoHash     string
+	Mod          *Mod
+	Ads          *AdsConfig
+	PreviewKey   string
 }
 
 func WithRulesContext(r *http.Request, rc *RulesContext) *http.Request {
@@ -100,6 +135,9 @@ func ExtractRules(claims jwt.MapClaims) []Rule {
 		if v, ok := m["duration_sec"].(float64); ok {
 			r.DurationSec = int(v)
 		}
+		if v, ok := m["total_sec"].(float64); ok {
+			r.TotalSec = int(v)
+		}
 		if v, ok := m["token"].(string); ok {
 			r.Token = v
 		}
@@ -108,16 +146,33 @@ func ExtractRules(claims jwt.MapClaims) []Rule {
 	return out
 }
 
-func NewClaims(c *cli.Context) *Claims {
-	return &Claims{
+func NewClaims(c *cli.Context, rc redis.UniversalClient) (*Claims, error) {
+	s := &Claims{
 		apiKey:    c.String(apiKeyFlag),
 		apiSecret: c.String(apiSecretFlag),
+		revoked:   NewRevocations(rc),
 	}
+	if f := c.String(apiJWKSFileFlag); f != "" {
+		jwks, err := NewJWKS(f, time.Duration(c.Int(apiJWKSOverlapFlag))*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		s.jwks = jwks
+	}
+	if f := c.String(apiKeysFileFlag); f != "" {
+		keys, err := NewAPIKeys(f)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.keys = keys
+	}
+	return s, nil
 }
 
 func (s *Claims) Get(tokenString string, apiKey string) (jwt.MapClaims, error) {
 
-	if s.apiKey == "" && s.apiSecret == "" {
+	if s.open() {
 		return jwt.MapClaims{}, nil
 	}
 
@@ -125,17 +180,14 @@ func (s *Claims) Get(tokenString string, apiKey string) (jwt.MapClaims, error) {
 		return nil, errors.Errorf("failed to get token")
 	}
 
-	if s.apiKey != apiKey {
-		return nil, errors.New("wrong api key")
+	secret, err := s.secret(apiKey)
+	// Without a secret only tokens of the JWKS may pass.
+	if err != nil && (s.jwks == nil || !errors.Is(err, errNoSecret)) {
+		return nil, err
 	}
 
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Don't forget to validate the alg is what you expect:
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.Errorf("Unexpected signing method=%v", token.Header["alg"])
-		}
-		// hmacSampleSecret is a []byte containing your secret, e.g. []byte("my_secret_key")
-		return []byte(s.apiSecret), nil
+		return s.key(token, secret)
 	})
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to parse token")
@@ -144,5 +196,100 @@ func (s *Claims) Get(tokenString string, apiKey string) (jwt.MapClaims, error) {
 	if !ok || !token.Valid {
 		return nil, errors.Wrapf(err, "failed to validate token")
 	}
+	if s.revoked != nil {
+		if err := s.revoked.Check(claims, apiKey); err != nil {
+			return nil, err
+		}
+	}
+	return claims, nil
+}
+
+// GetSigned returns claims of a signed url request to path, see SignURL.
+func (s *Claims) GetSigned(path string, q url.Values) (jwt.MapClaims, error) {
+	if s.open() {
+		return jwt.MapClaims{}, nil
+	}
+	apiKey := q.Get(signedURLAPIKeyParam)
+	secret, err := s.secret(apiKey)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := verifySignedURL(path, q, secret, time.Now())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to verify signed url")
+	}
+	if s.revoked != nil {
+		if err := s.revoked.Check(claims, apiKey); err != nil {
+			return nil, err
+		}
+	}
 	return claims, nil
 }
+
+func (s *Claims) open() bool {
+	return s.apiKey == "" && s.apiSecret == "" && s.jwks == nil && s.keys == nil
+}
+
+// errNoSecret is returned by secret when the api key has no HMAC secret,
+// e.g. the legacy key with only a keystore or a JWKS configured.
+var errNoSecret = errors.New("no secret for api key")
+
+// secret returns the HMAC secret of the api key: its own one from the
+// keystore or the global one for the legacy key. An empty secret is never
+// returned, it would verify tokens signed with an empty key.
+func (s *Claims) secret(apiKey string) (string, error) {
+	if k := s.GetAPIKey(apiKey); k != nil {
+		if !k.IsEnabled() {
+			return "", errors.New("api key is disabled")
+		}
+		if k.Secret == "" {
+			return "", errNoSecret
+		}
+		return k.Secret, nil
+	}
+	if s.apiKey != apiKey {
+		return "", errors.New("wrong api key")
+	}
+	if s.apiSecret == "" {
+		return "", errNoSecret
+	}
+	return s.apiSecret, nil
+}
+
+// key picks the verification key of the token: the JWKS one selected by kid,
+// or the HMAC secret of the api key for tokens without kid. Without a secret,
+// e.g. with only a JWKS configured, tokens must carry a kid.
+func (s *Claims) key(token *jwt.Token, secret string) (interface{}, error) {
+	if kid, _ := token.Header["kid"].(string); kid != "" && s.jwks != nil {
+		return s.jwks.Key(kid, token.Method)
+	}
+	if secret == "" {
+		return nil, errors.New("token without kid requires an HMAC secret")
+	}
+	// Don't forget to validate the alg is what you expect:
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, errors.Errorf("Unexpected signing method=%v", token.Header["alg"])
+	}
+	return []byte(secret), nil
+}
+
+// GetAPIKey returns the policy of the api key from the keystore, or nil if
+// the key isn't there.
+func (s *Claims) GetAPIKey(apiKey string) *APIKey {
+	if s.keys == nil || apiKey == "" {
+		return nil
+	}
+	return s.keys.Get(apiKey)
+}
+
+func (s *Claims) Close() {
+	if s.jwks != nil {
+		s.jwks.Close()
+	}
+	if s.keys != nil {
+		s.keys.Close()
+	}
+	if s.revoked != nil {
+		s.revoked.Close()
+	}
+}
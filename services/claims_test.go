@@ -0,0 +1,206 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func rsaJWK(kid string, k *rsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"alg": "RS256",
+		"use": "sig",
+		"n":   b64(k.N.Bytes()),
+		"e":   b64(big.NewInt(int64(k.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, k *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": "P-256",
+		"x":   b64(k.X.Bytes()),
+		"y":   b64(k.Y.Bytes()),
+	}
+}
+
+func writeJWKS(t *testing.T, path string, keys ...map[string]string) {
+	t.Helper()
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the reload sees a new modification time.
+	mt := time.Now().Add(time.Duration(len(keys)) * time.Second)
+	if err := os.Chtimes(path, mt, mt); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func signTestToken(t *testing.T, method jwt.SigningMethod, kid string, key interface{}) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, jwt.MapClaims{
+		"role": "free",
+		"exp":  time.Now().Add(time.Hour).Unix(),
+	})
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newTestClaims(t *testing.T, file string, overlap time.Duration) *Claims {
+	t.Helper()
+	c := &Claims{
+		apiKey:    "key",
+		apiSecret: "secret",
+	}
+	if file != "" {
+		jwks, err := NewJWKS(file, overlap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(jwks.Close)
+		c.jwks = jwks
+	}
+	return c
+}
+
+func TestClaims_JWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, rsaJWK("rsa-1", rsaKey), ecJWK("ec-1", ecKey))
+	c := newTestClaims(t, path, time.Hour)
+
+	for name, token := range map[string]string{
+		"RS256": signTestToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey),
+		"ES256": signTestToken(t, jwt.SigningMethodES256, "ec-1", ecKey),
+		"HS256": signTestToken(t, jwt.SigningMethodHS256, "", []byte("secret")),
+	} {
+		claims, err := c.Get(token, "key")
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if claims["role"] != "free" {
+			t.Fatalf("%s: unexpected claims: %v", name, claims)
+		}
+	}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, token := range map[string]string{
+		"unknown kid":   signTestToken(t, jwt.SigningMethodRS256, "rsa-2", rsaKey),
+		"wrong key":     signTestToken(t, jwt.SigningMethodRS256, "rsa-1", otherKey),
+		"alg of kid":    signTestToken(t, jwt.SigningMethodRS384, "rsa-1", rsaKey),
+		"HMAC with kid": signTestToken(t, jwt.SigningMethodHS256, "rsa-1", []byte("secret")),
+		"wrong secret":  signTestToken(t, jwt.SigningMethodHS256, "", []byte("other")),
+	} {
+		if _, err := c.Get(token, "key"); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
+
+func TestClaims_JWKSRotation(t *testing.T) {
+	oldKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, ecJWK("2026-01", oldKey))
+	c := newTestClaims(t, path, 100*time.Millisecond)
+	oldToken := signTestToken(t, jwt.SigningMethodES256, "2026-01", oldKey)
+	newToken := signTestToken(t, jwt.SigningMethodES256, "2026-02", newKey)
+	if _, err := c.Get(newToken, "key"); err == nil {
+		t.Fatal("expected token of unknown key to be rejected")
+	}
+
+	writeJWKS(t, path, ecJWK("2026-02", newKey))
+	changed, err := c.jwks.reload()
+	if err != nil || !changed {
+		t.Fatalf("expected jwks to reload, got %v, %v", changed, err)
+	}
+	if _, err := c.Get(newToken, "key"); err != nil {
+		t.Fatalf("expected token of new key to pass: %v", err)
+	}
+	if _, err := c.Get(oldToken, "key"); err != nil {
+		t.Fatalf("expected token of removed key to pass within overlap: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := c.Get(oldToken, "key"); err == nil {
+		t.Fatal("expected token of removed key to be rejected after overlap")
+	}
+}
+
+func TestJWKS_BadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	for name, data := range map[string]string{
+		"not json":     "keys",
+		"without kid":  `{"keys":[{"kty":"oct","k":"c2VjcmV0"}]}`,
+		"bad type":     `{"keys":[{"kty":"OKP","kid":"1"}]}`,
+		"bad curve":    `{"keys":[{"kty":"EC","kid":"1","crv":"P-192","x":"AA","y":"AA"}]}`,
+		"off curve":    `{"keys":[{"kty":"EC","kid":"1","crv":"P-256","x":"AQ","y":"AQ"}]}`,
+		"empty secret": `{"keys":[{"kty":"oct","kid":"1"}]}`,
+	} {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewJWKS(path, time.Hour); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+	if _, err := NewJWKS(filepath.Join(t.TempDir(), "missing.json"), time.Hour); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+}
+
+func TestClaims_EmptySecret(t *testing.T) {
+	c := &Claims{keys: &APIKeys{keys: map[string]*APIKey{"no-secret": {}}}}
+	token := signTestToken(t, jwt.SigningMethodHS256, "", []byte(""))
+	for _, apiKey := range []string{"", "no-secret"} {
+		if _, err := c.Get(token, apiKey); err == nil {
+			t.Fatalf("api key %q: expected token signed with an empty secret to be rejected", apiKey)
+		}
+	}
+	if _, err := c.key(&jwt.Token{Method: jwt.SigningMethodHS256, Header: map[string]interface{}{}}, ""); err == nil {
+		t.Fatal("expected empty HMAC key to be refused")
+	}
+}
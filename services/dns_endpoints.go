@@ -0,0 +1,315 @@
+package services
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsDefaultTimeout = 2 * time.Second
+	dnsMinTTL         = time.Second
+	dnsResolvConf     = "/etc/resolv.conf"
+)
+
+// DNSConfig configures the DNS endpoints provider. Record is the fully
+// qualified name to resolve, it defaults to the service name. Type is SRV
+// (default) or A; A records take the port from Port. Server is the
+// nameserver to ask, the first one of /etc/resolv.conf by default.
+type DNSConfig struct {
+	Record    string `yaml:"record"`
+	Type      string `yaml:"type"`
+	Port      int    `yaml:"port"`
+	ProbePort int    `yaml:"probePort"`
+	Server    string `yaml:"server"`
+	endpoints *DNSEndpoints
+}
+
+// DNSEndpoints resolves SRV or A records into endpoints and caches them for
+// the TTL of the answer. SRV targets are used as node names, so NodeHash
+// keeps an infohash on the same host. When a refresh fails the last known
+// records are served.
+type DNSEndpoints struct {
+	record    string
+	qtype     dnsmessage.Type
+	port      int
+	probePort int
+	server    string
+	timeout   time.Duration
+	mux       sync.Mutex
+	es        []Endpoint
+	expires   time.Time
+}
+
+func NewDNSEndpoints(name string, cfg *DNSConfig) (*DNSEndpoints, error) {
+	record := cfg.Record
+	if record == "" {
+		record = name
+	}
+	if !strings.HasSuffix(record, ".") {
+		record += "."
+	}
+	s := &DNSEndpoints{
+		record:    record,
+		port:      cfg.Port,
+		probePort: cfg.ProbePort,
+		server:    cfg.Server,
+		timeout:   dnsDefaultTimeout,
+	}
+	switch strings.ToUpper(cfg.Type) {
+	case "", "SRV":
+		s.qtype = dnsmessage.TypeSRV
+	case "A":
+		if cfg.Port == 0 {
+			return nil, errors.New("port is required for A records")
+		}
+		s.qtype = dnsmessage.TypeA
+	default:
+		return nil, errors.Errorf("unsupported record type %q", cfg.Type)
+	}
+	if s.server == "" {
+		server, err := systemNameserver()
+		if err != nil {
+			return nil, err
+		}
+		s.server = server
+	}
+	if _, _, err := net.SplitHostPort(s.server); err != nil {
+		s.server = net.JoinHostPort(s.server, "53")
+	}
+	return s, nil
+}
+
+// systemNameserver returns the first nameserver of /etc/resolv.conf.
+func systemNameserver() (string, error) {
+	f, err := os.Open(dnsResolvConf)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read nameserver, set it explicitly")
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return fields[1], nil
+		}
+	}
+	return "", errors.Errorf("no nameserver found in %s", dnsResolvConf)
+}
+
+// Get returns a copy of the cached endpoints, resolving them again once the
+// TTL has passed.
+func (s *DNSEndpoints) Get() ([]Endpoint, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.es != nil && time.Now().Before(s.expires) {
+		return append([]Endpoint(nil), s.es...), nil
+	}
+	es, ttl, err := s.lookup()
+	if err != nil && s.es != nil {
+		log.WithError(err).Warnf("failed to refresh dns records for %s, serving stale ones", s.record)
+		s.expires = time.Now().Add(dnsMinTTL)
+		return append([]Endpoint(nil), s.es...), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.es = es
+	s.expires = time.Now().Add(ttl)
+	return append([]Endpoint(nil), s.es...), nil
+}
+
+func (s *DNSEndpoints) lookup() ([]Endpoint, time.Duration, error) {
+	if s.qtype == dnsmessage.TypeA {
+		ips, ttl, err := s.lookupA(s.record, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		es := make([]Endpoint, 0, len(ips))
+		for _, ip := range ips {
+			es = append(es, Endpoint{
+				IP: ip,
+				Ports: Ports{
+					HTTP:  s.port,
+					Probe: s.probePort,
+				},
+			})
+		}
+		return es, ttl, nil
+	}
+	msg, err := s.query(s.record, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	var ttl time.Duration
+	var es []Endpoint
+	for _, a := range msg.Answers {
+		srv, ok := a.Body.(*dnsmessage.SRVResource)
+		if !ok {
+			continue
+		}
+		ttl = minTTL(ttl, a.Header.TTL)
+		ips, ipTTL, err := s.lookupA(srv.Target.String(), msg.Additionals)
+		if err != nil {
+			log.WithError(err).Warnf("failed to resolve srv target %s", srv.Target)
+			continue
+		}
+		ttl = minTTLDuration(ttl, ipTTL)
+		for _, ip := range ips {
+			es = append(es, Endpoint{
+				IP:       ip,
+				NodeName: strings.TrimSuffix(srv.Target.String(), "."),
+				Ports: Ports{
+					HTTP:  int(srv.Port),
+					Probe: s.probePort,
+				},
+			})
+		}
+	}
+	if len(es) == 0 {
+		return nil, 0, errors.Errorf("no srv records found for %s", s.record)
+	}
+	return es, ttl, nil
+}
+
+// lookupA resolves name, taking the addresses from additional records of an
+// SRV answer when the server already sent them.
+func (s *DNSEndpoints) lookupA(name string, additionals []dnsmessage.Resource) ([]string, time.Duration, error) {
+	var ttl time.Duration
+	var ips []string
+	for _, a := range additionals {
+		if r, ok := a.Body.(*dnsmessage.AResource); ok && strings.EqualFold(a.Header.Name.String(), name) {
+			ips = append(ips, net.IP(r.A[:]).String())
+			ttl = minTTL(ttl, a.Header.TTL)
+		}
+	}
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+	msg, err := s.query(name, dnsmessage.TypeA)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, a := range msg.Answers {
+		if r, ok := a.Body.(*dnsmessage.AResource); ok {
+			ips = append(ips, net.IP(r.A[:]).String())
+			ttl = minTTL(ttl, a.Header.TTL)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, 0, errors.Errorf("no a records found for %s", name)
+	}
+	return ips, ttl, nil
+}
+
+func minTTL(cur time.Duration, ttl uint32) time.Duration {
+	return minTTLDuration(cur, time.Duration(ttl)*time.Second)
+}
+
+// minTTLDuration keeps the shortest TTL of an answer, never going below
+// dnsMinTTL so a zero TTL doesn't turn every request into a query.
+func minTTLDuration(cur time.Duration, ttl time.Duration) time.Duration {
+	if ttl < dnsMinTTL {
+		ttl = dnsMinTTL
+	}
+	if cur == 0 || ttl < cur {
+		return ttl
+	}
+	return cur
+}
+
+func (s *DNSEndpoints) query(name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to make dns name from %s", name)
+	}
+	q := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               uint16(rand.Intn(1 << 16)),
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{{
+			Name:  n,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	req, err := q.Pack()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to pack dns query")
+	}
+	res, err := s.exchange("udp", req)
+	if err != nil {
+		return nil, err
+	}
+	msg := &dnsmessage.Message{}
+	if err := msg.Unpack(res); err != nil {
+		return nil, errors.Wrap(err, "failed to unpack dns response")
+	}
+	if msg.Truncated {
+		res, err = s.exchange("tcp", req)
+		if err != nil {
+			return nil, err
+		}
+		msg = &dnsmessage.Message{}
+		if err := msg.Unpack(res); err != nil {
+			return nil, errors.Wrap(err, "failed to unpack dns response")
+		}
+	}
+	if msg.ID != q.ID {
+		return nil, errors.Errorf("dns response id mismatch for %s", name)
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess {
+		return nil, errors.Errorf("dns query for %s failed with %v", name, msg.RCode)
+	}
+	return msg, nil
+}
+
+func (s *DNSEndpoints) exchange(network string, req []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, s.server, s.timeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to dial nameserver %s", s.server)
+	}
+	defer func(conn net.Conn) {
+		_ = conn.Close()
+	}(conn)
+	_ = conn.SetDeadline(time.Now().Add(s.timeout))
+	if network == "udp" {
+		if _, err := conn.Write(req); err != nil {
+			return nil, errors.Wrap(err, "failed to send dns query")
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read dns response")
+		}
+		return buf[:n], nil
+	}
+	msg := make([]byte, 2+len(req))
+	binary.BigEndian.PutUint16(msg, uint16(len(req)))
+	copy(msg[2:], req)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, errors.Wrap(err, "failed to send dns query")
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, errors.Wrap(err, "failed to read dns response")
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, errors.Wrap(err, "failed to read dns response")
+	}
+	return buf, nil
+}
@@ -0,0 +1,342 @@
+package services
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testDNSServer is a minimal in-process nameserver. It answers from a fixed
+// set of records and counts queries, so caching can be asserted.
+type testDNSServer struct {
+	addr     string
+	udp      net.PacketConn
+	tcp      net.Listener
+	mux      sync.Mutex
+	srv      map[string][]dnsmessage.SRVResource
+	a        map[string][]string
+	ttl      uint32
+	truncate bool
+	queries  atomic.Int32
+}
+
+func newTestDNSServer(t *testing.T) *testDNSServer {
+	t.Helper()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp, err := net.ListenPacket("udp", tcp.Addr().String())
+	if err != nil {
+		_ = tcp.Close()
+		t.Skipf("failed to bind udp next to tcp: %v", err)
+	}
+	s := &testDNSServer{
+		addr: tcp.Addr().String(),
+		udp:  udp,
+		tcp:  tcp,
+		srv:  map[string][]dnsmessage.SRVResource{},
+		a:    map[string][]string{},
+		ttl:  30,
+	}
+	go s.serveUDP()
+	go s.serveTCP()
+	t.Cleanup(func() {
+		_ = udp.Close()
+		_ = tcp.Close()
+	})
+	return s
+}
+
+func (s *testDNSServer) setSRV(name string, port uint16, targets ...string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var rs []dnsmessage.SRVResource
+	for _, t := range targets {
+		rs = append(rs, dnsmessage.SRVResource{
+			Port:   port,
+			Target: dnsmessage.MustNewName(t),
+		})
+	}
+	s.srv[name] = rs
+}
+
+func (s *testDNSServer) setA(name string, ips ...string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.a[name] = ips
+}
+
+func (s *testDNSServer) answer(req []byte, tcp bool) []byte {
+	s.queries.Add(1)
+	var q dnsmessage.Message
+	if err := q.Unpack(req); err != nil || len(q.Questions) != 1 {
+		return nil
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	question := q.Questions[0]
+	name := question.Name.String()
+	res := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:            q.ID,
+			Response:      true,
+			Authoritative: true,
+		},
+		Questions: q.Questions,
+	}
+	hdr := func(n string) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{
+			Name:  dnsmessage.MustNewName(n),
+			Class: dnsmessage.ClassINET,
+			TTL:   s.ttl,
+		}
+	}
+	aResource := func(ip string) *dnsmessage.AResource {
+		r := &dnsmessage.AResource{}
+		copy(r.A[:], net.ParseIP(ip).To4())
+		return r
+	}
+	switch question.Type {
+	case dnsmessage.TypeSRV:
+		rs, ok := s.srv[name]
+		if !ok {
+			res.RCode = dnsmessage.RCodeNameError
+		}
+		if s.truncate && !tcp {
+			res.Truncated = true
+			break
+		}
+		for i := range rs {
+			r := rs[i]
+			res.Answers = append(res.Answers, dnsmessage.Resource{Header: hdr(name), Body: &r})
+			// Send addresses of the first target only, the rest are
+			// looked up separately.
+			if i == 0 {
+				for _, ip := range s.a[r.Target.String()] {
+					res.Additionals = append(res.Additionals, dnsmessage.Resource{Header: hdr(r.Target.String()), Body: aResource(ip)})
+				}
+			}
+		}
+	case dnsmessage.TypeA:
+		ips, ok := s.a[name]
+		if !ok {
+			res.RCode = dnsmessage.RCodeNameError
+		}
+		for _, ip := range ips {
+			res.Answers = append(res.Answers, dnsmessage.Resource{Header: hdr(name), Body: aResource(ip)})
+		}
+	}
+	b, _ := res.Pack()
+	return b
+}
+
+func (s *testDNSServer) serveUDP() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if res := s.answer(buf[:n], false); res != nil {
+			_, _ = s.udp.WriteTo(res, addr)
+		}
+	}
+}
+
+func (s *testDNSServer) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer func(conn net.Conn) {
+				_ = conn.Close()
+			}(conn)
+			var l [2]byte
+			if _, err := io.ReadFull(conn, l[:]); err != nil {
+				return
+			}
+			req := make([]byte, binary.BigEndian.Uint16(l[:]))
+			if _, err := io.ReadFull(conn, req); err != nil {
+				return
+			}
+			res := s.answer(req, true)
+			out := make([]byte, 2+len(res))
+			binary.BigEndian.PutUint16(out, uint16(len(res)))
+			copy(out[2:], res)
+			_, _ = conn.Write(out)
+		}(conn)
+	}
+}
+
+func TestDNSEndpoints_SRV(t *testing.T) {
+	srv := newTestDNSServer(t)
+	srv.setSRV("seeder.service.consul.", 8080, "node-1.node.consul.", "node-2.node.consul.")
+	srv.setA("node-1.node.consul.", "10.0.0.1", "10.0.0.2")
+	srv.setA("node-2.node.consul.", "10.0.1.1")
+	es, err := NewDNSEndpoints("torrent-web-seeder", &DNSConfig{
+		Record: "seeder.service.consul",
+		Server: srv.addr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := es.Get()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	nodes := map[string]string{}
+	for _, e := range got {
+		if e.HTTP != 8080 {
+			t.Errorf("unexpected port: %+v", e)
+		}
+		nodes[e.IP] = e.NodeName
+	}
+	expected := map[string]string{
+		"10.0.0.1": "node-1.node.consul",
+		"10.0.0.2": "node-1.node.consul",
+		"10.0.1.1": "node-2.node.consul",
+	}
+	if len(nodes) != len(expected) {
+		t.Fatalf("unexpected endpoints: %+v", got)
+	}
+	for ip, n := range expected {
+		if nodes[ip] != n {
+			t.Errorf("endpoint %s: expected node %s, got %s", ip, n, nodes[ip])
+		}
+	}
+}
+
+func TestDNSEndpoints_CachesPerTTL(t *testing.T) {
+	srv := newTestDNSServer(t)
+	srv.ttl = 1
+	srv.setA("seeder.webtor.svc.cluster.local.", "10.0.0.1")
+	es, err := NewDNSEndpoints("torrent-web-seeder", &DNSConfig{
+		Record: "seeder.webtor.svc.cluster.local.",
+		Type:   "A",
+		Port:   8080,
+		Server: srv.addr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		got, err := es.Get()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(got) != 1 || got[0].IP != "10.0.0.1" || got[0].HTTP != 8080 {
+			t.Fatalf("unexpected endpoints: %+v", got)
+		}
+	}
+	if q := srv.queries.Load(); q != 1 {
+		t.Fatalf("expected a single query within ttl, got %d", q)
+	}
+
+	srv.setA("seeder.webtor.svc.cluster.local.", "10.0.0.1", "10.0.0.2")
+	time.Sleep(1100 * time.Millisecond)
+	got, err := es.Get()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected refreshed records after ttl, got %+v", got)
+	}
+
+	// Records that disappear are served stale instead of failing requests.
+	srv.mux.Lock()
+	delete(srv.a, "seeder.webtor.svc.cluster.local.")
+	srv.mux.Unlock()
+	time.Sleep(1100 * time.Millisecond)
+	got, err = es.Get()
+	if err != nil || len(got) != 2 {
+		t.Fatalf("expected stale records, got %+v, %v", got, err)
+	}
+}
+
+func TestDNSEndpoints_TruncatedFallsBackToTCP(t *testing.T) {
+	srv := newTestDNSServer(t)
+	srv.truncate = true
+	srv.setSRV("seeder.service.consul.", 8080, "node-1.node.consul.")
+	srv.setA("node-1.node.consul.", "10.0.0.1")
+	es, err := NewDNSEndpoints("torrent-web-seeder", &DNSConfig{
+		Record: "seeder.service.consul.",
+		Server: srv.addr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := es.Get()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 1 || got[0].IP != "10.0.0.1" {
+		t.Fatalf("unexpected endpoints: %+v", got)
+	}
+}
+
+func TestDNSEndpoints_Errors(t *testing.T) {
+	srv := newTestDNSServer(t)
+	es, err := NewDNSEndpoints("torrent-web-seeder", &DNSConfig{
+		Record: "missing.service.consul.",
+		Server: srv.addr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := es.Get(); err == nil {
+		t.Fatal("expected error for missing record")
+	}
+	if _, err := NewDNSEndpoints("torrent-web-seeder", &DNSConfig{Type: "A", Server: srv.addr}); err == nil {
+		t.Fatal("expected error for A records without port")
+	}
+	if _, err := NewDNSEndpoints("torrent-web-seeder", &DNSConfig{Type: "MX", Server: srv.addr}); err == nil {
+		t.Fatal("expected error for unsupported record type")
+	}
+}
+
+func TestServiceLocation_DNS(t *testing.T) {
+	srv := newTestDNSServer(t)
+	srv.setSRV("seeder.service.consul.", 8080, "node-1.node.consul.", "node-2.node.consul.")
+	srv.setA("node-1.node.consul.", "10.0.0.1", "10.0.0.2")
+	srv.setA("node-2.node.consul.", "10.0.1.1")
+	for _, d := range []Distribution{Hash, NodeHash, Rendezvous, NodeRendezvous} {
+		cfg := &ServiceConfig{
+			Name:              "torrent-web-seeder",
+			Distribution:      d,
+			EndpointsProvider: DNS,
+			DNS: &DNSConfig{
+				Record: "seeder.service.consul.",
+				Server: srv.addr,
+			},
+		}
+		if err := loadDNSConfig(cfg); err != nil {
+			t.Fatal(err)
+		}
+		sl := NewServiceLocationPool(newTestContext(), okClient, nil, nil, nil, nil)
+		src := &Source{InfoHash: "08ada5a7a6183aae1e09d831df6748d566095a10"}
+		loc, err := sl.Get(cfg, src, nil)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", d, err)
+		}
+		if loc.Unavailable || loc.HTTP != 8080 {
+			t.Fatalf("%v: unexpected location: %+v", d, loc)
+		}
+		// The failed endpoint is skipped.
+		fb, err := sl.GetFallback(cfg, src, loc.IP, nil)
+		if err != nil {
+			t.Fatalf("%v: unexpected fallback error: %v", d, err)
+		}
+		if fb.IP.Equal(loc.IP) {
+			t.Fatalf("%v: fallback returned the failed endpoint %v", d, loc.IP)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	HealthCheckIntervalFlag           = "health-check-interval"
+	HealthCheckTimeoutFlag            = "health-check-timeout"
+	HealthCheckUnhealthyThresholdFlag = "health-check-unhealthy-threshold"
+	HealthCheckHealthyThresholdFlag   = "health-check-healthy-threshold"
+	OutlierConsecutive5xxFlag         = "outlier-consecutive-5xx"
+	OutlierConsecutiveErrorsFlag      = "outlier-consecutive-errors"
+	OutlierBaseEjectionTimeFlag       = "outlier-base-ejection-time"
+	OutlierMaxEjectionTimeFlag        = "outlier-max-ejection-time"
+)
+
+const (
+	ejectReasonHealthCheck = "health_check"
+	ejectReason5xx         = "5xx"
+	ejectReasonConnection  = "connection"
+)
+
+// healthHostTTL is how long a host that no resolution returned anymore is
+// still checked. Scaled down pods drop out after it, ejected or not.
+const healthHostTTL = 10 * time.Minute
+
+var (
+	promUpstreamEjected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "webtor_http_proxy_upstream_ejected",
+		Help: "Upstream hosts currently ejected from load balancing, by reason",
+	}, []string{"host", "reason"})
+	promUpstreamEjections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webtor_http_proxy_upstream_ejections_total",
+		Help: "Total number of upstream host ejections",
+	}, []string{"reason"})
+	promHealthChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webtor_http_proxy_health_checks_total",
+		Help: "Total number of active upstream health checks",
+	}, []string{"outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(promUpstreamEjected, promUpstreamEjections, promHealthChecks)
+}
+
+func RegisterHealthCheckerFlags(f []cli.Flag) []cli.Flag {
+	return append(f,
+		cli.IntFlag{
+			Name:   HealthCheckIntervalFlag,
+			Usage:  "interval between active upstream health checks in seconds (0 disables them)",
+			Value:  10,
+			EnvVar: "HEALTH_CHECK_INTERVAL",
+		},
+		cli.IntFlag{
+			Name:   HealthCheckTimeoutFlag,
+			Usage:  "active upstream health check timeout in seconds",
+			Value:  3,
+			EnvVar: "HEALTH_CHECK_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   HealthCheckUnhealthyThresholdFlag,
+			Usage:  "consecutive failed health checks to eject an upstream",
+			Value:  2,
+			EnvVar: "HEALTH_CHECK_UNHEALTHY_THRESHOLD",
+		},
+		cli.IntFlag{
+			Name:   HealthCheckHealthyThresholdFlag,
+			Usage:  "consecutive passed health checks to re-admit an ejected upstream",
+			Value:  1,
+			EnvVar: "HEALTH_CHECK_HEALTHY_THRESHOLD",
+		},
+		cli.IntFlag{
+			Name:   OutlierConsecutive5xxFlag,
+			Usage:  "consecutive 5xx responses to eject an upstream (0 disables it)",
+			Value:  5,
+			EnvVar: "OUTLIER_CONSECUTIVE_5XX",
+		},
+		cli.IntFlag{
+			Name:   OutlierConsecutiveErrorsFlag,
+			Usage:  "consecutive connection failures to eject an upstream (0 disables it)",
+			Value:  3,
+			EnvVar: "OUTLIER_CONSECUTIVE_ERRORS",
+		},
+		cli.IntFlag{
+			Name:   OutlierBaseEjectionTimeFlag,
+			Usage:  "first ejection time of an upstream in seconds, doubled on every repeated ejection",
+			Value:  30,
+			EnvVar: "OUTLIER_BASE_EJECTION_TIME",
+		},
+		cli.IntFlag{
+			Name:   OutlierMaxEjectionTimeFlag,
+			Usage:  "max ejection time of an upstream in seconds",
+			Value:  300,
+			EnvVar: "OUTLIER_MAX_EJECTION_TIME",
+		},
+	)
+}
+
+// hostHealth is the health state of a single upstream IP.
+type hostHealth struct {
+	addr              string
+	seen              time.Time
+	failures          int
+	successes         int
+	consecutive5xx    int
+	consecutiveErrors int
+	ejected           bool
+	reason            string
+	ejectedAt         time.Time
+	until             time.Time
+	ejections         int
+}
+
+// HealthChecker tracks the health of upstream hosts returned by endpoint
+// providers. Hosts are probed in the background and ejected either after
+// failing consecutive checks or passively, after consecutive 5xx responses
+// or connection failures of proxied requests. An ejected host comes back
+// once its ejection time is over and, with active checks on, it passes them
+// again. The ejection time doubles each time the host is ejected again
+// shortly after.
+type HealthChecker struct {
+	cl                 *http.Client
+	interval           time.Duration
+	timeout            time.Duration
+	unhealthyThreshold int
+	healthyThreshold   int
+	max5xx             int
+	maxErrors          int
+	baseEjection       time.Duration
+	maxEjection        time.Duration
+	mux                sync.Mutex
+	hosts              map[string]*hostHealth
+	subscribers        []func(ip string)
+	closeCh            chan struct{}
+	closeOnce          sync.Once
+}
+
+func NewHealthChecker(c *cli.Context, cl *http.Client) *HealthChecker {
+	h := &HealthChecker{
+		cl:                 cl,
+		interval:           time.Duration(c.Int(HealthCheckIntervalFlag)) * time.Second,
+		timeout:            time.Duration(c.Int(HealthCheckTimeoutFlag)) * time.Second,
+		unhealthyThreshold: c.Int(HealthCheckUnhealthyThresholdFlag),
+		healthyThreshold:   c.Int(HealthCheckHealthyThresholdFlag),
+		max5xx:             c.Int(OutlierConsecutive5xxFlag),
+		maxErrors:          c.Int(OutlierConsecutiveErrorsFlag),
+		baseEjection:       time.Duration(c.Int(OutlierBaseEjectionTimeFlag)) * time.Second,
+		maxEjection:        time.Duration(c.Int(OutlierMaxEjectionTimeFlag)) * time.Second,
+		hosts:              map[string]*hostHealth{},
+		closeCh:            make(chan struct{}),
+	}
+	if h.timeout <= 0 {
+		h.timeout = 3 * time.Second
+	}
+	if h.unhealthyThreshold <= 0 {
+		h.unhealthyThreshold = 1
+	}
+	if h.healthyThreshold <= 0 {
+		h.healthyThreshold = 1
+	}
+	if h.baseEjection <= 0 {
+		h.baseEjection = 30 * time.Second
+	}
+	if h.maxEjection < h.baseEjection {
+		h.maxEjection = h.baseEjection
+	}
+	if h.active() {
+		go h.run()
+	}
+	return h
+}
+
+func (s *HealthChecker) active() bool {
+	return s.cl != nil && s.interval > 0
+}
+
+func (s *HealthChecker) Subscribe(f func(ip string)) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.subscribers = append(s.subscribers, f)
+}
+
+// Filter starts tracking es and returns the ones that are not ejected.
+func (s *HealthChecker) Filter(es []Endpoint) []Endpoint {
+	now := time.Now()
+	var res []Endpoint
+	var added []string
+	var readmitted []string
+	s.mux.Lock()
+	for _, e := range es {
+		ip := net.ParseIP(e.IP).String()
+		port := e.Ports.Probe
+		if port == 0 {
+			port = e.Ports.HTTP
+		}
+		h, ok := s.hosts[ip]
+		if !ok {
+			h = &hostHealth{}
+			s.hosts[ip] = h
+			added = append(added, ip)
+		}
+		h.addr = net.JoinHostPort(ip, fmt.Sprint(port))
+		h.seen = now
+		if h.ejected && s.readmittable(h, now) {
+			s.readmit(ip, h)
+			readmitted = append(readmitted, ip)
+		}
+		if h.ejected {
+			continue
+		}
+		res = append(res, e)
+	}
+	s.mux.Unlock()
+	if s.active() {
+		// New hosts are checked right away instead of waiting for the next
+		// round, so a dead one goes out within seconds.
+		for _, ip := range added {
+			go s.check(ip)
+		}
+	}
+	s.notify(readmitted...)
+	return res
+}
+
+// IsEjected reports whether the host with the given IP is ejected.
+func (s *HealthChecker) IsEjected(ip string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	h, ok := s.hosts[ip]
+	return ok && h.ejected
+}
+
+// ReportStatus records the status code of a proxied response. Only hosts
+// handed out by Filter are accounted.
+func (s *HealthChecker) ReportStatus(ip string, code int) {
+	var ejected bool
+	s.mux.Lock()
+	h, ok := s.hosts[ip]
+	if ok {
+		if code >= 500 {
+			h.consecutive5xx++
+			if s.max5xx > 0 && h.consecutive5xx >= s.max5xx {
+				ejected = s.eject(ip, h, ejectReason5xx)
+			}
+		} else {
+			h.consecutive5xx = 0
+			h.consecutiveErrors = 0
+		}
+	}
+	s.mux.Unlock()
+	if ejected {
+		s.notify(ip)
+	}
+}
+
+// ReportError records a failed connection to the host: a refused or reset
+// request or a stream broken in the middle.
+func (s *HealthChecker) ReportError(ip string) {
+	var ejected bool
+	s.mux.Lock()
+	h, ok := s.hosts[ip]
+	if ok {
+		h.consecutiveErrors++
+		if s.maxErrors > 0 && h.consecutiveErrors >= s.maxErrors {
+			ejected = s.eject(ip, h, ejectReasonConnection)
+		}
+	}
+	s.mux.Unlock()
+	if ejected {
+		s.notify(ip)
+	}
+}
+
+// eject takes the host out for the back-off period. Must be called with mux
+// held.
+func (s *HealthChecker) eject(ip string, h *hostHealth, reason string) bool {
+	if h.ejected {
+		return false
+	}
+	now := time.Now()
+	// A host that has been fine for a while starts over from the base
+	// ejection time.
+	if !h.ejectedAt.IsZero() && now.Sub(h.ejectedAt) > 2*s.maxEjection {
+		h.ejections = 0
+	}
+	h.ejections++
+	d := s.baseEjection
+	for i := 1; i < h.ejections && d < s.maxEjection; i++ {
+		d *= 2
+	}
+	if d > s.maxEjection {
+		d = s.maxEjection
+	}
+	h.ejected = true
+	h.reason = reason
+	h.ejectedAt = now
+	h.until = now.Add(d)
+	h.failures = 0
+	h.successes = 0
+	h.consecutive5xx = 0
+	h.consecutiveErrors = 0
+	promUpstreamEjected.WithLabelValues(ip, reason).Set(1)
+	promUpstreamEjections.WithLabelValues(reason).Inc()
+	log.Warnf("upstream %s ejected for %v, reason: %s", ip, d, reason)
+	return true
+}
+
+// readmittable reports whether the ejection of h is over. With active checks
+// on, the host must pass them as well. Must be called with mux held.
+func (s *HealthChecker) readmittable(h *hostHealth, now time.Time) bool {
+	if now.Before(h.until) {
+		return false
+	}
+	return !s.active() || h.successes >= s.healthyThreshold
+}
+
+// readmit puts the host back to load balancing. Must be called with mux held.
+func (s *HealthChecker) readmit(ip string, h *hostHealth) {
+	promUpstreamEjected.DeleteLabelValues(ip, h.reason)
+	log.Infof("upstream %s re-admitted after %v, reason was: %s", ip, time.Since(h.ejectedAt).Round(time.Second), h.reason)
+	h.ejected = false
+	h.reason = ""
+	h.failures = 0
+	h.successes = 0
+}
+
+func (s *HealthChecker) notify(ips ...string) {
+	if len(ips) == 0 {
+		return
+	}
+	s.mux.Lock()
+	subs := append([]func(string){}, s.subscribers...)
+	s.mux.Unlock()
+	for _, ip := range ips {
+		for _, f := range subs {
+			f(ip)
+		}
+	}
+}
+
+func (s *HealthChecker) run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case <-ticker.C:
+		}
+		s.checkAll()
+	}
+}
+
+func (s *HealthChecker) checkAll() {
+	now := time.Now()
+	var ips []string
+	s.mux.Lock()
+	for ip, h := range s.hosts {
+		if now.Sub(h.seen) > healthHostTTL {
+			if h.ejected {
+				promUpstreamEjected.DeleteLabelValues(ip, h.reason)
+			}
+			delete(s.hosts, ip)
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	s.mux.Unlock()
+	var wg sync.WaitGroup
+	for _, ip := range ips {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			s.check(ip)
+		}(ip)
+	}
+	wg.Wait()
+}
+
+// check probes the host once and updates its state.
+func (s *HealthChecker) check(ip string) {
+	s.mux.Lock()
+	h, ok := s.hosts[ip]
+	var addr string
+	if ok {
+		addr = h.addr
+	}
+	s.mux.Unlock()
+	if !ok {
+		return
+	}
+	err := s.probe(addr)
+	var ejected, readmitted bool
+	s.mux.Lock()
+	if err != nil {
+		promHealthChecks.WithLabelValues("failure").Inc()
+		h.successes = 0
+		h.failures++
+		if !h.ejected && h.failures >= s.unhealthyThreshold {
+			log.WithError(err).Warnf("health check of upstream %s failed %d times", addr, h.failures)
+			ejected = s.eject(ip, h, ejectReasonHealthCheck)
+		}
+	} else {
+		promHealthChecks.WithLabelValues("success").Inc()
+		h.failures = 0
+		h.successes++
+		if h.ejected && s.readmittable(h, time.Now()) {
+			s.readmit(ip, h)
+			readmitted = true
+		}
+	}
+	s.mux.Unlock()
+	if ejected || readmitted {
+		s.notify(ip)
+	}
+}
+
+func (s *HealthChecker) probe(addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+addr, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.cl.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+	if resp.StatusCode >= 500 {
+		return errors.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *HealthChecker) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+	})
+}
+
+// outlierTransport reports results of requests to upstream pods to the
+// HealthChecker. It sits under redirectFollowingTransport, so redirect
+// targets outside the cluster are not accounted to the pod.
+type outlierTransport struct {
+	http.RoundTripper
+	health *HealthChecker
+}
+
+func (t *outlierTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	ip := hostIP(req.URL.Host)
+	if err != nil {
+		if isRetryableError(err) {
+			t.health.ReportError(ip)
+		}
+		return nil, err
+	}
+	t.health.ReportStatus(ip, resp.StatusCode)
+	return resp, nil
+}
+
+// hostIP strips the port of a "host:port" string.
+func hostIP(host string) string {
+	ip, _, err := net.SplitHostPort(host)
+	if err != nil {
+		return host
+	}
+	return ip
+}
@@ -0,0 +1,259 @@
+package services
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testHealthEndpoints are three upstreams on two nodes.
+var testHealthEndpoints = []Endpoint{
+	{IP: "10.0.0.1", NodeName: "node-1", Ports: Ports{HTTP: 8080, Probe: 8081}},
+	{IP: "10.0.0.2", NodeName: "node-1", Ports: Ports{HTTP: 8080}},
+	{IP: "10.0.1.1", NodeName: "node-2", Ports: Ports{HTTP: 8080}},
+}
+
+// probeClient answers probes with the status set per host, 200 by default.
+type probeClient struct {
+	mux    sync.Mutex
+	status map[string]int
+	hosts  []string
+}
+
+func (p *probeClient) set(host string, code int) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.status[host] = code
+}
+
+func (p *probeClient) client() *http.Client {
+	return &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		p.mux.Lock()
+		defer p.mux.Unlock()
+		p.hosts = append(p.hosts, req.URL.Host)
+		code, ok := p.status[req.URL.Host]
+		if !ok {
+			code = http.StatusOK
+		}
+		return &http.Response{
+			StatusCode: code,
+			Body:       io.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	})}
+}
+
+// newTestHealthChecker returns a checker without a client, tests set one to
+// turn active checks on and drive them through checkAll.
+func newTestHealthChecker() *HealthChecker {
+	h := NewHealthChecker(newTestContext(RegisterHealthCheckerFlags), nil)
+	h.baseEjection = 50 * time.Millisecond
+	h.maxEjection = 200 * time.Millisecond
+	return h
+}
+
+func ips(es []Endpoint) []string {
+	var res []string
+	for _, e := range es {
+		res = append(res, e.IP)
+	}
+	return res
+}
+
+func TestHealthChecker_Consecutive5xx(t *testing.T) {
+	h := newTestHealthChecker()
+	h.Filter(testHealthEndpoints)
+	for i := 0; i < h.max5xx-1; i++ {
+		h.ReportStatus("10.0.0.1", http.StatusBadGateway)
+	}
+	// A good response in between starts the count over.
+	h.ReportStatus("10.0.0.1", http.StatusOK)
+	for i := 0; i < h.max5xx-1; i++ {
+		h.ReportStatus("10.0.0.1", http.StatusBadGateway)
+	}
+	if h.IsEjected("10.0.0.1") {
+		t.Fatal("expected host to stay while 5xx are not consecutive")
+	}
+	h.ReportStatus("10.0.0.1", http.StatusServiceUnavailable)
+	if !h.IsEjected("10.0.0.1") {
+		t.Fatal("expected host to be ejected after consecutive 5xx")
+	}
+	if got := ips(h.Filter(testHealthEndpoints)); len(got) != 2 || got[0] != "10.0.0.2" {
+		t.Fatalf("expected ejected host to be filtered out, got %v", got)
+	}
+	// Hosts that were never handed out are not tracked.
+	for i := 0; i < h.max5xx; i++ {
+		h.ReportStatus("192.168.0.1", http.StatusBadGateway)
+	}
+	if h.IsEjected("192.168.0.1") {
+		t.Fatal("expected untracked host to be ignored")
+	}
+}
+
+func TestHealthChecker_BackOff(t *testing.T) {
+	h := newTestHealthChecker()
+	h.Filter(testHealthEndpoints)
+	eject := func() time.Duration {
+		for i := 0; i < h.maxErrors; i++ {
+			h.ReportError("10.0.0.2")
+		}
+		h.mux.Lock()
+		defer h.mux.Unlock()
+		hh := h.hosts["10.0.0.2"]
+		if !hh.ejected || hh.reason != ejectReasonConnection {
+			t.Fatalf("expected connection ejection, got %+v", hh)
+		}
+		return hh.until.Sub(hh.ejectedAt)
+	}
+	for _, expected := range []time.Duration{50, 100, 200, 200} {
+		if d := eject(); d != expected*time.Millisecond {
+			t.Fatalf("expected ejection for %v, got %v", expected*time.Millisecond, d)
+		}
+		if len(h.Filter(testHealthEndpoints)) != 2 {
+			t.Fatal("expected ejected host to be filtered out")
+		}
+		time.Sleep(h.maxEjection + 10*time.Millisecond)
+		// Without active checks the host is back when the time is over.
+		if len(h.Filter(testHealthEndpoints)) != 3 {
+			t.Fatal("expected host to be re-admitted")
+		}
+	}
+}
+
+func TestHealthChecker_Active(t *testing.T) {
+	pc := &probeClient{status: map[string]int{"10.0.0.1:8081": http.StatusInternalServerError}}
+	h := newTestHealthChecker()
+	var notified []string
+	h.Subscribe(func(ip string) {
+		notified = append(notified, ip)
+	})
+	h.Filter(testHealthEndpoints)
+	h.cl = pc.client()
+	for i := 0; i < h.unhealthyThreshold; i++ {
+		h.checkAll()
+	}
+	if !h.IsEjected("10.0.0.1") || h.IsEjected("10.0.0.2") || h.IsEjected("10.0.1.1") {
+		t.Fatal("expected only the failing host to be ejected")
+	}
+	for _, host := range pc.hosts {
+		if host == "10.0.0.1:8080" {
+			t.Fatal("expected probe port to be checked")
+		}
+	}
+
+	// The ejection time is over, but the host still fails its checks.
+	time.Sleep(h.baseEjection)
+	h.checkAll()
+	if len(h.Filter(testHealthEndpoints)) != 2 {
+		t.Fatal("expected failing host to stay ejected")
+	}
+
+	pc.set("10.0.0.1:8081", http.StatusOK)
+	h.checkAll()
+	if len(h.Filter(testHealthEndpoints)) != 3 {
+		t.Fatal("expected recovered host to be re-admitted")
+	}
+	if len(notified) != 2 || notified[0] != "10.0.0.1" || notified[1] != "10.0.0.1" {
+		t.Fatalf("expected ejection and re-admission to be notified, got %v", notified)
+	}
+}
+
+func TestOutlierTransport(t *testing.T) {
+	h := newTestHealthChecker()
+	h.Filter(testHealthEndpoints)
+	var fail bool
+	tr := &outlierTransport{roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if fail {
+			return nil, syscall.ECONNREFUSED
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	}), h}
+	do := func() {
+		req, _ := http.NewRequest("GET", "http://10.0.1.1:8080/file", nil)
+		if resp, err := tr.RoundTrip(req); err == nil {
+			_ = resp.Body.Close()
+		}
+	}
+	fail = true
+	for i := 0; i < h.maxErrors-1; i++ {
+		do()
+	}
+	fail = false
+	do()
+	fail = true
+	for i := 0; i < h.maxErrors-1; i++ {
+		do()
+	}
+	if h.IsEjected("10.0.1.1") {
+		t.Fatal("expected host to stay while failures are not consecutive")
+	}
+	do()
+	if !h.IsEjected("10.0.1.1") {
+		t.Fatal("expected host to be ejected after consecutive connection failures")
+	}
+}
+
+func TestServiceLocation_EjectedHostIsSkipped(t *testing.T) {
+	cfg := testStaticConfig(t, Hash,
+		StaticEndpoint{Address: "10.0.0.1:8080"},
+		StaticEndpoint{Address: "10.0.0.2:8080"},
+	)
+	defer cfg.Static.endpoints.Close()
+	sl := NewServiceLocationPool(newTestContext(RegisterHealthCheckerFlags), nil, nil, nil, nil, nil)
+	defer sl.Close()
+	src := &Source{InfoHash: "08ada5a7a6183aae1e09d831df6748d566095a10"}
+	loc, err := sl.Get(cfg, src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := loc.IP.String()
+	for i := 0; i < sl.health.max5xx; i++ {
+		sl.health.ReportStatus(first, http.StatusBadGateway)
+	}
+	// The cached location is dropped together with the ejection.
+	loc, err = sl.Get(cfg, src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.Unavailable || loc.IP.String() == first {
+		t.Fatalf("expected another host than ejected %s, got %+v", first, loc)
+	}
+}
+
+func TestHealthChecker_ExpiresStaleHosts(t *testing.T) {
+	pc := &probeClient{status: map[string]int{"10.0.0.1:8081": http.StatusInternalServerError}}
+	h := newTestHealthChecker()
+	h.Filter(testHealthEndpoints)
+	h.cl = pc.client()
+	for i := 0; i < h.unhealthyThreshold; i++ {
+		h.checkAll()
+	}
+	if !h.IsEjected("10.0.0.1") {
+		t.Fatal("expected failing host to be ejected")
+	}
+
+	// The pods are gone, none of them is resolved anymore.
+	h.mux.Lock()
+	for _, hh := range h.hosts {
+		hh.seen = time.Now().Add(-healthHostTTL - time.Second)
+	}
+	h.mux.Unlock()
+	h.checkAll()
+	h.mux.Lock()
+	n := len(h.hosts)
+	h.mux.Unlock()
+	if n != 0 {
+		t.Fatalf("expected stale hosts to be dropped, %d left", n)
+	}
+	if promUpstreamEjected.DeleteLabelValues("10.0.0.1", ejectReasonHealthCheck) {
+		t.Fatal("expected ejection series of the dropped host to be deleted")
+	}
+}
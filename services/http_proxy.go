@@ -7,7 +7,6 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"strings"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -23,6 +22,7 @@ const (
 	proxyWriteBufferSizeFlag = "proxy-write-buffer-size"
 	retryMaxAttemptsFlag     = "retry-max-attempts"
 	retryDelayFlag           = "retry-delay"
+	proxyResponseTimeoutFlag = "proxy-response-header-timeout"
 )
 
 type HTTPProxy struct {
@@ -33,6 +33,7 @@ type HTTPProxy struct {
 	maxRetries        int
 	retryDelay        time.Duration
 	fileSizeCache     *FileSizeCache
+	breakers          *CircuitBreakers
 }
 
 func NewHTTPProxy(c *cli.Context, r *Resolver, retryDelay time.Duration, fsc *FileSizeCache) *HTTPProxy {
@@ -46,10 +47,14 @@ func NewHTTPProxy(c *cli.Context, r *Resolver, retryDelay time.Duration, fsc *Fi
 			IdleConnTimeout:     30 * time.Second,
 			WriteBufferSize:     writeBuf,
 			ReadBufferSize:      readBuf,
+			// Upstreams that hang count as failures of their circuit
+			// breaker only with a timeout.
+			ResponseHeaderTimeout: time.Duration(c.Int(proxyResponseTimeoutFlag)) * time.Second,
 		},
 		maxRetries:    c.Int(retryMaxAttemptsFlag),
 		retryDelay:    retryDelay,
 		fileSizeCache: fsc,
+		breakers:      NewCircuitBreakers(c),
 		LazyMap: lazymap.New[*httputil.ReverseProxy](&lazymap.Config{
 			Expire: 60 * time.Second,
 		}),
@@ -90,6 +95,11 @@ func RegisterHTTPProxyFlags(f []cli.Flag) []cli.Flag {
 			Value:  1000,
 			EnvVar: "RETRY_DELAY_MS",
 		},
+		cli.IntFlag{
+			Name:   proxyResponseTimeoutFlag,
+			Usage:  "time in seconds to wait for upstream response headers (0 waits forever)",
+			EnvVar: "PROXY_RESPONSE_HEADER_TIMEOUT",
+		},
 	)
 }
 
@@ -194,7 +204,11 @@ func (s *HTTPProxy) get(loc *Location) (*httputil.ReverseProxy, error) {
 	if loc.Unavailable {
 		t = &stubTransport{s.transport}
 	} else {
-		t = &redirectFollowingTransport{s.transport, s.externalTransport}
+		var pt http.RoundTripper = &outlierTransport{s.transport, s.r.svcLoc.health}
+		if b := s.breakers.Get(u.Host); b != nil {
+			pt = &breakerTransport{pt, b}
+		}
+		t = &redirectFollowingTransport{pt, s.externalTransport}
 		if s.maxRetries > 0 {
 			t = &retryTransport{RoundTripper: t}
 		}
@@ -203,15 +217,16 @@ func (s *HTTPProxy) get(loc *Location) (*httputil.ReverseProxy, error) {
 	p.Transport = t
 	p.ModifyResponse = s.modifyResponse
 	p.FlushInterval = -1
-	// Strip Accept-Encoding for .m3u8 paths so backend (nginx-vod, content-transcoder)
-	// returns plain text. modifyResponse rewrites segment tokens via byte-level
-	// substring match, which silently fails on a gzipped body — needle never
-	// found, gzipped body passes through unchanged. Manifests are tiny (<200 KB);
-	// edge gzip via ingress/CDN remains effective for the wire.
+	// Strip Accept-Encoding for .m3u8 and .mpd paths so backend (nginx-vod,
+	// content-transcoder) returns plain text. modifyResponse rewrites segment
+	// tokens via byte-level substring match, which silently fails on a gzipped
+	// body — needle never found, gzipped body passes through unchanged.
+	// Manifests are tiny (<200 KB); edge gzip via ingress/CDN remains
+	// effective for the wire.
 	defaultDirector := p.Director
 	p.Director = func(req *http.Request) {
 		defaultDirector(req)
-		if strings.HasSuffix(req.URL.Path, ".m3u8") {
+		if isManifest(req.URL.Path) {
 			req.Header.Del("Accept-Encoding")
 		}
 	}
@@ -223,7 +238,36 @@ func (s *HTTPProxy) Get(src *Source, claims jwt.MapClaims, logger *logrus.Entry)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get location")
 	}
+	if !loc.Unavailable {
+		loc = s.breakerLocation(src, claims, loc, logger)
+	}
 	return s.LazyMap.Get(fmt.Sprintf("%s:%d", loc.IP.String(), loc.HTTP), func() (*httputil.ReverseProxy, error) {
 		return s.get(loc)
 	})
 }
+
+// breakerLocation routes the request to a fallback location when the breaker
+// of loc is open. If there is none, or its breaker is open as well, the
+// request gets an unavailable location instead of waiting for a failure.
+func (s *HTTPProxy) breakerLocation(src *Source, claims jwt.MapClaims, loc *Location, logger *logrus.Entry) *Location {
+	b := s.breakers.Get(fmt.Sprintf("%s:%d", loc.IP.String(), loc.HTTP))
+	if b == nil || b.Allow() {
+		return loc
+	}
+	fb, err := s.r.ResolveFallback(src, claims, loc.IP, logger)
+	if err != nil {
+		logger.WithError(err).Warn("circuit breaker is open, failed to resolve fallback location")
+		promBreakerFallbacks.WithLabelValues("unavailable").Inc()
+		return &Location{Unavailable: true}
+	}
+	if fb.Unavailable {
+		promBreakerFallbacks.WithLabelValues("unavailable").Inc()
+		return fb
+	}
+	if b := s.breakers.Get(fmt.Sprintf("%s:%d", fb.IP.String(), fb.HTTP)); b != nil && !b.Allow() {
+		promBreakerFallbacks.WithLabelValues("unavailable").Inc()
+		return &Location{Unavailable: true}
+	}
+	promBreakerFallbacks.WithLabelValues("fallback").Inc()
+	return fb
+}
@@ -266,7 +266,13 @@ func (s *HybridBucketPool) Get(mc jwt.MapClaims) (Throttler, error) {
 	if !ok {
 		return nil, nil
 	}
-	key := sessionID + rate
+	return s.GetShared(sessionID, rate)
+}
+
+// GetShared returns the bucket of rate shared by all requests of id, a
+// session or a quota scope.
+func (s *HybridBucketPool) GetShared(id string, rate string) (Throttler, error) {
+	key := id + rate
 	r, err := bytefmt.ToBytes(rate)
 	if err != nil {
 		return nil, errors.Errorf("failed to parse rate %v", rate)
@@ -275,6 +281,6 @@ func (s *HybridBucketPool) Get(mc jwt.MapClaims) (Throttler, error) {
 		bytesPerSec := float64(r) / 8
 		// capacity == rate: at most one second of idle accrual, no extra
 		// burst beyond what the configured rate allows.
-		return NewHybridBucket(bytesPerSec, bytesPerSec, s.rc, sessionID), nil
+		return NewHybridBucket(bytesPerSec, bytesPerSec, s.rc, id), nil
 	})
 }
@@ -0,0 +1,251 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const jwksFileCheckInterval = 5 * time.Second
+
+// jwk is a single JSON Web Key. Only signature keys are supported: RSA, EC
+// and symmetric ("oct") ones.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+type jwksKey struct {
+	alg       string
+	key       interface{}
+	removedAt time.Time
+}
+
+// JWKS holds token verification keys by kid, loaded from a JWKS file that is
+// re-read when it changes. A key dropped from the file stays valid for the
+// overlap window, so tokens signed with it before a rotation keep working
+// until they expire.
+type JWKS struct {
+	file      string
+	overlap   time.Duration
+	interval  time.Duration
+	mux       sync.RWMutex
+	keys      map[string]*jwksKey
+	modTime   time.Time
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+func NewJWKS(file string, overlap time.Duration) (*JWKS, error) {
+	s := &JWKS{
+		file:     file,
+		overlap:  overlap,
+		interval: jwksFileCheckInterval,
+		keys:     map[string]*jwksKey{},
+		closeCh:  make(chan struct{}),
+	}
+	if _, err := s.reload(); err != nil {
+		return nil, err
+	}
+	go s.watch()
+	return s, nil
+}
+
+// reload re-reads the file if its modification time changed.
+func (s *JWKS) reload() (bool, error) {
+	st, err := os.Stat(s.file)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to stat jwks file %s", s.file)
+	}
+	s.mux.RLock()
+	same := st.ModTime().Equal(s.modTime)
+	s.mux.RUnlock()
+	if same {
+		return false, nil
+	}
+	data, err := os.ReadFile(s.file)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read jwks file %s", s.file)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to parse jwks file %s", s.file)
+	}
+	now := time.Now()
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for kid, k := range s.keys {
+		if _, ok := keys[kid]; ok {
+			continue
+		}
+		if k.removedAt.IsZero() {
+			k.removedAt = now
+		}
+		if now.Sub(k.removedAt) < s.overlap {
+			keys[kid] = k
+		}
+	}
+	s.keys = keys
+	s.modTime = st.ModTime()
+	return true, nil
+}
+
+func (s *JWKS) watch() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case <-ticker.C:
+		}
+		changed, err := s.reload()
+		if err != nil {
+			// Keep the keys we have, a half-written file must not log
+			// everybody out.
+			log.WithError(err).Warn("failed to reload jwks")
+			continue
+		}
+		if changed {
+			log.Infof("jwks reloaded from %s", s.file)
+		}
+	}
+}
+
+// Key returns the key with the given kid for verifying a token signed with
+// method.
+func (s *JWKS) Key(kid string, method jwt.SigningMethod) (interface{}, error) {
+	s.mux.RLock()
+	k, ok := s.keys[kid]
+	s.mux.RUnlock()
+	if !ok || (!k.removedAt.IsZero() && time.Since(k.removedAt) >= s.overlap) {
+		return nil, errors.Errorf("unknown key kid=%v", kid)
+	}
+	if k.alg != "" && k.alg != method.Alg() {
+		return nil, errors.Errorf("unexpected signing method=%v for key kid=%v", method.Alg(), kid)
+	}
+	switch key := k.key.(type) {
+	case *rsa.PublicKey:
+		if _, ok := method.(*jwt.SigningMethodRSA); ok {
+			return key, nil
+		}
+	case *ecdsa.PublicKey:
+		if m, ok := method.(*jwt.SigningMethodECDSA); ok && m.CurveBits == key.Curve.Params().BitSize {
+			return key, nil
+		}
+	case []byte:
+		if _, ok := method.(*jwt.SigningMethodHMAC); ok {
+			return key, nil
+		}
+	}
+	return nil, errors.Errorf("unexpected signing method=%v for key kid=%v", method.Alg(), kid)
+}
+
+func (s *JWKS) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+	})
+}
+
+func parseJWKS(data []byte) (map[string]*jwksKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]*jwksKey{}
+	for _, j := range set.Keys {
+		if j.Kid == "" {
+			return nil, errors.New("key without kid")
+		}
+		if j.Use != "" && j.Use != "sig" {
+			continue
+		}
+		key, err := j.publicKey()
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse key kid=%v", j.Kid)
+		}
+		keys[j.Kid] = &jwksKey{
+			alg: j.Alg,
+			key: key,
+		}
+	}
+	return keys, nil
+}
+
+func (s *jwk) publicKey() (interface{}, error) {
+	switch s.Kty {
+	case "RSA":
+		n, err := decodeJWKInt(s.N)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad modulus")
+		}
+		e, err := decodeJWKInt(s.E)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch s.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("unsupported curve %q", s.Crv)
+		}
+		x, err := decodeJWKInt(s.X)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad x coordinate")
+		}
+		y, err := decodeJWKInt(s.Y)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad y coordinate")
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "oct":
+		k, err := base64.RawURLEncoding.DecodeString(s.K)
+		if err != nil || len(k) == 0 {
+			return nil, errors.New("bad symmetric key")
+		}
+		return k, nil
+	default:
+		return nil, errors.Errorf("unsupported key type %q", s.Kty)
+	}
+}
+
+func decodeJWKInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
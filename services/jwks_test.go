@@ -0,0 +1,43 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestClaims_JWKSOnly(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, ecJWK("ec-1", ecKey))
+	jwks, err := NewJWKS(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(jwks.Close)
+	c := &Claims{jwks: jwks}
+
+	if _, err := c.Get(signTestToken(t, jwt.SigningMethodES256, "ec-1", ecKey), ""); err != nil {
+		t.Fatalf("expected token with kid to pass: %v", err)
+	}
+	for name, token := range map[string]string{
+		"HMAC without kid":  signTestToken(t, jwt.SigningMethodHS256, "", []byte("")),
+		"ES256 without kid": signTestToken(t, jwt.SigningMethodES256, "", ecKey),
+		"HMAC with kid":     signTestToken(t, jwt.SigningMethodHS256, "ec-1", []byte("")),
+	} {
+		if _, err := c.Get(token, ""); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+	if _, err := c.Get(signTestToken(t, jwt.SigningMethodES256, "ec-1", ecKey), "unknown"); err == nil {
+		t.Fatal("expected unknown api key to be rejected")
+	}
+}
@@ -14,9 +14,8 @@ import (
 )
 
 type Client struct {
-	cl     *kubernetes.Clientset
+	cl     kubernetes.Interface
 	inited bool
-	err    error
 	mux    sync.Mutex
 }
 
@@ -24,7 +23,16 @@ func NewClient() *Client {
 	return &Client{}
 }
 
-func (s *Client) get() (*kubernetes.Clientset, error) {
+// NewClientFromInterface wraps an already constructed clientset (e.g. the
+// client-go fake one in tests) so it skips kubeconfig discovery entirely.
+func NewClientFromInterface(cl kubernetes.Interface) *Client {
+	return &Client{
+		cl:     cl,
+		inited: true,
+	}
+}
+
+func (s *Client) get() (kubernetes.Interface, error) {
 	kubeconfig := filepath.Join(os.Getenv("HOME"), ".kube", "config")
 	log.Infof("checking local kubeconfig path=%s", kubeconfig)
 	var config *rest.Config
@@ -46,13 +54,17 @@ func (s *Client) get() (*kubernetes.Clientset, error) {
 	return kubernetes.NewForConfig(config)
 }
 
-func (s *Client) Get() (*kubernetes.Clientset, error) {
+func (s *Client) Get() (kubernetes.Interface, error) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 	if s.inited {
-		return s.cl, s.err
+		return s.cl, nil
+	}
+	cl, err := s.get()
+	if err != nil {
+		return nil, err
 	}
-	s.cl, s.err = s.get()
+	s.cl = cl
 	s.inited = true
-	return s.cl, s.err
+	return s.cl, nil
 }
@@ -0,0 +1,193 @@
+package k8s
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// EndpointSlices watches discovery.k8s.io/v1 EndpointSlices with a shared
+// informer, so added and removed pods are visible as soon as the API server
+// reports them. Subscribers are notified with the service name on every
+// change.
+type EndpointSlices struct {
+	cl          *Client
+	namespace   string
+	syncTimeout time.Duration
+	startMux    sync.Mutex
+	informer    cache.SharedIndexInformer
+	synced      bool
+	lister      discoverylisters.EndpointSliceLister
+	stopCh      chan struct{}
+	mux         sync.RWMutex
+	subscribers []func(name string)
+}
+
+func NewEndpointSlices(c *cli.Context, cl *Client) *EndpointSlices {
+	return &EndpointSlices{
+		cl:          cl,
+		namespace:   c.String(endpointsNamespaceFlag),
+		syncTimeout: 30 * time.Second,
+		stopCh:      make(chan struct{}),
+	}
+}
+
+func (s *EndpointSlices) Subscribe(f func(name string)) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.subscribers = append(s.subscribers, f)
+}
+
+func (s *EndpointSlices) notify(obj interface{}) {
+	if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = d.Obj
+	}
+	es, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return
+	}
+	name := es.Labels[discoveryv1.LabelServiceName]
+	if name == "" {
+		return
+	}
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	for _, f := range s.subscribers {
+		f(name)
+	}
+}
+
+// start runs the informer once and waits for its cache to sync. Failures are
+// not latched: the informer keeps running in the background, so the next
+// call waits for the sync again, and a failed client is requested again.
+func (s *EndpointSlices) start() error {
+	s.startMux.Lock()
+	defer s.startMux.Unlock()
+	if s.synced {
+		return nil
+	}
+	if s.informer == nil {
+		if err := s.run(); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.syncTimeout)
+	defer cancel()
+	if !cache.WaitForCacheSync(ctx.Done(), s.informer.HasSynced) {
+		return errors.New("failed to sync endpoint slices cache")
+	}
+	s.synced = true
+	return nil
+}
+
+func (s *EndpointSlices) run() error {
+	cl, err := s.cl.Get()
+	if err != nil {
+		return errors.Wrap(err, "failed to get k8s client")
+	}
+	log.Infof("watching k8s endpoint slices in %s", s.namespace)
+	factory := informers.NewSharedInformerFactoryWithOptions(cl, 0, informers.WithNamespace(s.namespace))
+	informer := factory.Discovery().V1().EndpointSlices()
+	_, err = informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: s.notify,
+		UpdateFunc: func(_, obj interface{}) {
+			s.notify(obj)
+		},
+		DeleteFunc: s.notify,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to add endpoint slices event handler")
+	}
+	s.lister = informer.Lister()
+	s.informer = informer.Informer()
+	factory.Start(s.stopCh)
+	return nil
+}
+
+// GetAddresses returns addresses of the service that are ready to receive
+// traffic. Endpoints that are terminating but still serving are used only
+// when nothing else is left, so in-flight rollouts don't end up with an
+// empty set.
+func (s *EndpointSlices) GetAddresses(name string) ([]Address, error) {
+	if err := s.start(); err != nil {
+		return nil, err
+	}
+	slices, err := s.lister.EndpointSlices(s.namespace).List(labels.SelectorFromSet(labels.Set{
+		discoveryv1.LabelServiceName: name,
+	}))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list k8s endpoint slices for %s", name)
+	}
+	if len(slices) == 0 {
+		return nil, errors.Errorf("no k8s endpoint slices found for %s", name)
+	}
+	// Slices come from the informer cache in random order; keep results
+	// stable so duplicates (an address moving between slices) resolve the
+	// same way every time.
+	sort.Slice(slices, func(i, j int) bool {
+		return slices[i].Name < slices[j].Name
+	})
+	var ready, serving []Address
+	seen := map[string]bool{}
+	for _, es := range slices {
+		if es.AddressType == discoveryv1.AddressTypeFQDN {
+			continue
+		}
+		ports := map[string]int{}
+		for _, p := range es.Ports {
+			if p.Name != nil && p.Port != nil {
+				ports[*p.Name] = int(*p.Port)
+			}
+		}
+		for _, e := range es.Endpoints {
+			if len(e.Addresses) == 0 || seen[e.Addresses[0]] {
+				continue
+			}
+			a := Address{
+				IP:    e.Addresses[0],
+				Ports: ports,
+			}
+			if e.NodeName != nil {
+				a.NodeName = *e.NodeName
+			}
+			if e.TargetRef != nil && e.TargetRef.Kind == "Pod" {
+				a.PodName = e.TargetRef.Name
+			}
+			c := e.Conditions
+			if isTrue(c.Ready, true) && !isTrue(c.Terminating, false) {
+				seen[a.IP] = true
+				ready = append(ready, a)
+			} else if isTrue(c.Serving, false) {
+				seen[a.IP] = true
+				serving = append(serving, a)
+			}
+		}
+	}
+	if len(ready) > 0 {
+		return ready, nil
+	}
+	return serving, nil
+}
+
+// isTrue reads an optional EndpointConditions field. Per the API, an unset
+// condition should be interpreted as def.
+func isTrue(b *bool, def bool) bool {
+	if b == nil {
+		return def
+	}
+	return *b
+}
+
+func (s *EndpointSlices) Close() {
+	close(s.stopCh)
+}
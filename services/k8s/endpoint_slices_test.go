@@ -0,0 +1,190 @@
+package k8s
+
+import (
+	"context"
+	"flag"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func testEndpointSlice(name string, service string, endpoints ...discoveryv1.Endpoint) *discoveryv1.EndpointSlice {
+	portName := "http"
+	port := int32(8080)
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "webtor",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   endpoints,
+		Ports:       []discoveryv1.EndpointPort{{Name: &portName, Port: &port}},
+	}
+}
+
+func testEndpoint(ip string, node string, ready bool, serving bool, terminating bool) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		Addresses: []string{ip},
+		NodeName:  &node,
+		Conditions: discoveryv1.EndpointConditions{
+			Ready:       boolPtr(ready),
+			Serving:     boolPtr(serving),
+			Terminating: boolPtr(terminating),
+		},
+	}
+}
+
+func newTestEndpointSlices(cs *fake.Clientset) *EndpointSlices {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, f := range RegisterEndpointsFlags(nil) {
+		f.Apply(set)
+	}
+	return NewEndpointSlices(cli.NewContext(nil, set, nil), NewClientFromInterface(cs))
+}
+
+func addressIPs(as []Address) []string {
+	var res []string
+	for _, a := range as {
+		res = append(res, a.IP)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestEndpointSlicesGetAddresses_Conditions(t *testing.T) {
+	cs := fake.NewClientset(
+		testEndpointSlice("seeder-a", "seeder",
+			testEndpoint("10.0.0.1", "node-1", true, true, false),
+			testEndpoint("10.0.0.2", "node-1", false, false, false),
+		),
+		testEndpointSlice("seeder-b", "seeder",
+			testEndpoint("10.0.0.3", "node-2", false, true, true),
+			// Same address reported by two slices during a transition.
+			testEndpoint("10.0.0.1", "node-1", true, true, false),
+		),
+		testEndpointSlice("other-a", "other",
+			testEndpoint("10.0.1.1", "node-1", true, true, false),
+		),
+	)
+	es := newTestEndpointSlices(cs)
+	defer es.Close()
+
+	as, err := es.GetAddresses("seeder")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := addressIPs(as); len(got) != 1 || got[0] != "10.0.0.1" {
+		t.Fatalf("expected only the ready endpoint, got %v", got)
+	}
+	if as[0].NodeName != "node-1" || as[0].Ports["http"] != 8080 {
+		t.Fatalf("unexpected address: %+v", as[0])
+	}
+}
+
+func TestEndpointSlicesGetAddresses_TerminatingServingFallback(t *testing.T) {
+	cs := fake.NewClientset(
+		testEndpointSlice("seeder-a", "seeder",
+			testEndpoint("10.0.0.1", "node-1", false, true, true),
+			testEndpoint("10.0.0.2", "node-1", false, false, true),
+		),
+	)
+	es := newTestEndpointSlices(cs)
+	defer es.Close()
+
+	as, err := es.GetAddresses("seeder")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := addressIPs(as); len(got) != 1 || got[0] != "10.0.0.1" {
+		t.Fatalf("expected terminating but serving endpoint, got %v", got)
+	}
+}
+
+func TestEndpointSlicesGetAddresses_PushesRemoval(t *testing.T) {
+	slice := testEndpointSlice("seeder-a", "seeder",
+		testEndpoint("10.0.0.1", "node-1", true, true, false),
+		testEndpoint("10.0.0.2", "node-2", true, true, false),
+	)
+	cs := fake.NewClientset(slice)
+	es := newTestEndpointSlices(cs)
+	defer es.Close()
+	changed := make(chan string, 10)
+	es.Subscribe(func(name string) {
+		changed <- name
+	})
+
+	as, err := es.GetAddresses("seeder")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(as) != 2 {
+		t.Fatalf("expected 2 addresses, got %v", addressIPs(as))
+	}
+	<-changed // initial add
+
+	updated := slice.DeepCopy()
+	updated.Endpoints = updated.Endpoints[1:]
+	if _, err := cs.DiscoveryV1().EndpointSlices("webtor").Update(context.Background(), updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update slice: %v", err)
+	}
+	select {
+	case name := <-changed:
+		if name != "seeder" {
+			t.Fatalf("unexpected service notified: %s", name)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscriber was not notified about removal")
+	}
+	as, err = es.GetAddresses("seeder")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := addressIPs(as); len(got) != 1 || got[0] != "10.0.0.2" {
+		t.Fatalf("expected removed pod to disappear, got %v", got)
+	}
+}
+
+func TestEndpointSlicesGetAddresses_RetriesFailedSync(t *testing.T) {
+	cs := fake.NewClientset(testEndpointSlice("seeder-a", "seeder",
+		testEndpoint("10.0.0.1", "node-1", true, true, false),
+	))
+	var failing atomic.Bool
+	failing.Store(true)
+	cs.PrependReactor("list", "endpointslices", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if failing.Load() {
+			return true, nil, errors.New("api server is unavailable")
+		}
+		return false, nil, nil
+	})
+	es := newTestEndpointSlices(cs)
+	defer es.Close()
+	es.syncTimeout = 100 * time.Millisecond
+
+	if _, err := es.GetAddresses("seeder"); err == nil {
+		t.Fatal("expected sync error")
+	}
+
+	failing.Store(false)
+	es.syncTimeout = 10 * time.Second
+	as, err := es.GetAddresses("seeder")
+	if err != nil {
+		t.Fatalf("unexpected error after api server recovered: %v", err)
+	}
+	if got := addressIPs(as); len(got) != 1 || got[0] != "10.0.0.1" {
+		t.Fatalf("unexpected addresses: %v", got)
+	}
+}
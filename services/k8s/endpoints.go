@@ -14,6 +14,7 @@ import (
 
 const (
 	endpointsNamespaceFlag = "endpoints-namespace"
+	EndpointsWatchFlag     = "endpoints-watch"
 )
 
 func RegisterEndpointsFlags(f []cli.Flag) []cli.Flag {
@@ -24,9 +25,36 @@ func RegisterEndpointsFlags(f []cli.Flag) []cli.Flag {
 			Value:  "webtor",
 			EnvVar: "ENDPOINTS_NAMESPACE",
 		},
+		cli.BoolFlag{
+			Name:   EndpointsWatchFlag,
+			Usage:  "watch discovery.k8s.io/v1 EndpointSlices instead of polling Endpoints",
+			EnvVar: "ENDPOINTS_WATCH",
+		},
 	)
 }
 
+// Address is a single endpoint address with its named ports, flattened out
+// of Endpoints subsets or EndpointSlices.
+type Address struct {
+	IP       string
+	NodeName string
+	PodName  string
+	Ports    map[string]int
+}
+
+// EndpointsGetter resolves the ready addresses of a service. Implemented by
+// the polling Endpoints pool and the watch-based EndpointSlices.
+type EndpointsGetter interface {
+	GetAddresses(name string) ([]Address, error)
+}
+
+// EndpointsSubscriber is implemented by getters that learn about changes
+// right away and can push them to the caller instead of waiting for a cache
+// to expire.
+type EndpointsSubscriber interface {
+	Subscribe(f func(name string))
+}
+
 type Endpoints struct {
 	*lazymap.LazyMap[*corev1.Endpoints]
 	cl        *Client
@@ -59,3 +87,35 @@ func (s *Endpoints) Get(name string) (*corev1.Endpoints, error) {
 		return endpoints, nil
 	})
 }
+
+// GetAddresses returns ready addresses of every subset of the service.
+func (s *Endpoints) GetAddresses(name string) ([]Address, error) {
+	endpoints, err := s.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	var res []Address
+	for _, sub := range endpoints.Subsets {
+		ports := map[string]int{}
+		for _, p := range sub.Ports {
+			ports[p.Name] = int(p.Port)
+		}
+		for _, a := range sub.Addresses {
+			nodeName := ""
+			if a.NodeName != nil {
+				nodeName = *a.NodeName
+			}
+			podName := ""
+			if a.TargetRef != nil && a.TargetRef.Kind == "Pod" {
+				podName = a.TargetRef.Name
+			}
+			res = append(res, Address{
+				IP:       a.IP,
+				NodeName: nodeName,
+				PodName:  podName,
+				Ports:    ports,
+			})
+		}
+	}
+	return res, nil
+}
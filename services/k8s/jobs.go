@@ -0,0 +1,558 @@
+package k8s
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"github.com/webtor-io/lazymap"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+)
+
+const (
+	jobNamespaceFlag         = "job-namespace"
+	jobNodeAffinityKeyFlag   = "job-node-affinity-key"
+	jobNodeAffinityValueFlag = "job-node-affinity-value"
+	jobActiveDeadlineFlag    = "job-active-deadline"
+)
+
+const (
+	jobNameLabel      = "job-name"
+	jobManagedByLabel = "webtor.io/managed-by"
+	jobManagedByValue = "torrent-http-proxy"
+
+	// jobLastUsedAnnotation is when any replica last requested the job
+	// (RFC 3339), jobIdleTTLAnnotation is how long after it the job is
+	// deleted (Go duration).
+	jobLastUsedAnnotation = "webtor.io/last-used"
+	jobIdleTTLAnnotation  = "webtor.io/idle-ttl"
+)
+
+const (
+	// jobTTLAfterFinished lets Kubernetes delete finished jobs nobody
+	// requests anymore.
+	jobTTLAfterFinished int32 = 60
+
+	// jobSweepInterval is how often jobs idle for their TTL are looked
+	// up, e.g. those left behind by a restarted replica.
+	jobSweepInterval = time.Minute
+)
+
+// ErrJobNotReady is returned when the job's pod didn't become ready within
+// the configured timeout.
+var ErrJobNotReady = errors.New("job pod is not ready")
+
+// ErrJobFinished is returned when the job has already completed or failed,
+// so it will never get a ready pod. The job is deleted and the next request
+// deploys a fresh one.
+var ErrJobFinished = errors.New("job is finished")
+
+func RegisterJobsFlags(f []cli.Flag) []cli.Flag {
+	return append(f,
+		cli.StringFlag{
+			Name:   jobNamespaceFlag,
+			Usage:  "Job namespace",
+			Value:  "webtor",
+			EnvVar: "JOB_NAMESPACE",
+		},
+		cli.StringFlag{
+			Name:   jobNodeAffinityKeyFlag,
+			Usage:  "Node Affinity Key",
+			EnvVar: "JOB_NODE_AFFINITY_KEY",
+		},
+		cli.StringFlag{
+			Name:   jobNodeAffinityValueFlag,
+			Usage:  "Node Affinity Value",
+			EnvVar: "JOB_NODE_AFFINITY_VALUE",
+		},
+		cli.IntFlag{
+			Name:   jobActiveDeadlineFlag,
+			Usage:  "activeDeadlineSeconds of jobs whose template doesn't set one, a backstop to idle cleanup (0 = none)",
+			Value:  86400,
+			EnvVar: "JOB_ACTIVE_DEADLINE",
+		},
+	)
+}
+
+// LoadJobTemplate reads a batch/v1 Job manifest from disk. It is used as the
+// base object for every on-demand job of a service.
+func LoadJobTemplate(filename string) (*batchv1.Job, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read job template %s", filename)
+	}
+	obj, _, err := scheme.Codecs.UniversalDeserializer().Decode(data, nil, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode job template %s", filename)
+	}
+	job, ok := obj.(*batchv1.Job)
+	if !ok {
+		return nil, errors.Errorf("job template %s is %T, not a batch/v1 Job", filename, obj)
+	}
+	if len(job.Spec.Template.Spec.Containers) == 0 {
+		return nil, errors.Errorf("job template %s has no containers", filename)
+	}
+	return job, nil
+}
+
+// JobRequest describes a single on-demand job. Jobs with equal Name and Key
+// share one Kubernetes Job object.
+type JobRequest struct {
+	Name         string
+	Key          string
+	Template     *batchv1.Job
+	Env          map[string]string
+	ReadyTimeout time.Duration
+	TTL          time.Duration
+}
+
+// JobPod is the ready pod that serves a deployed job.
+type JobPod struct {
+	Name     string
+	IP       string
+	NodeName string
+	Ports    map[string]int
+}
+
+// Jobs deploys Kubernetes Jobs on demand and waits for their pods to become
+// ready. Creation is idempotent: the job name is derived from the request
+// key, so concurrent callers (and other proxy replicas) end up on the same
+// Job. Jobs that weren't requested for TTL are deleted. Replicas share when
+// a job was last used through an annotation on it, so that none deletes a
+// job another one still uses, and jobs left behind by a restart are swept.
+type Jobs struct {
+	*lazymap.LazyMap[*JobPod]
+	cl             *Client
+	namespace      string
+	affinityKey    string
+	affinityValue  string
+	activeDeadline int64
+	pollInterval   time.Duration
+	mux            sync.Mutex
+	timers         map[string]*time.Timer
+	marked         map[string]time.Time
+	closeCh        chan struct{}
+	closeOnce      sync.Once
+}
+
+func NewJobs(c *cli.Context, cl *Client) *Jobs {
+	s := &Jobs{
+		cl:             cl,
+		namespace:      c.String(jobNamespaceFlag),
+		affinityKey:    c.String(jobNodeAffinityKeyFlag),
+		affinityValue:  c.String(jobNodeAffinityValueFlag),
+		activeDeadline: int64(c.Int(jobActiveDeadlineFlag)),
+		pollInterval:   500 * time.Millisecond,
+		timers:         map[string]*time.Timer{},
+		marked:         map[string]time.Time{},
+		closeCh:        make(chan struct{}),
+		LazyMap: lazymap.New[*JobPod](&lazymap.Config{
+			Concurrency: 100,
+			Expire:      30 * time.Second,
+			StoreErrors: true,
+			ErrorExpire: time.Second,
+		}),
+	}
+	go s.run()
+	return s
+}
+
+// JobName derives a DNS-1123 compatible job name from service name and key.
+func JobName(name string, key string) string {
+	hash := fmt.Sprintf("%x", sha1.Sum([]byte(key)))[:16]
+	if len(name) > 46 {
+		name = name[:46]
+	}
+	return name + "-" + hash
+}
+
+func (s *Jobs) Get(req *JobRequest) (*JobPod, error) {
+	name := JobName(req.Name, req.Key)
+	p, err := s.LazyMap.Get(name, func() (*JobPod, error) {
+		cl, err := s.cl.Get()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get k8s client")
+		}
+		err = s.create(cl, name, req)
+		if err != nil {
+			return nil, err
+		}
+		return s.waitReady(cl, name, req.ReadyTimeout)
+	})
+	// A finished job is already deleted, re-arming its TTL would only
+	// schedule a second delete. Nothing is left to wait for either, so the
+	// next request deploys it again.
+	if errors.Is(err, ErrJobFinished) {
+		s.LazyMap.Drop(name)
+		return nil, err
+	}
+	s.touch(name, req.TTL)
+	return p, err
+}
+
+func (s *Jobs) create(cl kubernetes.Interface, name string, req *JobRequest) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := cl.BatchV1().Jobs(s.namespace).Create(ctx, s.makeJob(name, req), metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to create job %s", name)
+	}
+	log.WithField("job", name).WithField("key", req.Key).Info("job created")
+	return nil
+}
+
+func (s *Jobs) makeJob(name string, req *JobRequest) *batchv1.Job {
+	job := req.Template.DeepCopy()
+	job.Name = name
+	job.GenerateName = ""
+	job.Namespace = s.namespace
+	if job.Labels == nil {
+		job.Labels = map[string]string{}
+	}
+	job.Labels[jobManagedByLabel] = jobManagedByValue
+	if req.TTL > 0 {
+		if job.Annotations == nil {
+			job.Annotations = map[string]string{}
+		}
+		job.Annotations[jobLastUsedAnnotation] = time.Now().UTC().Format(time.RFC3339Nano)
+		job.Annotations[jobIdleTTLAnnotation] = req.TTL.String()
+	}
+	if job.Spec.TTLSecondsAfterFinished == nil {
+		ttl := jobTTLAfterFinished
+		job.Spec.TTLSecondsAfterFinished = &ttl
+	}
+	if job.Spec.ActiveDeadlineSeconds == nil && s.activeDeadline > 0 {
+		d := s.activeDeadline
+		job.Spec.ActiveDeadlineSeconds = &d
+	}
+	spec := &job.Spec.Template.Spec
+	if spec.RestartPolicy == "" {
+		spec.RestartPolicy = corev1.RestartPolicyNever
+	}
+	var keys []string
+	for k := range req.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i := range spec.Containers {
+		for _, k := range keys {
+			setEnv(&spec.Containers[i], k, req.Env[k])
+		}
+	}
+	if s.affinityKey != "" && s.affinityValue != "" {
+		if spec.Affinity == nil {
+			spec.Affinity = &corev1.Affinity{}
+		}
+		spec.Affinity.NodeAffinity = &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+				NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+					MatchExpressions: []corev1.NodeSelectorRequirement{{
+						Key:      s.affinityKey,
+						Operator: corev1.NodeSelectorOpIn,
+						Values:   []string{s.affinityValue},
+					}},
+				}},
+			},
+		}
+	}
+	return job
+}
+
+// setEnv overrides the variable if the template already defines it.
+func setEnv(c *corev1.Container, name string, value string) {
+	for i := range c.Env {
+		if c.Env[i].Name == name {
+			c.Env[i] = corev1.EnvVar{
+				Name:  name,
+				Value: value,
+			}
+			return
+		}
+	}
+	c.Env = append(c.Env, corev1.EnvVar{
+		Name:  name,
+		Value: value,
+	})
+}
+
+func (s *Jobs) waitReady(cl kubernetes.Interface, name string, timeout time.Duration) (*JobPod, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+	for {
+		job, err := cl.BatchV1().Jobs(s.namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil && ctx.Err() == nil {
+			return nil, errors.Wrapf(err, "failed to get job %s", name)
+		}
+		if job != nil && isJobFinished(job) {
+			s.finish(name)
+			return nil, errors.Wrapf(ErrJobFinished, "job %s", name)
+		}
+		pods, err := cl.CoreV1().Pods(s.namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: fmt.Sprintf("%s=%s", jobNameLabel, name),
+		})
+		if err != nil && ctx.Err() == nil {
+			return nil, errors.Wrapf(err, "failed to list pods for job %s", name)
+		}
+		if pods != nil {
+			for _, p := range pods.Items {
+				if isPodReady(&p) {
+					return podToJobPod(&p), nil
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ErrJobNotReady, "job %s is not ready after %v", name, timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+func isJobFinished(job *batchv1.Job) bool {
+	for _, c := range job.Status.Conditions {
+		if (c.Type == batchv1.JobComplete || c.Type == batchv1.JobFailed) && c.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+func isPodReady(p *corev1.Pod) bool {
+	if p.Status.PodIP == "" || p.DeletionTimestamp != nil {
+		return false
+	}
+	for _, c := range p.Status.Conditions {
+		if c.Type == corev1.PodReady && c.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+func podToJobPod(p *corev1.Pod) *JobPod {
+	ports := map[string]int{}
+	for _, c := range p.Spec.Containers {
+		for _, cp := range c.Ports {
+			if cp.Name != "" {
+				ports[cp.Name] = int(cp.ContainerPort)
+			}
+		}
+	}
+	return &JobPod{
+		Name:     p.Name,
+		IP:       p.Status.PodIP,
+		NodeName: p.Spec.NodeName,
+		Ports:    ports,
+	}
+}
+
+// touch postpones cleanup of the job by ttl. Zero ttl disables cleanup.
+func (s *Jobs) touch(name string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	s.arm(name, ttl)
+	s.markUsed(name, ttl)
+}
+
+// arm (re)schedules the expiry check of the job in d.
+func (s *Jobs) arm(name string, d time.Duration) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if t, ok := s.timers[name]; ok {
+		t.Reset(d)
+		return
+	}
+	s.timers[name] = time.AfterFunc(d, func() {
+		s.expire(name)
+	})
+}
+
+// markUsed updates the last-used annotation of the job, at most every quarter
+// of its ttl, so that other replicas see it's in use.
+func (s *Jobs) markUsed(name string, ttl time.Duration) {
+	now := time.Now()
+	s.mux.Lock()
+	if now.Sub(s.marked[name]) < ttl/4 {
+		s.mux.Unlock()
+		return
+	}
+	s.marked[name] = now
+	s.mux.Unlock()
+	cl, err := s.cl.Get()
+	if err != nil {
+		log.WithError(err).WithField("job", name).Warn("failed to get k8s client")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	patch := fmt.Sprintf(`{"metadata":{"annotations":{%q:%q}}}`, jobLastUsedAnnotation, now.UTC().Format(time.RFC3339Nano))
+	_, err = cl.BatchV1().Jobs(s.namespace).Patch(ctx, name, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.WithError(err).WithField("job", name).Warn("failed to mark job as used")
+	}
+}
+
+// idleLeft returns how long the job has to stay idle before it may be
+// deleted, judging by the annotations every replica updates. Jobs without
+// them are never deleted.
+func idleLeft(job *batchv1.Job, now time.Time) (left time.Duration, ok bool) {
+	ttl, err := time.ParseDuration(job.Annotations[jobIdleTTLAnnotation])
+	if err != nil || ttl <= 0 {
+		return 0, false
+	}
+	lastUsed, err := time.Parse(time.RFC3339Nano, job.Annotations[jobLastUsedAnnotation])
+	if err != nil {
+		return 0, true
+	}
+	return lastUsed.Add(ttl).Sub(now), true
+}
+
+// expire deletes the job unless another replica used it meanwhile, then the
+// check is postponed.
+func (s *Jobs) expire(name string) {
+	s.mux.Lock()
+	delete(s.timers, name)
+	s.mux.Unlock()
+	cl, err := s.cl.Get()
+	if err != nil {
+		log.WithError(err).WithField("job", name).Warn("failed to get k8s client")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	job, err := cl.BatchV1().Jobs(s.namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		s.forget(name)
+		return
+	}
+	if err != nil {
+		// Leave it to the sweep rather than delete a job in use.
+		log.WithError(err).WithField("job", name).Warn("failed to get expired job")
+		return
+	}
+	if left, ok := idleLeft(job, time.Now()); ok && left > 0 {
+		s.arm(name, left)
+		return
+	}
+	s.forget(name)
+	if err := s.delete(name); err != nil {
+		log.WithError(err).WithField("job", name).Warn("failed to delete expired job")
+		return
+	}
+	log.WithField("job", name).Info("expired job deleted")
+}
+
+func (s *Jobs) forget(name string) {
+	s.mux.Lock()
+	delete(s.marked, name)
+	s.mux.Unlock()
+	s.LazyMap.Drop(name)
+}
+
+// sweep deletes jobs of any replica idle for their TTL that no timer of this
+// replica watches.
+func (s *Jobs) sweep() error {
+	cl, err := s.cl.Get()
+	if err != nil {
+		return errors.Wrap(err, "failed to get k8s client")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	jobs, err := cl.BatchV1().Jobs(s.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", jobManagedByLabel, jobManagedByValue),
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to list jobs")
+	}
+	now := time.Now()
+	for i := range jobs.Items {
+		name := jobs.Items[i].Name
+		s.mux.Lock()
+		_, watched := s.timers[name]
+		s.mux.Unlock()
+		if left, ok := idleLeft(&jobs.Items[i], now); watched || !ok || left > 0 {
+			continue
+		}
+		s.forget(name)
+		if err := s.delete(name); err != nil {
+			log.WithError(err).WithField("job", name).Warn("failed to delete idle job")
+			continue
+		}
+		log.WithField("job", name).Info("idle job deleted")
+	}
+	return nil
+}
+
+func (s *Jobs) run() {
+	ticker := time.NewTicker(jobSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case <-ticker.C:
+		}
+		if err := s.sweep(); err != nil {
+			log.WithError(err).Warn("failed to sweep idle jobs")
+		}
+	}
+}
+
+func (s *Jobs) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+	})
+}
+
+// finish cancels cleanup of a completed or failed job and deletes it right
+// away.
+func (s *Jobs) finish(name string) {
+	s.mux.Lock()
+	if t, ok := s.timers[name]; ok {
+		t.Stop()
+		delete(s.timers, name)
+	}
+	delete(s.marked, name)
+	s.mux.Unlock()
+	if err := s.delete(name); err != nil {
+		log.WithError(err).WithField("job", name).Warn("failed to delete finished job")
+		return
+	}
+	log.WithField("job", name).Info("finished job deleted")
+}
+
+func (s *Jobs) delete(name string) error {
+	cl, err := s.cl.Get()
+	if err != nil {
+		return errors.Wrap(err, "failed to get k8s client")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	policy := metav1.DeletePropagationBackground
+	err = cl.BatchV1().Jobs(s.namespace).Delete(ctx, name, metav1.DeleteOptions{
+		PropagationPolicy: &policy,
+	})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,352 @@
+package k8s
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/webtor-io/lazymap"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestJobs(cs *fake.Clientset) *Jobs {
+	return &Jobs{
+		cl:           NewClientFromInterface(cs),
+		namespace:    "webtor",
+		pollInterval: 10 * time.Millisecond,
+		timers:       map[string]*time.Timer{},
+		marked:       map[string]time.Time{},
+		LazyMap: lazymap.New[*JobPod](&lazymap.Config{
+			Expire:      30 * time.Second,
+			StoreErrors: true,
+			ErrorExpire: 10 * time.Millisecond,
+		}),
+	}
+}
+
+func testJobTemplate() *batchv1.Job {
+	return &batchv1.Job{
+		Spec: batchv1.JobSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  "seeder",
+						Image: "webtor/torrent-web-seeder",
+						Ports: []corev1.ContainerPort{
+							{Name: "http", ContainerPort: 8080},
+							{Name: "httpprobe", ContainerPort: 8081},
+						},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// markReady emulates the job controller and kubelet: once the job shows up,
+// a ready pod labeled with its name is created.
+func markReady(t *testing.T, cs *fake.Clientset, name string, ip string) {
+	t.Helper()
+	ctx := context.Background()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := cs.BatchV1().Jobs("webtor").Get(ctx, name, metav1.GetOptions{})
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("job %s was not created", name)
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	job, _ := cs.BatchV1().Jobs("webtor").Get(ctx, name, metav1.GetOptions{})
+	_, err := cs.CoreV1().Pods("webtor").Create(ctx, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name + "-abcde",
+			Labels: map[string]string{jobNameLabel: name},
+		},
+		Spec: *job.Spec.Template.Spec.DeepCopy(),
+		Status: corev1.PodStatus{
+			PodIP: ip,
+			Conditions: []corev1.PodCondition{
+				{Type: corev1.PodReady, Status: corev1.ConditionTrue},
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Errorf("failed to create pod: %v", err)
+	}
+}
+
+func TestJobsGet_CreatesJobAndWaitsForReadyPod(t *testing.T) {
+	cs := fake.NewClientset()
+	jobs := newTestJobs(cs)
+	req := &JobRequest{
+		Name:         "torrent-web-seeder",
+		Key:          "08ada5a7a6183aae1e09d831df6748d566095a10default",
+		Template:     testJobTemplate(),
+		Env:          map[string]string{"INFO_HASH": "08ada5a7a6183aae1e09d831df6748d566095a10"},
+		ReadyTimeout: 5 * time.Second,
+	}
+	name := JobName(req.Name, req.Key)
+	go markReady(t, cs, name, "10.0.0.7")
+
+	p, err := jobs.Get(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.IP != "10.0.0.7" || p.Ports["http"] != 8080 || p.Ports["httpprobe"] != 8081 {
+		t.Fatalf("unexpected pod: %+v", p)
+	}
+
+	job, err := cs.BatchV1().Jobs("webtor").Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("job not found: %v", err)
+	}
+	env := job.Spec.Template.Spec.Containers[0].Env
+	if len(env) != 1 || env[0].Name != "INFO_HASH" || env[0].Value != req.Env["INFO_HASH"] {
+		t.Fatalf("INFO_HASH not injected: %+v", env)
+	}
+	if job.Labels[jobManagedByLabel] != jobManagedByValue {
+		t.Fatalf("managed-by label missing: %+v", job.Labels)
+	}
+}
+
+func TestJobsGet_Idempotent(t *testing.T) {
+	cs := fake.NewClientset()
+	req := &JobRequest{
+		Name:         "torrent-web-seeder",
+		Key:          "08ada5a7a6183aae1e09d831df6748d566095a10default",
+		Template:     testJobTemplate(),
+		ReadyTimeout: 5 * time.Second,
+	}
+	name := JobName(req.Name, req.Key)
+	go markReady(t, cs, name, "10.0.0.7")
+
+	// Two independent pools emulate two proxy replicas racing on the same key.
+	var wg sync.WaitGroup
+	for _, jobs := range []*Jobs{newTestJobs(cs), newTestJobs(cs)} {
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func(jobs *Jobs) {
+				defer wg.Done()
+				if _, err := jobs.Get(req); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}(jobs)
+		}
+	}
+	wg.Wait()
+
+	list, err := cs.BatchV1().Jobs("webtor").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("failed to list jobs: %v", err)
+	}
+	if len(list.Items) != 1 {
+		t.Fatalf("expected exactly one job, got %d", len(list.Items))
+	}
+}
+
+func TestJobsGet_ReadyTimeout(t *testing.T) {
+	cs := fake.NewClientset()
+	jobs := newTestJobs(cs)
+	_, err := jobs.Get(&JobRequest{
+		Name:         "torrent-web-seeder",
+		Key:          "key",
+		Template:     testJobTemplate(),
+		ReadyTimeout: 50 * time.Millisecond,
+	})
+	if !errors.Is(err, ErrJobNotReady) {
+		t.Fatalf("expected ErrJobNotReady, got %v", err)
+	}
+}
+
+func TestJobsGet_FinishedJobIsDeleted(t *testing.T) {
+	req := &JobRequest{
+		Name:         "torrent-web-seeder",
+		Key:          "key",
+		Template:     testJobTemplate(),
+		ReadyTimeout: 5 * time.Second,
+		TTL:          time.Minute,
+	}
+	name := JobName(req.Name, req.Key)
+	cs := fake.NewClientset(&batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "webtor"},
+		Status: batchv1.JobStatus{
+			Conditions: []batchv1.JobCondition{
+				{Type: batchv1.JobFailed, Status: corev1.ConditionTrue},
+			},
+		},
+	})
+	jobs := newTestJobs(cs)
+
+	_, err := jobs.Get(req)
+	if !errors.Is(err, ErrJobFinished) {
+		t.Fatalf("expected ErrJobFinished, got %v", err)
+	}
+	if _, err := cs.BatchV1().Jobs("webtor").Get(context.Background(), name, metav1.GetOptions{}); err == nil {
+		t.Fatal("finished job should be deleted")
+	}
+	jobs.mux.Lock()
+	_, ok := jobs.timers[name]
+	jobs.mux.Unlock()
+	if ok {
+		t.Fatal("finished job should not be scheduled for cleanup")
+	}
+
+	// The next request deploys the job again.
+	go markReady(t, cs, name, "10.0.0.7")
+	p, err := jobs.Get(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.IP != "10.0.0.7" {
+		t.Fatalf("unexpected pod: %+v", p)
+	}
+}
+
+func TestJobsMakeJob_OverridesTemplateEnv(t *testing.T) {
+	tpl := testJobTemplate()
+	tpl.Spec.Template.Spec.Containers[0].Env = []corev1.EnvVar{
+		{Name: "INFO_HASH", Value: "placeholder"},
+		{Name: "LOG_LEVEL", Value: "debug"},
+	}
+	jobs := newTestJobs(fake.NewClientset())
+	job := jobs.makeJob("job", &JobRequest{
+		Template: tpl,
+		Env:      map[string]string{"INFO_HASH": "08ada5a7a6183aae1e09d831df6748d566095a10"},
+	})
+	env := job.Spec.Template.Spec.Containers[0].Env
+	if len(env) != 2 || env[0].Name != "INFO_HASH" || env[0].Value != "08ada5a7a6183aae1e09d831df6748d566095a10" {
+		t.Fatalf("INFO_HASH not overridden: %+v", env)
+	}
+	if tpl.Spec.Template.Spec.Containers[0].Env[0].Value != "placeholder" {
+		t.Fatal("template must not be modified")
+	}
+}
+
+func TestJobsGet_DeletedAfterTTL(t *testing.T) {
+	cs := fake.NewClientset()
+	jobs := newTestJobs(cs)
+	req := &JobRequest{
+		Name:         "torrent-web-seeder",
+		Key:          "key",
+		Template:     testJobTemplate(),
+		ReadyTimeout: 5 * time.Second,
+		TTL:          100 * time.Millisecond,
+	}
+	name := JobName(req.Name, req.Key)
+	go markReady(t, cs, name, "10.0.0.7")
+	if _, err := jobs.Get(req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := cs.BatchV1().Jobs("webtor").Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("job was not deleted after TTL")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := jobs.Status(name); ok {
+		t.Fatal("expired job should be dropped from cache")
+	}
+}
+
+func TestJobsMakeJob_Backstops(t *testing.T) {
+	jobs := newTestJobs(fake.NewClientset())
+	jobs.activeDeadline = 3600
+	job := jobs.makeJob("job", &JobRequest{
+		Template: testJobTemplate(),
+		TTL:      time.Minute,
+	})
+	if d := job.Spec.ActiveDeadlineSeconds; d == nil || *d != 3600 {
+		t.Fatalf("expected active deadline, got %v", d)
+	}
+	if ttl := job.Spec.TTLSecondsAfterFinished; ttl == nil || *ttl != jobTTLAfterFinished {
+		t.Fatalf("expected ttl after finished, got %v", ttl)
+	}
+	if left, ok := idleLeft(job, time.Now()); !ok || left <= 0 || left > time.Minute {
+		t.Fatalf("expected idle annotations, got %v %v", left, ok)
+	}
+}
+
+// TestJobsExpire_UsedByAnotherReplica checks that a job isn't deleted while
+// its last-used annotation is fresh, even if this replica stopped using it.
+func TestJobsExpire_UsedByAnotherReplica(t *testing.T) {
+	cs := fake.NewClientset()
+	jobs := newTestJobs(cs)
+	job := jobs.makeJob("job", &JobRequest{
+		Template: testJobTemplate(),
+		TTL:      time.Hour,
+	})
+	if _, err := cs.BatchV1().Jobs("webtor").Create(context.Background(), job, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	jobs.expire("job")
+	if _, err := cs.BatchV1().Jobs("webtor").Get(context.Background(), "job", metav1.GetOptions{}); err != nil {
+		t.Fatalf("job in use must not be deleted: %v", err)
+	}
+	jobs.mux.Lock()
+	_, rearmed := jobs.timers["job"]
+	jobs.mux.Unlock()
+	if !rearmed {
+		t.Fatal("expected expiry to be postponed")
+	}
+	jobs.finish("job")
+}
+
+// TestJobsSweep_DeletesIdleJobs checks that jobs left behind, e.g. by a
+// restarted replica, are deleted once idle for their TTL.
+func TestJobsSweep_DeletesIdleJobs(t *testing.T) {
+	cs := fake.NewClientset()
+	jobs := newTestJobs(cs)
+	ctx := context.Background()
+	for name, lastUsed := range map[string]time.Time{
+		"idle":   time.Now().Add(-2 * time.Minute),
+		"in-use": time.Now(),
+	} {
+		job := jobs.makeJob(name, &JobRequest{
+			Template: testJobTemplate(),
+			TTL:      time.Minute,
+		})
+		job.Annotations[jobLastUsedAnnotation] = lastUsed.UTC().Format(time.RFC3339Nano)
+		if _, err := cs.BatchV1().Jobs("webtor").Create(ctx, job, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := jobs.sweep(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.BatchV1().Jobs("webtor").Get(ctx, "idle", metav1.GetOptions{}); err == nil {
+		t.Fatal("idle job should be deleted")
+	}
+	if _, err := cs.BatchV1().Jobs("webtor").Get(ctx, "in-use", metav1.GetOptions{}); err != nil {
+		t.Fatalf("job in use must not be deleted: %v", err)
+	}
+}
+
+func TestJobName(t *testing.T) {
+	a := JobName("torrent-web-seeder", "a")
+	b := JobName("torrent-web-seeder", "b")
+	if a == b {
+		t.Fatal("different keys should produce different job names")
+	}
+	if a != JobName("torrent-web-seeder", "a") {
+		t.Fatal("job name must be stable")
+	}
+	long := JobName("a-very-long-service-name-that-does-not-fit-into-a-label-value", "a")
+	if len(long) > 63 {
+		t.Fatalf("job name too long: %d", len(long))
+	}
+}
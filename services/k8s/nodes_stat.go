@@ -5,6 +5,7 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -34,6 +35,8 @@ type NodeStat struct {
 	Name         string
 	RolesAllowed []string
 	RolesDenied  []string
+	// Weight is nil when the node doesn't set one.
+	Weight *float64
 }
 
 func (s *NodeStat) IsAllowed(role string) bool {
@@ -96,11 +99,15 @@ func (s *NodesStat) Get() ([]NodeStat, error) {
 			if !ready {
 				continue
 			}
-			res = append(res, NodeStat{
+			ns := NodeStat{
 				Name:         n.Name,
 				RolesAllowed: s.getLabelList(n, "roles-allowed"),
 				RolesDenied:  s.getLabelList(n, "roles-denied"),
-			})
+			}
+			if w, ok := getWeight(n.GetLabels(), s.labelPrefix, "node "+n.Name); ok {
+				ns.Weight = &w
+			}
+			res = append(res, ns)
 		}
 		sort.Slice(res, func(i, j int) bool {
 			return res[i].Name < res[j].Name
@@ -119,3 +126,19 @@ func (s *NodesStat) getLabelList(n corev1.Node, name string) []string {
 	}
 	return list
 }
+
+// getWeight reads the "<prefix>weight" label or annotation value of obj.
+// Missing or malformed values are reported as unset, so callers fall back to
+// the default weight; an explicit 0 takes the object out of rotation.
+func getWeight(m map[string]string, prefix string, obj string) (float64, bool) {
+	v, ok := m[prefix+"weight"]
+	if !ok {
+		return 0, false
+	}
+	w, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || w < 0 {
+		log.Warnf("failed to parse weight %q of %s", v, obj)
+		return 0, false
+	}
+	return w, true
+}
@@ -0,0 +1,106 @@
+package k8s
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+	"github.com/webtor-io/lazymap"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type PodStat struct {
+	Name string
+	// Weight is nil when the pod doesn't set one.
+	Weight *float64
+}
+
+// PodsStat exposes per-pod metadata of the endpoints namespace. It follows
+// the NodesStat label convention: "<node-label-prefix>weight" is read from
+// pod annotations first and pod labels second. Only pods referenced by
+// endpoints are fetched, each one is cached on its own, so a new pod is
+// picked up on its first lookup.
+type PodsStat struct {
+	*lazymap.LazyMap[PodStat]
+	kcl         *Client
+	namespace   string
+	labelPrefix string
+}
+
+func NewPodsStat(c *cli.Context, kcl *Client) *PodsStat {
+	return &PodsStat{
+		LazyMap: lazymap.New[PodStat](&lazymap.Config{
+			Expire: 60 * time.Second,
+		}),
+		kcl:         kcl,
+		namespace:   c.String(endpointsNamespaceFlag),
+		labelPrefix: c.String(nodeLabelPrefixFlag),
+	}
+}
+
+func (s *PodsStat) get(name string) (PodStat, error) {
+	return s.LazyMap.Get(name, func() (PodStat, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		cl, err := s.kcl.Get()
+		if err != nil {
+			return PodStat{}, errors.Wrap(err, "failed to get k8s client")
+		}
+		p, err := cl.CoreV1().Pods(s.namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return PodStat{Name: name}, nil
+		}
+		if err != nil {
+			return PodStat{}, errors.Wrapf(err, "failed to get k8s pod %s", name)
+		}
+		w, ok := getWeight(p.GetAnnotations(), s.labelPrefix, "pod "+name)
+		if !ok {
+			w, ok = getWeight(p.GetLabels(), s.labelPrefix, "pod "+name)
+		}
+		res := PodStat{
+			Name: name,
+		}
+		if ok {
+			res.Weight = &w
+		}
+		return res, nil
+	})
+}
+
+// Get returns stats of the named pods. Pods that failed to load are left
+// out, callers treat them as pods without weight.
+func (s *PodsStat) Get(names []string) (map[string]PodStat, error) {
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	var lastErr error
+	res := make(map[string]PodStat, len(names))
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			p, err := s.get(name)
+			mux.Lock()
+			defer mux.Unlock()
+			if err != nil {
+				lastErr = err
+				return
+			}
+			res[name] = p
+		}(name)
+	}
+	wg.Wait()
+	if len(res) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	if lastErr != nil {
+		log.WithError(lastErr).Warn("failed to get some k8s pods")
+	}
+	return res, nil
+}
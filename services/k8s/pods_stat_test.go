@@ -0,0 +1,63 @@
+package k8s
+
+import (
+	"testing"
+	"time"
+
+	"github.com/webtor-io/lazymap"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testPod(name string, labels map[string]string, annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "webtor",
+			Labels:      labels,
+			Annotations: annotations,
+		},
+	}
+}
+
+func TestPodsStatGet_Weight(t *testing.T) {
+	cs := fake.NewClientset(
+		testPod("annotated", map[string]string{"webtor.io/weight": "2"}, map[string]string{"webtor.io/weight": "3.5"}),
+		testPod("drained", map[string]string{"webtor.io/weight": "2"}, map[string]string{"webtor.io/weight": "0"}),
+		testPod("labeled", map[string]string{"webtor.io/weight": "2"}, nil),
+		testPod("malformed", nil, map[string]string{"webtor.io/weight": "big"}),
+		testPod("plain", nil, nil),
+		testPod("unreferenced", nil, map[string]string{"webtor.io/weight": "5"}),
+	)
+	s := &PodsStat{
+		kcl:         NewClientFromInterface(cs),
+		namespace:   "webtor",
+		labelPrefix: "webtor.io/",
+		LazyMap: lazymap.New[PodStat](&lazymap.Config{
+			Expire: 60 * time.Second,
+		}),
+	}
+	pods, err := s.Get([]string{"annotated", "drained", "labeled", "malformed", "plain", "gone"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]float64{
+		"annotated": 3.5,
+		"drained":   0,
+		"labeled":   2,
+	}
+	for name, w := range expected {
+		if pods[name].Weight == nil || *pods[name].Weight != w {
+			t.Errorf("pod %s: expected weight %v, got %v", name, w, pods[name].Weight)
+		}
+	}
+	for _, name := range []string{"malformed", "plain", "gone"} {
+		if pods[name].Weight != nil {
+			t.Errorf("pod %s: expected no weight, got %v", name, *pods[name].Weight)
+		}
+	}
+	if _, ok := pods["unreferenced"]; ok {
+		t.Error("pods not referenced by endpoints should not be fetched")
+	}
+}
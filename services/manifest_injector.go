@@ -0,0 +1,135 @@
+package services
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// uriAttr starts the URI attribute of tags like #EXT-X-KEY, #EXT-X-MAP and
+// #EXT-X-MEDIA.
+var uriAttr = []byte(`URI="`)
+
+// injectManifestTokens is the response-rule handler registered in rules.go
+// for `kind=inject, scope=manifest`. It makes every relative URI of .m3u8
+// responses carry the token and api key of the request, for upstreams that
+// emit bare segment URIs.
+func injectManifestTokens(r *http.Response, rc *RulesContext) error {
+	if r.Request == nil || r.Body == nil || !strings.HasSuffix(r.Request.URL.Path, ".m3u8") {
+		return nil
+	}
+	if !hasRule(rc.Claims, "inject", "manifest") || rc.PrimaryToken == "" {
+		return nil
+	}
+	streamBody(r, InjectManifestTokens(r.Body, rc.PrimaryToken, rc.APIKey))
+	return nil
+}
+
+// hasRule reports whether claims carry a rule of kind and scope.
+func hasRule(claims jwt.MapClaims, kind string, scope string) bool {
+	for _, r := range ExtractRules(claims) {
+		if r.Kind == kind && r.Scope == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// InjectManifestTokens sets the token and api-key params on every URI of an
+// HLS master or variant playlist streamed from src: segment and variant lines
+// and URI attributes of tags. Existing params are replaced, other params keep
+// their order. Absolute URIs are left alone, they may point to other hosts
+// which must not see the token.
+func InjectManifestTokens(src io.Reader, token string, apiKey string) io.Reader {
+	params := "token=" + url.QueryEscape(token)
+	if apiKey != "" {
+		params += "&api-key=" + url.QueryEscape(apiKey)
+	}
+	return newLineReader(src, func(dst []byte, line []byte) []byte {
+		trimmed := bytes.TrimRight(line, "\r\n")
+		eol := line[len(trimmed):]
+		stripped := bytes.TrimLeft(trimmed, " \t")
+		if len(stripped) == 0 {
+			return append(dst, line...)
+		}
+		if stripped[0] != '#' {
+			dst = append(dst, trimmed[:len(trimmed)-len(stripped)]...)
+			dst = appendInjectedURI(dst, stripped, params)
+			return append(dst, eol...)
+		}
+		// URI attributes of tags.
+		for {
+			i := bytes.Index(trimmed, uriAttr)
+			if i < 0 {
+				break
+			}
+			i += len(uriAttr)
+			j := bytes.IndexByte(trimmed[i:], '"')
+			if j < 0 {
+				break
+			}
+			dst = append(dst, trimmed[:i]...)
+			dst = appendInjectedURI(dst, trimmed[i:i+j], params)
+			trimmed = trimmed[i+j:]
+		}
+		dst = append(dst, trimmed...)
+		return append(dst, eol...)
+	})
+}
+
+// appendInjectedURI appends uri with params in place of its token and
+// api-key params, or as is if it's absolute.
+func appendInjectedURI(dst []byte, uri []byte, params string) []byte {
+	if isAbsoluteURI(uri) {
+		return append(dst, uri...)
+	}
+	var frag []byte
+	if i := bytes.IndexByte(uri, '#'); i >= 0 {
+		uri, frag = uri[:i], uri[i:]
+	}
+	var query []byte
+	if i := bytes.IndexByte(uri, '?'); i >= 0 {
+		uri, query = uri[:i], uri[i+1:]
+	}
+	dst = append(dst, uri...)
+	dst = append(dst, '?')
+	for len(query) > 0 {
+		p := query
+		if i := bytes.IndexByte(query, '&'); i >= 0 {
+			p, query = query[:i], query[i+1:]
+		} else {
+			query = nil
+		}
+		k := p
+		if i := bytes.IndexByte(p, '='); i >= 0 {
+			k = p[:i]
+		}
+		if len(p) == 0 || string(k) == "token" || string(k) == "api-key" {
+			continue
+		}
+		dst = append(dst, p...)
+		dst = append(dst, '&')
+	}
+	dst = append(dst, params...)
+	return append(dst, frag...)
+}
+
+// isAbsoluteURI reports whether uri has a scheme or a host.
+func isAbsoluteURI(uri []byte) bool {
+	if bytes.HasPrefix(uri, []byte("//")) {
+		return true
+	}
+	for i, c := range uri {
+		switch {
+		case c == ':':
+			return i > 0
+		case c == '/' || c == '?' || c == '#':
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func claimsWithInject() jwt.MapClaims {
+	return jwt.MapClaims{
+		"rules": []interface{}{
+			map[string]interface{}{
+				"kind":  "inject",
+				"scope": "manifest",
+			},
+		},
+	}
+}
+
+func readTestManifest(t *testing.T, r io.Reader) string {
+	t.Helper()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestInjectManifestTokens_Variant(t *testing.T) {
+	body := []byte(strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-TARGETDURATION:6",
+		`#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x1`,
+		`#EXT-X-MAP:URI="init.mp4?x=1"`,
+		"#EXTINF:6.0,",
+		"v0-0.ts",
+		"#EXTINF:6.0,",
+		"v0-1.ts?token=OLD&api-key=OLD&x=1",
+		"#EXTINF:6.0,",
+		"https://cdn.example.com/v0-2.ts",
+		"#EXT-X-ENDLIST",
+		"",
+	}, "\r\n"))
+	got := readTestManifest(t, InjectManifestTokens(bytes.NewReader(body), primaryJWT, "K"))
+	want := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-TARGETDURATION:6",
+		`#EXT-X-KEY:METHOD=AES-128,URI="key.bin?token=` + primaryJWT + `&api-key=K",IV=0x1`,
+		`#EXT-X-MAP:URI="init.mp4?x=1&token=` + primaryJWT + `&api-key=K"`,
+		"#EXTINF:6.0,",
+		"v0-0.ts?token=" + primaryJWT + "&api-key=K",
+		"#EXTINF:6.0,",
+		"v0-1.ts?x=1&token=" + primaryJWT + "&api-key=K",
+		"#EXTINF:6.0,",
+		"https://cdn.example.com/v0-2.ts",
+		"#EXT-X-ENDLIST",
+		"",
+	}, "\r\n")
+	if got != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestInjectManifestTokens_Master(t *testing.T) {
+	body := []byte(strings.Join([]string{
+		"#EXTM3U",
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="en",URI="a-en.m3u8"`,
+		`#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="sub",NAME="en",URI="s-en.m3u8#x"`,
+		"#EXT-X-STREAM-INF:BANDWIDTH=5000000,AUDIO=\"aud\"",
+		"v0-720.m3u8",
+		"",
+	}, "\n"))
+	got := readTestManifest(t, InjectManifestTokens(bytes.NewReader(body), primaryJWT, ""))
+	for _, s := range []string{
+		`URI="a-en.m3u8?token=` + primaryJWT + `"`,
+		`URI="s-en.m3u8?token=` + primaryJWT + `#x"`,
+		"\nv0-720.m3u8?token=" + primaryJWT + "\n",
+	} {
+		if !strings.Contains(got, s) {
+			t.Errorf("expected %s, got:\n%s", s, got)
+		}
+	}
+	if strings.Contains(got, "api-key") {
+		t.Errorf("expected no api key, got:\n%s", got)
+	}
+}
+
+func TestInjectManifestTokens_BeforeGrace(t *testing.T) {
+	body := []byte("#EXTM3U\n#EXTINF:6.0,\nv0-0.ts\n#EXTINF:6.0,\nv0-1.ts\n")
+	claims := claimsWithGrace(6)
+	claims["rules"] = append(claims["rules"].([]interface{}), claimsWithInject()["rules"].([]interface{})...)
+	req := httptest.NewRequest("GET", "/index.m3u8", nil)
+	req = WithRulesContext(req, &RulesContext{Claims: claims, PrimaryToken: primaryJWT, APIKey: "K"})
+	resp := &http.Response{
+		Request: req,
+		Header:  http.Header{},
+		Body:    io.NopCloser(bytes.NewReader(body)),
+	}
+	if err := applyResponseRules(resp); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := io.ReadAll(resp.Body)
+	got := string(out)
+	if !strings.Contains(got, "v0-0.ts?token="+graceJWT+"&api-key=K") ||
+		!strings.Contains(got, "v0-1.ts?token="+primaryJWT+"&api-key=K") {
+		t.Fatalf("expected injected tokens with grace swap, got:\n%s", got)
+	}
+}
+
+func TestInjectManifestTokens_NoRule(t *testing.T) {
+	body := []byte("#EXTM3U\n#EXTINF:6.0,\nv0-0.ts\n")
+	req := httptest.NewRequest("GET", "/index.m3u8", nil)
+	resp := &http.Response{
+		Request: req,
+		Header:  http.Header{},
+		Body:    io.NopCloser(bytes.NewReader(body)),
+	}
+	if err := injectManifestTokens(resp, &RulesContext{Claims: jwt.MapClaims{}, PrimaryToken: primaryJWT}); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := io.ReadAll(resp.Body)
+	if string(out) != string(body) {
+		t.Fatalf("expected pass-through, got:\n%s", out)
+	}
+}
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"bufio"
 	"bytes"
 	"io"
 	"net/http"
@@ -16,32 +17,105 @@ const (
 	tagExtinf        = "#EXTINF:"
 )
 
+// isManifest reports whether path is an HLS playlist or a DASH MPD, which
+// make players request segments under the same infohash.
+func isManifest(path string) bool {
+	return strings.HasSuffix(path, ".m3u8") || strings.HasSuffix(path, ".mpd")
+}
+
 // rewriteManifestForGrace is the response-rule handler registered in rules.go
-// for `kind=grace, scope=manifest`. It intercepts .m3u8 responses and applies
-// per-segment token swaps when the request's primary token carries a grace
-// rule. No-op for non-m3u8 paths or when no grace rule is present.
+// for `kind=grace, scope=manifest`. It intercepts .m3u8 and .mpd responses and
+// applies per-segment token swaps when the request's primary token carries a
+// grace rule. No-op for other paths or when no grace rule is present.
 func rewriteManifestForGrace(r *http.Response, rc *RulesContext) error {
-	if r.Request == nil || !strings.HasSuffix(r.Request.URL.Path, ".m3u8") {
+	if r.Request == nil || r.Body == nil || findGraceRule(rc.Claims) == nil {
 		return nil
 	}
-	if findGraceRule(rc.Claims) == nil {
-		return nil
-	}
-	if r.Body == nil {
-		return nil
+	switch {
+	case strings.HasSuffix(r.Request.URL.Path, ".m3u8"):
+		streamBody(r, RewriteManifest(r.Body, rc.Claims, rc.PrimaryToken))
+	case strings.HasSuffix(r.Request.URL.Path, ".mpd"):
+		// MPD is XML, it can't be rewritten line by line.
+		return rewriteBody(r, func(body []byte) []byte {
+			return RewriteMPD(body, rc.Claims, rc.PrimaryToken)
+		})
 	}
+	return nil
+}
+
+// rewriteBody replaces the manifest body of r with the result of fn.
+func rewriteBody(r *http.Response, fn func(body []byte) []byte) error {
 	body, err := io.ReadAll(r.Body)
 	_ = r.Body.Close()
 	if err != nil {
 		return errors.Wrap(err, "failed to read manifest body")
 	}
-	rewritten := RewriteManifest(body, rc.Claims, rc.PrimaryToken)
+	rewritten := fn(body)
 	r.Body = io.NopCloser(bytes.NewReader(rewritten))
 	r.ContentLength = int64(len(rewritten))
 	r.Header.Set("Content-Length", strconv.Itoa(len(rewritten)))
 	return nil
 }
 
+// streamBody replaces the body of r with rd reading from it. The length of
+// the result isn't known up front, so it goes chunked.
+func streamBody(r *http.Response, rd io.Reader) {
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{rd, r.Body}
+	r.ContentLength = -1
+	r.Header.Del("Content-Length")
+}
+
+// lineTransform appends the transformed line to dst. Lines come with their
+// line break, if any.
+type lineTransform func(dst []byte, line []byte) []byte
+
+// lineReader streams src through a lineTransform, holding no more than a
+// line of it in memory.
+type lineReader struct {
+	br   *bufio.Reader
+	fn   lineTransform
+	line []byte
+	out  []byte
+	off  int
+	err  error
+}
+
+func newLineReader(src io.Reader, fn lineTransform) *lineReader {
+	return &lineReader{
+		br: bufio.NewReaderSize(src, 32*1024),
+		fn: fn,
+	}
+}
+
+func (s *lineReader) Read(p []byte) (int, error) {
+	for s.off == len(s.out) {
+		if s.err != nil {
+			return 0, s.err
+		}
+		s.line = s.line[:0]
+		for {
+			chunk, err := s.br.ReadSlice('\n')
+			s.line = append(s.line, chunk...)
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			s.err = err
+			break
+		}
+		s.out = s.out[:0]
+		s.off = 0
+		if len(s.line) > 0 {
+			s.out = s.fn(s.out, s.line)
+		}
+	}
+	n := copy(p, s.out[s.off:])
+	s.off += n
+	return n, nil
+}
+
 // findGraceRule returns the first grace/manifest rule from a claims set,
 // or nil if none. Empty/zero rules are skipped.
 func findGraceRule(claims jwt.MapClaims) *Rule {
@@ -73,80 +147,85 @@ func parseSessionOffset(body []byte) float64 {
 	return v
 }
 
-// stripSessionOffsetLine removes the #EXT-X-SESSION-OFFSET line from the
-// manifest. Tag was injected upstream as a hint for THP only — players ignore
-// unknown X- tags but downstream consumers (CDN logs, etc.) needn't see it.
-func stripSessionOffsetLine(body []byte) []byte {
-	out := make([]byte, 0, len(body))
-	for _, line := range bytes.SplitAfter(body, []byte("\n")) {
-		if bytes.HasPrefix(bytes.TrimLeft(line, " \t"), []byte(tagSessionOffset)) {
-			continue
-		}
-		out = append(out, line...)
+// parseExtinf extracts the duration of an #EXTINF:<sec>,<title> line.
+func parseExtinf(line []byte) (float64, bool) {
+	if !bytes.HasPrefix(line, []byte(tagExtinf)) {
+		return 0, false
+	}
+	rest := line[len(tagExtinf):]
+	if comma := bytes.IndexByte(rest, ','); comma >= 0 {
+		rest = rest[:comma]
 	}
-	return out
+	d, err := strconv.ParseFloat(strings.TrimSpace(string(rest)), 64)
+	if err != nil {
+		return 0, false
+	}
+	return d, true
 }
 
-// RewriteManifest applies grace-rule token swaps to an HLS variant playlist.
+// RewriteManifest applies grace-rule token swaps to an HLS variant playlist
+// streamed from src.
 //
 // Behavior:
-//   - No grace rule on the claims → returns body unchanged.
-//   - sessionOffset already past graceUntil → returns body with offset tag
-//     stripped (no segments qualify).
+//   - No grace rule on the claims → returns src unchanged.
 //   - Otherwise: walks #EXTINF/segment pairs, accumulates movie-time, and
 //     replaces ?token=<primary> with ?token=<grace> on segment URL lines whose
 //     movie-time start falls within [0, graceUntil). Segment-start semantics
 //     match the design doc (movie_time(N) = offset + Σ EXTINF_0..N-1).
+//   - Segments of ad pods inserted by InsertAds take no movie time.
+//   - The #EXT-X-SESSION-OFFSET line is stripped. It is expected in the
+//     header, segments above it count from 0.
 //
 // Master playlists (#EXT-X-STREAM-INF) carry no #EXTINF and no segment URLs,
 // so this function is a no-op on them and they pass through unchanged.
-func RewriteManifest(body []byte, claims jwt.MapClaims, primaryToken string) []byte {
+func RewriteManifest(src io.Reader, claims jwt.MapClaims, primaryToken string) io.Reader {
 	rule := findGraceRule(claims)
 	if rule == nil || primaryToken == "" {
-		return body
+		return src
 	}
-
-	sessionOffset := parseSessionOffset(body)
 	graceUntil := float64(rule.DurationSec)
-	if sessionOffset >= graceUntil {
-		return stripSessionOffsetLine(body)
-	}
-
-	var out bytes.Buffer
-	out.Grow(len(body))
-
-	movieTime := sessionOffset
+	movieTime := 0.0
 	pendingExtinf := 0.0 // duration of the next segment, set by EXTINF, consumed by following URL line
+	inAd := false        // within an ad pod inserted by InsertAds, which takes no movie time
 
-	scanner := bytes.SplitAfter(body, []byte("\n"))
-	for _, raw := range scanner {
-		line := raw
-		// Drop trailing newline for inspection but emit raw at end.
+	return newLineReader(src, func(dst []byte, line []byte) []byte {
+		// Drop trailing newline for inspection but emit line as is.
 		trimmed := bytes.TrimRight(line, "\r\n")
 		stripped := bytes.TrimLeft(trimmed, " \t")
 
-		// Strip session-offset tag from output.
+		// Strip session-offset tag from output. Tag was injected upstream as
+		// a hint for THP only — players ignore unknown X- tags but downstream
+		// consumers (CDN logs, etc.) needn't see it.
 		if bytes.HasPrefix(stripped, []byte(tagSessionOffset)) {
-			continue
+			movieTime = parseSessionOffset(stripped)
+			return dst
+		}
+
+		if bytes.HasPrefix(stripped, []byte(tagDateRange)) && bytes.Contains(stripped, []byte(`CLASS="`+adDateRangeClass+`"`)) {
+			inAd = true
+			return append(dst, line...)
+		}
+		if bytes.HasPrefix(stripped, []byte(tagDiscontinuity)) {
+			inAd = false
+			return append(dst, line...)
 		}
 
 		// EXTINF: parse duration for the upcoming segment URL line.
 		if bytes.HasPrefix(stripped, []byte(tagExtinf)) {
-			rest := stripped[len(tagExtinf):]
-			if comma := bytes.IndexByte(rest, ','); comma >= 0 {
-				rest = rest[:comma]
-			}
-			if d, err := strconv.ParseFloat(strings.TrimSpace(string(rest)), 64); err == nil {
+			if d, ok := parseExtinf(stripped); ok {
 				pendingExtinf = d
 			}
-			out.Write(line)
-			continue
+			return append(dst, line...)
 		}
 
 		// Comments, blank lines, other tags: pass through.
 		if len(stripped) == 0 || stripped[0] == '#' {
-			out.Write(line)
-			continue
+			return append(dst, line...)
+		}
+
+		if inAd {
+			pendingExtinf = 0
+			return append(dst, line...)
 		}
 
 		// Segment URL line. Use start-of-segment movie time.
@@ -155,10 +234,8 @@ func RewriteManifest(body []byte, claims jwt.MapClaims, primaryToken string) []b
 		}
 		movieTime += pendingExtinf
 		pendingExtinf = 0
-		out.Write(line)
-	}
-
-	return out.Bytes()
+		return append(dst, line...)
+	})
 }
 
 // swapToken replaces an exact ?token=<primary> or &token=<primary> occurrence
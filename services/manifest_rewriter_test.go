@@ -1,8 +1,15 @@
 package services
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/dgrijalva/jwt-go"
 )
@@ -28,9 +35,18 @@ func claimsWithGrace(durationSec int) jwt.MapClaims {
 	}
 }
 
+func rewriteTestManifest(t *testing.T, body []byte, claims jwt.MapClaims, primaryToken string) []byte {
+	t.Helper()
+	out, err := io.ReadAll(RewriteManifest(bytes.NewReader(body), claims, primaryToken))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
 func TestRewriteManifest_NoRule_PassesThrough(t *testing.T) {
 	body := []byte("#EXTM3U\n#EXTINF:6.0,\nv0-0.ts?token=" + primaryJWT + "\n")
-	out := RewriteManifest(body, jwt.MapClaims{"rate": "5M"}, primaryJWT)
+	out := rewriteTestManifest(t, body, jwt.MapClaims{"rate": "5M"}, primaryJWT)
 	if string(out) != string(body) {
 		t.Fatalf("expected pass-through, got: %s", out)
 	}
@@ -38,7 +54,7 @@ func TestRewriteManifest_NoRule_PassesThrough(t *testing.T) {
 
 func TestRewriteManifest_NoPrimary_PassesThrough(t *testing.T) {
 	body := []byte("#EXTM3U\n#EXTINF:6.0,\nv0-0.ts\n")
-	out := RewriteManifest(body, claimsWithGrace(1200), "")
+	out := rewriteTestManifest(t, body, claimsWithGrace(1200), "")
 	if string(out) != string(body) {
 		t.Fatalf("expected pass-through, got: %s", out)
 	}
@@ -61,7 +77,7 @@ func TestRewriteManifest_FreshOffset_FirstSegmentsGetGrace(t *testing.T) {
 		"v0-3.ts?token=" + primaryJWT + "&api-key=K",
 		"",
 	}, "\n"))
-	out := RewriteManifest(body, claimsWithGrace(12), primaryJWT)
+	out := rewriteTestManifest(t, body, claimsWithGrace(12), primaryJWT)
 	got := string(out)
 
 	if strings.Contains(got, "#EXT-X-SESSION-OFFSET:") {
@@ -89,7 +105,7 @@ func TestRewriteManifest_OffsetPastGrace_NoSwap(t *testing.T) {
 		"v0-250.ts?token=" + primaryJWT,
 		"",
 	}, "\n"))
-	out := RewriteManifest(body, claimsWithGrace(1200), primaryJWT)
+	out := rewriteTestManifest(t, body, claimsWithGrace(1200), primaryJWT)
 	got := string(out)
 
 	if strings.Contains(got, graceJWT) {
@@ -114,7 +130,7 @@ func TestRewriteManifest_OffsetMidGrace_PartialSwap(t *testing.T) {
 		"v0-151.ts?token=" + primaryJWT, // start=906, in grace
 		"",
 	}, "\n"))
-	out := RewriteManifest(body, claimsWithGrace(1200), primaryJWT)
+	out := rewriteTestManifest(t, body, claimsWithGrace(1200), primaryJWT)
 	got := string(out)
 	if !strings.Contains(got, "v0-150.ts?token="+graceJWT) {
 		t.Errorf("seg 150 should swap, got:\n%s", got)
@@ -131,7 +147,7 @@ func TestRewriteManifest_NoOffsetTag_DefaultsToZero(t *testing.T) {
 		"v0-0.ts?token=" + primaryJWT,
 		"",
 	}, "\n"))
-	out := RewriteManifest(body, claimsWithGrace(1200), primaryJWT)
+	out := rewriteTestManifest(t, body, claimsWithGrace(1200), primaryJWT)
 	if !strings.Contains(string(out), "v0-0.ts?token="+graceJWT) {
 		t.Errorf("missing offset tag should default to 0 and apply grace, got:\n%s", string(out))
 	}
@@ -146,7 +162,7 @@ func TestRewriteManifest_MasterPlaylist_NoOp(t *testing.T) {
 		"v0-720.m3u8?token=" + primaryJWT,
 		"",
 	}, "\n"))
-	out := RewriteManifest(body, claimsWithGrace(1200), primaryJWT)
+	out := rewriteTestManifest(t, body, claimsWithGrace(1200), primaryJWT)
 	got := string(out)
 	if strings.Contains(got, graceJWT) {
 		t.Errorf("master playlist must not be rewritten (no EXTINF), got:\n%s", got)
@@ -191,3 +207,96 @@ func TestParseSessionOffset(t *testing.T) {
 		}
 	}
 }
+
+func TestRewriteManifest_Streaming(t *testing.T) {
+	// Segment lines longer than the read buffer, read a byte at a time.
+	long := strings.Repeat("x", 100*1024)
+	body := []byte(strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-SESSION-OFFSET:0",
+		"#EXTINF:6.0,",
+		long + ".ts?token=" + primaryJWT,
+		"#EXTINF:6.0,",
+		"v0-1.ts?token=" + primaryJWT,
+	}, "\n"))
+	out, err := io.ReadAll(iotest.OneByteReader(RewriteManifest(iotest.OneByteReader(bytes.NewReader(body)), claimsWithGrace(6), primaryJWT)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"#EXTM3U",
+		"#EXTINF:6.0,",
+		long + ".ts?token=" + graceJWT,
+		"#EXTINF:6.0,",
+		"v0-1.ts?token=" + primaryJWT,
+	}, "\n")
+	if string(out) != want {
+		t.Fatalf("unexpected output of %d bytes, want %d", len(out), len(want))
+	}
+}
+
+func TestRewriteManifestForGrace_Chunked(t *testing.T) {
+	body := "#EXTM3U\n#EXTINF:6.0,\nv0-0.ts?token=" + primaryJWT + "\n"
+	resp := &http.Response{
+		Request:       httptest.NewRequest("GET", "/index.m3u8", nil),
+		Header:        http.Header{"Content-Length": {strconv.Itoa(len(body))}},
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+	}
+	if err := rewriteManifestForGrace(resp, &RulesContext{Claims: claimsWithGrace(6), PrimaryToken: primaryJWT}); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ContentLength != -1 || resp.Header.Get("Content-Length") != "" {
+		t.Fatalf("expected unknown length, got %d %q", resp.ContentLength, resp.Header.Get("Content-Length"))
+	}
+	out, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(out), "v0-0.ts?token="+graceJWT) {
+		t.Fatalf("expected rewritten manifest, got:\n%s", out)
+	}
+	if err := resp.Body.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testEventPlaylist returns an event playlist of about size bytes.
+func testEventPlaylist(size int) []byte {
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n#EXT-X-PLAYLIST-TYPE:EVENT\n#EXT-X-SESSION-OFFSET:0\n")
+	for i := 0; b.Len() < size; i++ {
+		fmt.Fprintf(&b, "#EXTINF:6.0,\nv0-%d.ts?token=%s&api-key=K\n", i, primaryJWT)
+	}
+	return b.Bytes()
+}
+
+// BenchmarkRewriteManifest shows memory per op staying flat as playlists
+// grow.
+func BenchmarkRewriteManifest(b *testing.B) {
+	claims := claimsWithGrace(3600)
+	for _, mb := range []int{1, 4, 16} {
+		body := testEventPlaylist(mb << 20)
+		b.Run(fmt.Sprintf("%dMB", mb), func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := io.Copy(io.Discard, RewriteManifest(bytes.NewReader(body), claims, primaryJWT)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkInjectManifestTokens(b *testing.B) {
+	for _, mb := range []int{1, 4, 16} {
+		body := testEventPlaylist(mb << 20)
+		b.Run(fmt.Sprintf("%dMB", mb), func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := io.Copy(io.Discard, InjectManifestTokens(bytes.NewReader(body), primaryJWT, "K")); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
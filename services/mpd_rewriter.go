@@ -0,0 +1,280 @@
+package services
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// mpdRange is a byte range of the MPD body to swap tokens in.
+type mpdRange struct {
+	start int64
+	end   int64
+}
+
+// mpdS is an S entry of a SegmentTimeline.
+type mpdS struct {
+	t    float64
+	hasT bool
+	d    float64
+	r    int
+}
+
+// mpdSegments is a SegmentTemplate or SegmentList being parsed. Ranges in
+// pending (the template tag, Initialization) are decided by the start of the
+// first segment.
+type mpdSegments struct {
+	timescale float64
+	pto       float64
+	duration  float64
+	timeline  []mpdS
+	pending   []mpdRange
+	next      int
+}
+
+// start returns the start of the i-th segment in seconds relative to the
+// Period.
+func (s *mpdSegments) start(i int) (float64, bool) {
+	if len(s.timeline) == 0 {
+		if s.duration <= 0 {
+			return 0, i == 0
+		}
+		return float64(i) * s.duration / s.timescale, true
+	}
+	t := 0.0
+	n := 0
+	for k, e := range s.timeline {
+		if e.hasT {
+			t = e.t
+		}
+		reps := e.r
+		if reps < 0 {
+			// Negative r repeats up to the next S with t, or to the end.
+			reps = math.MaxInt32
+			if k+1 < len(s.timeline) && s.timeline[k+1].hasT && e.d > 0 {
+				reps = int((s.timeline[k+1].t-t)/e.d) - 1
+			}
+		}
+		if i-n <= reps {
+			return (t + float64(i-n)*e.d - s.pto) / s.timescale, true
+		}
+		n += reps + 1
+		t += float64(reps+1) * e.d
+	}
+	return 0, false
+}
+
+// RewriteMPD applies grace-rule token swaps to a DASH MPD, the counterpart of
+// RewriteManifest for HLS.
+//
+// Movie time of a segment is the start of its Period plus its start in the
+// Period (SegmentTimeline or @duration, with @presentationTimeOffset and
+// @timescale applied); a session that starts mid-movie is expressed with
+// Period@start. Token swaps apply to:
+//   - SegmentURL entries whose movie-time start falls within [0, graceUntil);
+//   - SegmentTemplate and Initialization, which serve every segment of their
+//     list, if the first segment starts within grace;
+//   - BaseURL entries, if their Period (the first one for MPD-level ones)
+//     starts within grace.
+//
+// The document is not re-serialized, only token values inside the matching
+// tags change. Malformed documents pass through unchanged.
+func RewriteMPD(body []byte, claims jwt.MapClaims, primaryToken string) []byte {
+	rule := findGraceRule(claims)
+	if rule == nil || primaryToken == "" {
+		return body
+	}
+	ranges, err := mpdGraceRanges(body, float64(rule.DurationSec))
+	if err != nil || len(ranges) == 0 {
+		return body
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+	needle := []byte("token=" + primaryToken)
+	repl := []byte("token=" + rule.Token)
+	var out bytes.Buffer
+	out.Grow(len(body))
+	var prev int64
+	for _, r := range ranges {
+		out.Write(body[prev:r.start])
+		out.Write(bytes.ReplaceAll(body[r.start:r.end], needle, repl))
+		prev = r.end
+	}
+	out.Write(body[prev:])
+	return out.Bytes()
+}
+
+// mpdGraceRanges walks the MPD and returns ranges of tags and BaseURL texts
+// that get the grace token.
+func mpdGraceRanges(body []byte, graceUntil float64) ([]mpdRange, error) {
+	d := xml.NewDecoder(bytes.NewReader(body))
+	var (
+		res           []mpdRange
+		seg           *mpdSegments
+		inPeriod      bool
+		periodSeen    bool
+		periodStart   float64
+		nextStart     float64
+		inBaseURL     bool
+		depth         int
+		mpdBaseURLs   []mpdRange
+		periodStarted = func(start float64) {
+			if start < graceUntil {
+				res = append(res, mpdBaseURLs...)
+			}
+			mpdBaseURLs = nil
+		}
+		decide = func(r mpdRange, start float64, ok bool) {
+			if ok && periodStart+start < graceUntil {
+				res = append(res, r)
+			}
+		}
+		resolvePending = func() {
+			if seg == nil || seg.pending == nil {
+				return
+			}
+			start, ok := seg.start(0)
+			for _, r := range seg.pending {
+				decide(r, start, ok)
+			}
+			seg.pending = nil
+		}
+	)
+	for {
+		off := d.InputOffset()
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			if depth != 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		r := mpdRange{off, d.InputOffset()}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			switch t.Name.Local {
+			case "Period":
+				periodStart = nextStart
+				if v, ok := parseISODuration(xmlAttr(t, "start")); ok {
+					periodStart = v
+				}
+				nextStart = periodStart
+				if v, ok := parseISODuration(xmlAttr(t, "duration")); ok {
+					nextStart += v
+				}
+				if !periodSeen {
+					periodStarted(periodStart)
+					periodSeen = true
+				}
+				inPeriod = true
+			case "BaseURL":
+				inBaseURL = true
+			case "SegmentTemplate", "SegmentList":
+				seg = &mpdSegments{
+					timescale: xmlFloatAttr(t, "timescale", 1),
+					pto:       xmlFloatAttr(t, "presentationTimeOffset", 0),
+					duration:  xmlFloatAttr(t, "duration", 0),
+					pending:   []mpdRange{r},
+				}
+				if seg.timescale <= 0 {
+					seg.timescale = 1
+				}
+			case "Initialization":
+				if seg != nil && seg.pending != nil {
+					seg.pending = append(seg.pending, r)
+				}
+			case "S":
+				if seg != nil {
+					s := mpdS{
+						d: xmlFloatAttr(t, "d", 0),
+						r: int(xmlFloatAttr(t, "r", 0)),
+					}
+					if v := xmlAttr(t, "t"); v != "" {
+						s.t, _ = strconv.ParseFloat(v, 64)
+						s.hasT = true
+					}
+					seg.timeline = append(seg.timeline, s)
+				}
+			case "SegmentURL":
+				if seg != nil {
+					resolvePending()
+					start, ok := seg.start(seg.next)
+					decide(r, start, ok)
+					seg.next++
+				}
+			}
+		case xml.CharData:
+			if !inBaseURL {
+				continue
+			}
+			if inPeriod {
+				decide(r, 0, true)
+			} else if !periodSeen {
+				mpdBaseURLs = append(mpdBaseURLs, r)
+			}
+		case xml.EndElement:
+			depth--
+			switch t.Name.Local {
+			case "Period":
+				inPeriod = false
+			case "BaseURL":
+				inBaseURL = false
+			case "SegmentTemplate", "SegmentList":
+				resolvePending()
+				seg = nil
+			}
+		}
+	}
+	return res, nil
+}
+
+func xmlAttr(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func xmlFloatAttr(e xml.StartElement, name string, def float64) float64 {
+	v, err := strconv.ParseFloat(xmlAttr(e, name), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+var isoDurationRe = regexp.MustCompile(`^P(?:(\d+(?:\.\d+)?)D)?(?:T(?:(\d+(?:\.\d+)?)H)?(?:(\d+(?:\.\d+)?)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// parseISODuration parses xs:duration values of MPD attributes, e.g.
+// PT1H2M3.5S, into seconds. Years and months are not supported.
+func parseISODuration(s string) (float64, bool) {
+	m := isoDurationRe.FindStringSubmatch(s)
+	if m == nil || s == "P" || s == "PT" {
+		return 0, false
+	}
+	res := 0.0
+	for i, mul := range []float64{86400, 3600, 60, 1} {
+		if m[i+1] == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(m[i+1], 64)
+		if err != nil {
+			return 0, false
+		}
+		res += v * mul
+	}
+	return res, true
+}
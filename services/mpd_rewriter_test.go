@@ -0,0 +1,209 @@
+package services
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// testMPD builds an MPD with a Period starting at periodStart and a
+// SegmentList of 4 × 6s segments, each URL carrying the primary token.
+func testMPD(periodStart string) []byte {
+	return []byte(strings.Join([]string{
+		`<?xml version="1.0" encoding="UTF-8"?>`,
+		`<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static">`,
+		`  <Period start="` + periodStart + `">`,
+		`    <AdaptationSet mimeType="video/mp4">`,
+		`      <Representation id="720" bandwidth="5000000">`,
+		`        <SegmentList timescale="1000" duration="6000">`,
+		`          <Initialization sourceURL="init.mp4?token=` + primaryJWT + `&amp;api-key=K"/>`,
+		`          <SegmentURL media="v0-0.m4s?token=` + primaryJWT + `&amp;api-key=K"/>`,
+		`          <SegmentURL media="v0-1.m4s?token=` + primaryJWT + `&amp;api-key=K"/>`,
+		`          <SegmentURL media="v0-2.m4s?token=` + primaryJWT + `&amp;api-key=K"/>`,
+		`          <SegmentURL media="v0-3.m4s?token=` + primaryJWT + `&amp;api-key=K"/>`,
+		`        </SegmentList>`,
+		`      </Representation>`,
+		`    </AdaptationSet>`,
+		`  </Period>`,
+		`</MPD>`,
+		"",
+	}, "\n"))
+}
+
+func TestRewriteMPD_NoRule_PassesThrough(t *testing.T) {
+	body := testMPD("PT0S")
+	out := RewriteMPD(body, jwt.MapClaims{"rate": "5M"}, primaryJWT)
+	if string(out) != string(body) {
+		t.Fatalf("expected pass-through, got: %s", out)
+	}
+}
+
+func TestRewriteMPD_NoPrimary_PassesThrough(t *testing.T) {
+	body := testMPD("PT0S")
+	out := RewriteMPD(body, claimsWithGrace(1200), "")
+	if string(out) != string(body) {
+		t.Fatalf("expected pass-through, got: %s", out)
+	}
+}
+
+func TestRewriteMPD_FreshOffset_FirstSegmentsGetGrace(t *testing.T) {
+	// 4 × 6s segments, grace 12s → init and first 2 segments swap (start=0, start=6)
+	out := RewriteMPD(testMPD("PT0S"), claimsWithGrace(12), primaryJWT)
+	got := string(out)
+	for _, s := range []string{"init.mp4", "v0-0.m4s", "v0-1.m4s"} {
+		if !strings.Contains(got, s+"?token="+graceJWT+"&amp;api-key=K") {
+			t.Errorf("%s should have grace token, got:\n%s", s, got)
+		}
+	}
+	for _, s := range []string{"v0-2.m4s", "v0-3.m4s"} {
+		if !strings.Contains(got, s+"?token="+primaryJWT) {
+			t.Errorf("%s should keep primary token, got:\n%s", s, got)
+		}
+	}
+	// Nothing but tokens changes.
+	if strings.ReplaceAll(got, graceJWT, primaryJWT) != string(testMPD("PT0S")) {
+		t.Errorf("document should be kept as is, got:\n%s", got)
+	}
+}
+
+func TestRewriteMPD_OffsetPastGrace_NoSwap(t *testing.T) {
+	out := RewriteMPD(testMPD("PT25M"), claimsWithGrace(1200), primaryJWT)
+	if strings.Contains(string(out), graceJWT) {
+		t.Errorf("no segment should swap when period starts past grace, got:\n%s", out)
+	}
+}
+
+func TestRewriteMPD_OffsetMidGrace_PartialSwap(t *testing.T) {
+	// period start=1188, grace=1200 → 12s of grace remain → 2 segments
+	got := string(RewriteMPD(testMPD("PT19M48S"), claimsWithGrace(1200), primaryJWT))
+	for _, s := range []string{"init.mp4", "v0-0.m4s", "v0-1.m4s"} {
+		if !strings.Contains(got, s+"?token="+graceJWT) {
+			t.Errorf("%s should swap, got:\n%s", s, got)
+		}
+	}
+	if !strings.Contains(got, "v0-2.m4s?token="+primaryJWT) {
+		t.Errorf("v0-2 should keep primary token, got:\n%s", got)
+	}
+}
+
+func TestRewriteMPD_SegmentTemplate(t *testing.T) {
+	template := func(t0 string) []byte {
+		return []byte(strings.Join([]string{
+			`<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="dynamic">`,
+			`  <Period start="PT0S">`,
+			`    <AdaptationSet>`,
+			`      <SegmentTemplate timescale="90000" presentationTimeOffset="900000" media="$Number$.m4s?token=` + primaryJWT + `" initialization="init.mp4?token=` + primaryJWT + `">`,
+			`        <SegmentTimeline><S t="` + t0 + `" d="540000" r="9"/></SegmentTimeline>`,
+			`      </SegmentTemplate>`,
+			`    </AdaptationSet>`,
+			`  </Period>`,
+			`</MPD>`,
+		}, "\n"))
+	}
+	// Timeline starts at (1800000-900000)/90000 = 10s.
+	got := string(RewriteMPD(template("1800000"), claimsWithGrace(12), primaryJWT))
+	if strings.Contains(got, primaryJWT) {
+		t.Errorf("template starting within grace should swap, got:\n%s", got)
+	}
+	// Timeline starts at 20s.
+	got = string(RewriteMPD(template("2700000"), claimsWithGrace(12), primaryJWT))
+	if strings.Contains(got, graceJWT) {
+		t.Errorf("template starting past grace should not swap, got:\n%s", got)
+	}
+}
+
+func TestRewriteMPD_SegmentListTimeline(t *testing.T) {
+	body := []byte(strings.Join([]string{
+		`<MPD><Period>`,
+		`<SegmentList timescale="10">`,
+		`<SegmentTimeline><S t="0" d="40" r="1"/><S d="20" r="-1"/></SegmentTimeline>`,
+		`<SegmentURL media="a.m4s?token=` + primaryJWT + `"/>`, // 0s
+		`<SegmentURL media="b.m4s?token=` + primaryJWT + `"/>`, // 4s
+		`<SegmentURL media="c.m4s?token=` + primaryJWT + `"/>`, // 8s
+		`<SegmentURL media="d.m4s?token=` + primaryJWT + `"/>`, // 10s
+		`</SegmentList>`,
+		`</Period></MPD>`,
+	}, "\n"))
+	got := string(RewriteMPD(body, claimsWithGrace(9), primaryJWT))
+	for _, s := range []string{"a.m4s", "b.m4s", "c.m4s"} {
+		if !strings.Contains(got, s+"?token="+graceJWT) {
+			t.Errorf("%s should swap, got:\n%s", s, got)
+		}
+	}
+	if !strings.Contains(got, "d.m4s?token="+primaryJWT) {
+		t.Errorf("d.m4s should keep primary token, got:\n%s", got)
+	}
+}
+
+func TestRewriteMPD_BaseURL(t *testing.T) {
+	body := []byte(strings.Join([]string{
+		`<MPD>`,
+		`<BaseURL>https://a.example.com/?token=` + primaryJWT + `</BaseURL>`,
+		`<Period id="1" start="PT0S" duration="PT10S"><BaseURL>p1/?token=` + primaryJWT + `</BaseURL></Period>`,
+		`<Period id="2"><BaseURL>p2/?token=` + primaryJWT + `</BaseURL></Period>`,
+		`</MPD>`,
+	}, "\n"))
+	got := string(RewriteMPD(body, claimsWithGrace(10), primaryJWT))
+	for _, s := range []string{"https://a.example.com/", "p1/"} {
+		if !strings.Contains(got, s+"?token="+graceJWT) {
+			t.Errorf("%s should swap, got:\n%s", s, got)
+		}
+	}
+	// Second period starts after the first one, at 10s.
+	if !strings.Contains(got, "p2/?token="+primaryJWT) {
+		t.Errorf("p2 should keep primary token, got:\n%s", got)
+	}
+}
+
+func TestRewriteMPD_Malformed_PassesThrough(t *testing.T) {
+	body := []byte(`<MPD><Period><SegmentList><SegmentURL media="a.m4s?token=` + primaryJWT + `"/>`)
+	if out := RewriteMPD(body, claimsWithGrace(1200), primaryJWT); string(out) != string(body) {
+		t.Fatalf("expected pass-through, got: %s", out)
+	}
+}
+
+func TestRewriteManifestForGrace_MPD(t *testing.T) {
+	req := httptest.NewRequest("GET", "/manifest.mpd", nil)
+	resp := &http.Response{
+		Request: req,
+		Header:  http.Header{},
+		Body:    io.NopCloser(bytes.NewReader(testMPD("PT0S"))),
+	}
+	if err := rewriteManifestForGrace(resp, &RulesContext{Claims: claimsWithGrace(12), PrimaryToken: primaryJWT}); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), "v0-0.m4s?token="+graceJWT) {
+		t.Errorf("mpd response should be rewritten, got:\n%s", body)
+	}
+	if resp.ContentLength != int64(len(body)) {
+		t.Errorf("expected content length %d, got %d", len(body), resp.ContentLength)
+	}
+}
+
+func TestParseISODuration(t *testing.T) {
+	cases := []struct {
+		in   string
+		want float64
+		ok   bool
+	}{
+		{"PT0S", 0, true},
+		{"PT1H2M3.5S", 3723.5, true},
+		{"PT25M", 1500, true},
+		{"P1DT1S", 86401, true},
+		{"", 0, false},
+		{"PT", 0, false},
+		{"1500", 0, false},
+	}
+	for _, c := range cases {
+		got, ok := parseISODuration(c.in)
+		if got != c.want || ok != c.ok {
+			t.Errorf("in=%q want=%v,%v got=%v,%v", c.in, c.want, c.ok, got, ok)
+		}
+	}
+}
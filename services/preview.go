@@ -0,0 +1,286 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const tagEndlist = "#EXT-X-ENDLIST"
+
+// previewSigParam carries the signature of a segment URL listed in a preview
+// playlist, see SignPreviewSegments.
+const previewSigParam = "preview-sig"
+
+// previewSegmentExts are extensions of HLS media and init segments, which
+// previews serve only when listed in a truncated playlist.
+var previewSegmentExts = map[string]bool{
+	".ts":  true,
+	".m4s": true,
+	".mp4": true,
+	".aac": true,
+}
+
+// applyPreview is the response-rule handler registered in rules.go for
+// `kind=preview`. For anonymous roles it cuts HLS variant playlists after
+// DurationSec of movie time and caps progressive files at the same share of
+// their size, so that free previews need no separate transcoder job.
+// Segments left in playlists are signed, segment requests without a valid
+// signature are refused, so that segments past the cut can't be fetched by
+// URL. Other roles and other responses of mods pass through.
+func applyPreview(r *http.Response, rc *RulesContext) error {
+	if r.Request == nil || r.Body == nil || !isAnonymous(rc.Claims) {
+		return nil
+	}
+	rule := findPreviewRule(rc.Claims)
+	if rule == nil {
+		return nil
+	}
+	scope := previewScope(r.Request, rc)
+	switch {
+	case strings.HasSuffix(r.Request.URL.Path, ".m3u8"):
+		rd := TruncateManifest(r.Body, float64(rule.DurationSec))
+		streamBody(r, SignPreviewSegments(rd, r.Request.URL, scope, rc.PreviewKey))
+	case rc.Mod == nil:
+		capPreviewFile(r, rule)
+	case previewSegmentExts[path.Ext(r.Request.URL.Path)]:
+		sig := r.Request.URL.Query().Get(previewSigParam)
+		if rc.PreviewKey == "" || sig != previewSegmentSig(rc.PreviewKey, scope, r.Request.URL.Path) {
+			emptyResponse(r, http.StatusForbidden)
+		}
+	}
+	return nil
+}
+
+// previewScope binds segment signatures to the file the playlist is a mod of,
+// as mods of different files share paths.
+func previewScope(r *http.Request, rc *RulesContext) string {
+	scope := rc.InfoHash
+	if fk := GetFileKey(r); fk != nil {
+		scope = fk.InfoHash + fk.Path
+	}
+	return scope
+}
+
+func previewSegmentSig(key string, scope string, segment string) string {
+	return signURLPayload("preview\n"+scope+"\n"+segment, key)
+}
+
+// SignPreviewSegments sets the preview-sig param on every relative URI of a
+// playlist streamed from src, resolved against base: segment lines and URI
+// attributes of tags, e.g. init segments of #EXT-X-MAP. Without a key, e.g.
+// when the API key has no HMAC secret, nothing is signed and no segment of
+// the preview is served.
+func SignPreviewSegments(src io.Reader, base *url.URL, scope string, key string) io.Reader {
+	if key == "" {
+		return src
+	}
+	sign := func(dst []byte, uri []byte) []byte {
+		if isAbsoluteURI(uri) {
+			return append(dst, uri...)
+		}
+		ref, err := url.Parse(string(uri))
+		if err != nil {
+			return append(dst, uri...)
+		}
+		var frag []byte
+		if i := bytes.IndexByte(uri, '#'); i >= 0 {
+			uri, frag = uri[:i], uri[i:]
+		}
+		sep := byte('?')
+		if bytes.IndexByte(uri, '?') >= 0 {
+			sep = '&'
+		}
+		dst = append(dst, uri...)
+		dst = append(dst, sep)
+		dst = append(dst, previewSigParam+"="...)
+		dst = append(dst, previewSegmentSig(key, scope, base.ResolveReference(ref).Path)...)
+		return append(dst, frag...)
+	}
+	return newLineReader(src, func(dst []byte, line []byte) []byte {
+		trimmed := bytes.TrimRight(line, "\r\n")
+		eol := line[len(trimmed):]
+		stripped := bytes.TrimLeft(trimmed, " \t")
+		if len(stripped) == 0 {
+			return append(dst, line...)
+		}
+		if stripped[0] != '#' {
+			dst = append(dst, trimmed[:len(trimmed)-len(stripped)]...)
+			dst = sign(dst, stripped)
+			return append(dst, eol...)
+		}
+		for {
+			i := bytes.Index(trimmed, uriAttr)
+			if i < 0 {
+				break
+			}
+			i += len(uriAttr)
+			j := bytes.IndexByte(trimmed[i:], '"')
+			if j < 0 {
+				break
+			}
+			dst = append(dst, trimmed[:i]...)
+			dst = sign(dst, trimmed[i:i+j])
+			trimmed = trimmed[i+j:]
+		}
+		dst = append(dst, trimmed...)
+		return append(dst, eol...)
+	})
+}
+
+// isAnonymous reports whether claims carry no role, which web.go accounts
+// as "nobody".
+func isAnonymous(claims jwt.MapClaims) bool {
+	role, _ := claims["role"].(string)
+	return role == "" || role == "nobody"
+}
+
+// findPreviewRule returns the first preview rule from a claims set, or nil
+// if none. Rules without a duration are skipped.
+func findPreviewRule(claims jwt.MapClaims) *Rule {
+	for _, r := range ExtractRules(claims) {
+		if r.Kind == "preview" && r.DurationSec > 0 {
+			rr := r
+			return &rr
+		}
+	}
+	return nil
+}
+
+// TruncateManifest cuts an HLS variant playlist streamed from src at the
+// first segment starting at or past previewSec of movie time and appends
+// #EXT-X-ENDLIST, so that players treat the preview as a complete VOD.
+// Movie time is accounted the same way as in RewriteManifest: the
+// #EXT-X-SESSION-OFFSET plus #EXTINF durations of the preceding segments.
+// The session-offset tag is kept for the grace rewriting that follows.
+//
+// Playlists ending within the preview, and master playlists, pass through
+// unchanged.
+func TruncateManifest(src io.Reader, previewSec float64) io.Reader {
+	movieTime := 0.0
+	pendingExtinf := 0.0
+	done := false
+
+	return newLineReader(src, func(dst []byte, line []byte) []byte {
+		if done {
+			return dst
+		}
+		trimmed := bytes.TrimRight(line, "\r\n")
+		stripped := bytes.TrimLeft(trimmed, " \t")
+
+		if bytes.HasPrefix(stripped, []byte(tagSessionOffset)) {
+			movieTime = parseSessionOffset(stripped)
+			return append(dst, line...)
+		}
+		if bytes.HasPrefix(stripped, []byte(tagExtinf)) {
+			if movieTime >= previewSec {
+				done = true
+				eol := line[len(trimmed):]
+				if len(eol) == 0 {
+					eol = []byte("\n")
+				}
+				dst = append(dst, tagEndlist...)
+				return append(dst, eol...)
+			}
+			if d, ok := parseExtinf(stripped); ok {
+				pendingExtinf = d
+			}
+			return append(dst, line...)
+		}
+		if len(stripped) == 0 || stripped[0] == '#' {
+			return append(dst, line...)
+		}
+		movieTime += pendingExtinf
+		pendingExtinf = 0
+		return append(dst, line...)
+	})
+}
+
+// capPreviewFile limits a progressive file response to the DurationSec to
+// TotalSec share of the file. Without TotalSec, or without the size of the
+// file, the share is unknown, and nothing of the file is served.
+func capPreviewFile(r *http.Response, rule *Rule) {
+	if r.StatusCode != http.StatusOK && r.StatusCode != http.StatusPartialContent {
+		return
+	}
+	if rule.TotalSec > 0 && rule.DurationSec >= rule.TotalSec {
+		return
+	}
+	size := SizeFromHeaders(r.StatusCode, r.ContentLength, r.Header.Get("Content-Range"))
+	if size <= 0 {
+		emptyResponse(r, http.StatusForbidden)
+		return
+	}
+	limit := int64(0)
+	if rule.TotalSec > 0 {
+		limit = size * int64(rule.DurationSec) / int64(rule.TotalSec)
+	}
+	start, end := int64(0), size-1
+	if r.StatusCode == http.StatusPartialContent {
+		var ok bool
+		start, end, ok = parseContentRange(r.Header.Get("Content-Range"))
+		if !ok {
+			return
+		}
+	}
+	if limit == 0 {
+		emptyResponse(r, http.StatusForbidden)
+		return
+	}
+	if start >= limit {
+		emptyResponse(r, http.StatusRequestedRangeNotSatisfiable)
+		r.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return
+	}
+	if end < limit {
+		return
+	}
+	end = limit - 1
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(r.Body, end-start+1), r.Body}
+	r.ContentLength = end - start + 1
+	r.Header.Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
+	if r.StatusCode == http.StatusPartialContent {
+		r.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	}
+}
+
+// parseContentRange extracts start and end offsets from a
+// "bytes <start>-<end>/<total>" Content-Range header.
+func parseContentRange(h string) (start int64, end int64, ok bool) {
+	start, ok = parseContentRangeStart(h)
+	if !ok {
+		return 0, 0, false
+	}
+	h = strings.TrimPrefix(h, "bytes ")
+	h = h[strings.IndexByte(h, '-')+1:]
+	if slash := strings.IndexByte(h, '/'); slash >= 0 {
+		h = h[:slash]
+	}
+	end, err := strconv.ParseInt(h, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// emptyResponse replaces r with a bodiless one of status.
+func emptyResponse(r *http.Response, status int) {
+	_ = r.Body.Close()
+	r.StatusCode = status
+	r.Status = fmt.Sprintf("%d %s", status, http.StatusText(status))
+	r.Body = http.NoBody
+	r.ContentLength = 0
+	r.Header.Set("Content-Length", "0")
+	r.Header.Del("Content-Range")
+	r.Header.Del("Content-Type")
+}
@@ -0,0 +1,218 @@
+package services
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func claimsWithPreview(durationSec int, totalSec int) jwt.MapClaims {
+	return jwt.MapClaims{
+		"rules": []interface{}{
+			map[string]interface{}{
+				"kind":         "preview",
+				"duration_sec": float64(durationSec),
+				"total_sec":    float64(totalSec),
+			},
+		},
+	}
+}
+
+// testVariant builds a VOD playlist of n × 6s segments.
+func testVariant(header string, n int) []byte {
+	lines := []string{"#EXTM3U", "#EXT-X-TARGETDURATION:6"}
+	if header != "" {
+		lines = append(lines, header)
+	}
+	for i := 0; i < n; i++ {
+		lines = append(lines, "#EXTINF:6.0,", "v0-"+string(rune('0'+i))+".ts")
+	}
+	lines = append(lines, tagEndlist, "")
+	return []byte(strings.Join(lines, "\n"))
+}
+
+func TestTruncateManifest(t *testing.T) {
+	got := readTestManifest(t, TruncateManifest(bytes.NewReader(testVariant("", 4)), 10))
+	want := strings.Join([]string{
+		"#EXTM3U",
+		"#EXT-X-TARGETDURATION:6",
+		"#EXTINF:6.0,",
+		"v0-0.ts",
+		"#EXTINF:6.0,",
+		"v0-1.ts",
+		tagEndlist,
+		"",
+	}, "\n")
+	if got != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestTruncateManifest_WithinPreview(t *testing.T) {
+	body := testVariant("", 4)
+	if got := readTestManifest(t, TruncateManifest(bytes.NewReader(body), 24)); got != string(body) {
+		t.Fatalf("expected pass-through, got:\n%s", got)
+	}
+}
+
+func TestTruncateManifest_SessionOffset(t *testing.T) {
+	// Session starts at 6s, so 1 segment of 12s of preview remains.
+	got := readTestManifest(t, TruncateManifest(bytes.NewReader(testVariant(tagSessionOffset+"6", 4)), 12))
+	if !strings.Contains(got, tagSessionOffset+"6\n") {
+		t.Errorf("session offset should be kept, got:\n%s", got)
+	}
+	if !strings.Contains(got, "v0-0.ts\n"+tagEndlist+"\n") || strings.Contains(got, "v0-1.ts") {
+		t.Errorf("expected cut after v0-0, got:\n%s", got)
+	}
+	// Session starts past the preview.
+	got = readTestManifest(t, TruncateManifest(bytes.NewReader(testVariant(tagSessionOffset+"30", 4)), 12))
+	if strings.Contains(got, ".ts") || !strings.HasSuffix(got, tagEndlist+"\n") {
+		t.Errorf("expected no segments, got:\n%s", got)
+	}
+}
+
+func TestTruncateManifest_Master(t *testing.T) {
+	body := []byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=5000000\nv0-720.m3u8\n")
+	if got := readTestManifest(t, TruncateManifest(bytes.NewReader(body), 1)); got != string(body) {
+		t.Fatalf("expected pass-through, got:\n%s", got)
+	}
+}
+
+func previewResponse(path string, status int, header http.Header, body []byte) *http.Response {
+	return &http.Response{
+		Request:       httptest.NewRequest("GET", path, nil),
+		StatusCode:    status,
+		Header:        header,
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(bytes.NewReader(body)),
+	}
+}
+
+func TestApplyPreview_Manifest(t *testing.T) {
+	resp := previewResponse("/index.m3u8", 200, http.Header{}, testVariant("", 4))
+	if err := applyPreview(resp, &RulesContext{Claims: claimsWithPreview(6, 0), Mod: &Mod{Type: "hls"}}); err != nil {
+		t.Fatal(err)
+	}
+	got := readTestManifest(t, resp.Body)
+	if strings.Contains(got, "v0-1.ts") || resp.ContentLength != -1 {
+		t.Fatalf("expected truncated chunked playlist, got %d:\n%s", resp.ContentLength, got)
+	}
+}
+
+func TestApplyPreview_NotAnonymous(t *testing.T) {
+	claims := claimsWithPreview(6, 0)
+	claims["role"] = "paid"
+	body := testVariant("", 4)
+	resp := previewResponse("/index.m3u8", 200, http.Header{}, body)
+	if err := applyPreview(resp, &RulesContext{Claims: claims}); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestManifest(t, resp.Body); got != string(body) {
+		t.Fatalf("expected pass-through, got:\n%s", got)
+	}
+}
+
+func TestApplyPreview_File(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 1000)
+	resp := previewResponse("/movie.mp4", 200, http.Header{"Content-Length": {"1000"}}, body)
+	if err := applyPreview(resp, &RulesContext{Claims: claimsWithPreview(60, 600)}); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := io.ReadAll(resp.Body)
+	if len(out) != 100 || resp.ContentLength != 100 || resp.Header.Get("Content-Length") != "100" {
+		t.Fatalf("expected 100 bytes, got %d (%d)", len(out), resp.ContentLength)
+	}
+}
+
+func TestApplyPreview_FileRange(t *testing.T) {
+	cases := []struct {
+		contentRange string
+		status       int
+		want         string
+	}{
+		{"bytes 50-149/1000", 206, "bytes 50-99/1000"},
+		{"bytes 10-19/1000", 206, "bytes 10-19/1000"},
+		{"bytes 100-199/1000", 416, "bytes */1000"},
+	}
+	for _, c := range cases {
+		resp := previewResponse("/movie.mp4", 206, http.Header{"Content-Range": {c.contentRange}}, bytes.Repeat([]byte("x"), 100))
+		if err := applyPreview(resp, &RulesContext{Claims: claimsWithPreview(60, 600)}); err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != c.status || resp.Header.Get("Content-Range") != c.want {
+			t.Errorf("%s: expected %d %s, got %d %s", c.contentRange, c.status, c.want, resp.StatusCode, resp.Header.Get("Content-Range"))
+		}
+	}
+}
+
+func TestApplyPreview_FileWithoutTotal(t *testing.T) {
+	resp := previewResponse("/movie.mp4", 200, http.Header{}, bytes.Repeat([]byte("x"), 1000))
+	if err := applyPreview(resp, &RulesContext{Claims: claimsWithPreview(60, 0)}); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", resp.StatusCode)
+	}
+}
+
+func TestApplyPreview_FileUnknownSize(t *testing.T) {
+	resp := previewResponse("/movie.mp4", 200, http.Header{}, bytes.Repeat([]byte("x"), 1000))
+	resp.ContentLength = -1
+	if err := applyPreview(resp, &RulesContext{Claims: claimsWithPreview(60, 600)}); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403, got %d", resp.StatusCode)
+	}
+}
+
+func TestApplyPreview_Segments(t *testing.T) {
+	rc := &RulesContext{Claims: claimsWithPreview(6, 0), Mod: &Mod{Type: "hls"}, PreviewKey: "secret"}
+	withFile := func(resp *http.Response, file string) *http.Response {
+		resp.Request = WithFileKey(resp.Request, "08ada5a7a6183aae1e09d831df6748d566095a10", file)
+		return resp
+	}
+	resp := withFile(previewResponse("/720/index.m3u8", 200, http.Header{}, testVariant("#EXT-X-MAP:URI=\"init.mp4\"", 4)), "/e01.mkv")
+	if err := applyPreview(resp, rc); err != nil {
+		t.Fatal(err)
+	}
+	got := readTestManifest(t, resp.Body)
+	if !strings.Contains(got, `URI="init.mp4?`+previewSigParam+"=") {
+		t.Fatalf("expected signed init segment, got:\n%s", got)
+	}
+	var segments []string
+	for _, line := range strings.Split(got, "\n") {
+		if strings.HasPrefix(line, "v0-") {
+			segments = append(segments, line)
+		}
+	}
+	if len(segments) != 1 || !strings.HasPrefix(segments[0], "v0-0.ts?"+previewSigParam+"=") {
+		t.Fatalf("expected one signed segment, got %v", segments)
+	}
+
+	get := func(uri string, file string) int {
+		resp := withFile(previewResponse("/720/"+uri, 200, http.Header{}, []byte("segment")), file)
+		if err := applyPreview(resp, rc); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	if status := get(segments[0], "/e01.mkv"); status != http.StatusOK {
+		t.Fatalf("expected listed segment to be served, got %d", status)
+	}
+	if status := get("v0-3.ts", "/e01.mkv"); status != http.StatusForbidden {
+		t.Fatalf("expected segment past the cut to be refused, got %d", status)
+	}
+	sig := strings.TrimPrefix(segments[0], "v0-0.ts")
+	if status := get("v0-3.ts"+sig, "/e01.mkv"); status != http.StatusForbidden {
+		t.Fatalf("expected signature of another segment to be refused, got %d", status)
+	}
+	if status := get(segments[0], "/e02.mkv"); status != http.StatusForbidden {
+		t.Fatalf("expected signature of another file to be refused, got %d", status)
+	}
+}
@@ -0,0 +1,154 @@
+package services
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/redis/go-redis/v9"
+	"github.com/urfave/cli"
+)
+
+const quotaLimiterKeyPrefix = "thp:quota:"
+
+// Quota limits all streams of a tenant, or of one of its domains, together.
+// Zero values mean unlimited. MaxRate is in bits per second like the rate of
+// the key, e.g. "100M". DailyBytes and MonthlyBytes cap the volume served
+// within rolling windows of 24 hours and 30 days, e.g. "500G".
+type Quota struct {
+	MaxStreams    int    `yaml:"maxStreams"`
+	MaxInfoHashes int    `yaml:"maxInfoHashes"`
+	MaxRate       string `yaml:"maxRate"`
+	DailyBytes    string `yaml:"dailyBytes"`
+	MonthlyBytes  string `yaml:"monthlyBytes"`
+}
+
+// QuotaScope is a quota along with what it's shared by: "key:<api key>" or
+// "domain:<api key>|<domain>".
+type QuotaScope struct {
+	Scope string
+	Quota *Quota
+}
+
+// Quotas returns the quotas a request with claims counts toward, the one of
+// the key first.
+func (s *APIKey) Quotas(apiKey string, claims jwt.MapClaims) []QuotaScope {
+	var res []QuotaScope
+	if s.Quota != nil {
+		res = append(res, QuotaScope{"key:" + apiKey, s.Quota})
+	}
+	domain, _ := claims["domain"].(string)
+	if q := s.DomainQuotas[domain]; q != nil && domain != "" {
+		res = append(res, QuotaScope{"domain:" + apiKey + "|" + domain, q})
+	}
+	return res
+}
+
+// QuotaLimiter limits concurrent streams and distinct infohashes per quota
+// scope, so that one reseller can't starve the others. Unlike SessionLimiter
+// it counts requests without a session too. With Redis the counters are
+// shared by all replicas as leases, the in-process state is used while Redis
+// is down.
+type QuotaLimiter struct {
+	redis *redisLeases
+
+	mu     sync.Mutex
+	scopes map[string]*quotaState
+}
+
+type quotaState struct {
+	streams int
+	hashes  map[string]int
+}
+
+func NewQuotaLimiter(c *cli.Context, rc redis.UniversalClient) *QuotaLimiter {
+	l := &QuotaLimiter{
+		scopes: make(map[string]*quotaState),
+	}
+	if ttl := c.Int(SessionLimiterLeaseTTLFlag); rc != nil && c.Bool(SessionLimiterRedisFlag) && ttl > 0 {
+		l.redis = newRedisLeases(rc, time.Duration(ttl)*time.Second, quotaLimiterKeyPrefix, nil)
+	}
+	return l
+}
+
+// Acquire takes a stream of infoHash in every scope. On rejection release is
+// nil and scope and reason ("streams" or "infohashes") tell which quota is
+// exhausted.
+func (l *QuotaLimiter) Acquire(quotas []QuotaScope, infoHash string) (release func(), scope string, reason string) {
+	var releases []func()
+	releaseAll := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+	for _, q := range quotas {
+		if q.Quota.MaxStreams <= 0 && q.Quota.MaxInfoHashes <= 0 {
+			continue
+		}
+		r, reason := l.acquire(q, infoHash)
+		if r == nil {
+			releaseAll()
+			return nil, q.Scope, reason
+		}
+		releases = append(releases, r)
+	}
+	return releaseAll, "", ""
+}
+
+func (l *QuotaLimiter) acquire(q QuotaScope, infoHash string) (release func(), reason string) {
+	if l.redis != nil && l.redis.available() {
+		// Infohashes of the scope are its big files, all of them in one set.
+		release, reason, err := l.redis.acquire(leaseLimits{
+			maxTotal: q.Quota.MaxStreams,
+			maxBig:   q.Quota.MaxInfoHashes,
+		}, q.Scope, "", infoHash, "", true)
+		if err == nil {
+			return release, quotaReason(reason)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.scopes[q.Scope]
+	if !ok {
+		s = &quotaState{hashes: make(map[string]int)}
+		l.scopes[q.Scope] = s
+	}
+	if q.Quota.MaxStreams > 0 && s.streams >= q.Quota.MaxStreams {
+		return nil, "streams"
+	}
+	if _, active := s.hashes[infoHash]; !active && q.Quota.MaxInfoHashes > 0 && len(s.hashes) >= q.Quota.MaxInfoHashes {
+		return nil, "infohashes"
+	}
+	s.streams++
+	s.hashes[infoHash]++
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		s.streams--
+		s.hashes[infoHash]--
+		if s.hashes[infoHash] <= 0 {
+			delete(s.hashes, infoHash)
+		}
+		if s.streams <= 0 && l.scopes[q.Scope] == s {
+			delete(l.scopes, q.Scope)
+		}
+	}, ""
+}
+
+// quotaReason maps rejections of luaAcquireLease to those of quotas.
+func quotaReason(reason string) string {
+	switch reason {
+	case "total":
+		return "streams"
+	case "bigfiles":
+		return "infohashes"
+	}
+	return reason
+}
+
+func (l *QuotaLimiter) Close() {
+	if l.redis != nil {
+		l.redis.Close()
+	}
+}
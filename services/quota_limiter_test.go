@@ -0,0 +1,131 @@
+package services
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v3"
+)
+
+const testQuotaYAML = `
+secret: secret-a
+quota:
+  maxStreams: 3
+  maxInfoHashes: 2
+  maxRate: 100M
+domainQuotas:
+  a.example.com:
+    maxStreams: 1
+`
+
+func newTestQuotaKey(t *testing.T) *APIKey {
+	t.Helper()
+	k := &APIKey{}
+	if err := yaml.Unmarshal([]byte(testQuotaYAML), k); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func newTestQuotaReplica(t *testing.T, mr *miniredis.Miniredis) *QuotaLimiter {
+	t.Helper()
+	rc := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = rc.Close() })
+	l := &QuotaLimiter{scopes: make(map[string]*quotaState)}
+	l.redis = newRedisLeases(rc, time.Minute, quotaLimiterKeyPrefix, nil)
+	t.Cleanup(l.Close)
+	return l
+}
+
+func TestAPIKey_Quotas(t *testing.T) {
+	k := newTestQuotaKey(t)
+	qs := k.Quotas("tenant-a", jwt.MapClaims{"domain": "a.example.com"})
+	if len(qs) != 2 || qs[0].Scope != "key:tenant-a" || qs[1].Scope != "domain:tenant-a|a.example.com" {
+		t.Fatalf("unexpected quotas %+v", qs)
+	}
+	if qs := k.Quotas("tenant-a", jwt.MapClaims{"domain": "b.example.com"}); len(qs) != 1 {
+		t.Fatalf("expected key quota only, got %+v", qs)
+	}
+}
+
+func testQuotaLimits(t *testing.T, l *QuotaLimiter) {
+	t.Helper()
+	k := newTestQuotaKey(t)
+	key := k.Quotas("tenant-a", jwt.MapClaims{})
+
+	r1, _, _ := l.Acquire(key, "h1")
+	r2, _, _ := l.Acquire(key, "h2")
+	if r1 == nil || r2 == nil {
+		t.Fatal("expected streams within quota")
+	}
+	if r, scope, reason := l.Acquire(key, "h3"); r != nil || scope != "key:tenant-a" || reason != "infohashes" {
+		t.Fatalf("expected infohashes rejection, got %s %s", scope, reason)
+	}
+	r3, _, _ := l.Acquire(key, "h1")
+	if r3 == nil {
+		t.Fatal("active infohash should pass")
+	}
+	if r, _, reason := l.Acquire(key, "h1"); r != nil || reason != "streams" {
+		t.Fatalf("expected streams rejection, got %s", reason)
+	}
+	r2()
+	r4, _, _ := l.Acquire(key, "h3")
+	if r4 == nil {
+		t.Fatal("released infohash should free its slot")
+	}
+
+	// The domain quota rejects, the slot taken in the key quota is
+	// given back.
+	r1()
+	r3()
+	domain := k.Quotas("tenant-a", jwt.MapClaims{"domain": "a.example.com"})
+	r5, _, _ := l.Acquire(domain, "h1")
+	if r5 == nil {
+		t.Fatal("expected stream within domain quota")
+	}
+	if r, scope, reason := l.Acquire(domain, "h1"); r != nil || scope != "domain:tenant-a|a.example.com" || reason != "streams" {
+		t.Fatalf("expected domain streams rejection, got %s %s", scope, reason)
+	}
+	if r, _, _ := l.Acquire(key, "h1"); r == nil {
+		t.Fatal("rejected domain stream should not hold a key slot")
+	}
+}
+
+func TestQuotaLimiter_Local(t *testing.T) {
+	testQuotaLimits(t, &QuotaLimiter{scopes: make(map[string]*quotaState)})
+}
+
+func TestQuotaLimiter_Redis(t *testing.T) {
+	testQuotaLimits(t, newTestQuotaReplica(t, miniredis.RunT(t)))
+}
+
+func TestQuotaLimiterRedis_SharedAcrossReplicas(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := newTestQuotaReplica(t, mr)
+	b := newTestQuotaReplica(t, mr)
+	domain := newTestQuotaKey(t).Quotas("tenant-a", jwt.MapClaims{"domain": "a.example.com"})
+
+	r, _, _ := a.Acquire(domain, "h1")
+	if r == nil {
+		t.Fatal("expected stream")
+	}
+	if r, _, reason := b.Acquire(domain, "h1"); r != nil || reason != "streams" {
+		t.Fatalf("quota should be shared, got %s", reason)
+	}
+	r()
+	if r, _, _ := b.Acquire(domain, "h1"); r == nil {
+		t.Fatal("expected stream after release on the other replica")
+	}
+}
+
+func TestAPIKeys_ReloadBadQuotaRate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api-keys.yaml")
+	writeAPIKeys(t, path, "tenant-a:\n  secret: s\n  domainQuotas:\n    a.example.com:\n      maxRate: fast\n", time.Now())
+	if _, err := NewAPIKeys(path); err == nil {
+		t.Fatal("expected error")
+	}
+}
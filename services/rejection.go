@@ -0,0 +1,209 @@
+package services
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+const rejectionsConfigFlag = "rejections-config"
+
+// Codes of limiter rejections, they are part of the API and must not change.
+const (
+	rejectSessionIP        = "session_ip_mismatch"
+	rejectSessionTotal     = "session_total"
+	rejectSessionPath      = "session_path"
+	rejectSessionBigFiles  = "session_bigfiles"
+	rejectSessionIPs       = "session_ips"
+	rejectQuotaStreams     = "quota_streams"
+	rejectQuotaInfoHashes  = "quota_infohashes"
+	rejectByteQuotaDaily   = "byte_quota_daily"
+	rejectByteQuotaMonthly = "byte_quota_monthly"
+)
+
+var promLimiterRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "webtor_http_proxy_limiter_rejections_total",
+	Help: "Total number of requests rejected by limiters and quotas",
+}, []string{"code"})
+
+func init() {
+	prometheus.MustRegister(promLimiterRejections)
+}
+
+func RegisterRejectionsFlags(f []cli.Flag) []cli.Flag {
+	return append(f,
+		cli.StringFlag{
+			Name:   rejectionsConfigFlag,
+			Usage:  "path to the YAML file overriding messages and retry-after seconds of limiter rejections by code",
+			EnvVar: "REJECTIONS_CONFIG",
+		},
+	)
+}
+
+// Rejection is the body of a request rejected by a limiter. RetryAfter is an
+// estimate in seconds of when a retry may pass, zero if it won't without a
+// new token.
+type Rejection struct {
+	Code       string `json:"code" yaml:"-"`
+	Message    string `json:"message" yaml:"message"`
+	RetryAfter int64  `json:"retry_after,omitempty" yaml:"retryAfter"`
+}
+
+// defaultRejections estimate RetryAfter by how soon the limit frees up:
+// concurrency slots free as soon as other requests end, the IP window rolls
+// in a minute. Byte quotas know it exactly.
+var defaultRejections = map[string]Rejection{
+	rejectSessionIP:        {Message: "The session is bound to another network, a new token is required"},
+	rejectSessionTotal:     {Message: "Too many concurrent requests in the session", RetryAfter: 5},
+	rejectSessionPath:      {Message: "Too many concurrent requests for the file", RetryAfter: 5},
+	rejectSessionBigFiles:  {Message: "Too many files of the torrent are played at once", RetryAfter: 10},
+	rejectSessionIPs:       {Message: "The file is played from too many networks", RetryAfter: int64(ipWindow.Seconds())},
+	rejectQuotaStreams:     {Message: "Too many concurrent streams of the API key", RetryAfter: 5},
+	rejectQuotaInfoHashes:  {Message: "Too many torrents are streamed with the API key", RetryAfter: 10},
+	rejectByteQuotaDaily:   {Message: "Daily traffic quota is exhausted"},
+	rejectByteQuotaMonthly: {Message: "Monthly traffic quota is exhausted"},
+}
+
+// Rejections are the responses of limiter rejections by code.
+type Rejections struct {
+	codes map[string]Rejection
+}
+
+// NewRejections loads the rejections config file, the defaults are used
+// without it.
+func NewRejections(c *cli.Context) (*Rejections, error) {
+	f := c.String(rejectionsConfigFlag)
+	if f == "" {
+		return &Rejections{codes: defaultRejections}, nil
+	}
+	return LoadRejections(f)
+}
+
+// LoadRejections reads overrides of the defaults from file, an override
+// without a message keeps the default one.
+func LoadRejections(file string) (*Rejections, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read rejections config %s", file)
+	}
+	overrides := map[string]Rejection{}
+	if err := yaml.Unmarshal(data, &overrides); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse rejections config %s", file)
+	}
+	codes := map[string]Rejection{}
+	for code, rej := range defaultRejections {
+		codes[code] = rej
+	}
+	for code, rej := range overrides {
+		def, ok := codes[code]
+		if !ok {
+			return nil, errors.Errorf("unknown rejection code %s in %s", code, file)
+		}
+		if rej.RetryAfter < 0 {
+			return nil, errors.Errorf("negative retry after of rejection %s in %s", code, file)
+		}
+		if rej.Message == "" {
+			rej.Message = def.Message
+		}
+		codes[code] = rej
+	}
+	return &Rejections{codes: codes}, nil
+}
+
+func (s *Rejections) get(code string) Rejection {
+	codes := defaultRejections
+	if s != nil {
+		codes = s.codes
+	}
+	rej := codes[code]
+	rej.Code = code
+	return rej
+}
+
+// sessionRejectCode maps reasons of SessionLimiter.Acquire to codes.
+func sessionRejectCode(reason string) string {
+	switch reason {
+	case "path":
+		return rejectSessionPath
+	case "bigfiles":
+		return rejectSessionBigFiles
+	case "ips":
+		return rejectSessionIPs
+	}
+	return rejectSessionTotal
+}
+
+// quotaRejectCode maps reasons of QuotaLimiter.Acquire to codes.
+func quotaRejectCode(reason string) string {
+	if reason == "infohashes" {
+		return rejectQuotaInfoHashes
+	}
+	return rejectQuotaStreams
+}
+
+// reject writes the rejection of code with status, as JSON or as plain text
+// depending on Accept. A positive retryAfter overrides the configured one.
+func (s *Web) reject(w http.ResponseWriter, r *http.Request, status int, code string, retryAfter int64) {
+	promLimiterRejections.WithLabelValues(code).Inc()
+	rej := s.rejections.get(code)
+	if retryAfter > 0 {
+		rej.RetryAfter = retryAfter
+	}
+	if rej.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(rej.RetryAfter, 10))
+	}
+	if prefersText(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(status)
+		_, _ = fmt.Fprintln(w, rej.Message)
+		return
+	}
+	writeJSON(w, status, rej)
+}
+
+// prefersText reports whether accept ranks text/plain above
+// application/json. JSON wins ties, so it's served to clients that accept
+// anything.
+func prefersText(accept string) bool {
+	return acceptQuality(accept, "text/plain") > acceptQuality(accept, "application/json")
+}
+
+// acceptQuality returns the q-value accept gives to mediaType by its most
+// specific matching range, 0 if none matches.
+func acceptQuality(accept string, mediaType string) float64 {
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		sp := -1
+		switch {
+		case mt == mediaType:
+			sp = 2
+		case strings.HasSuffix(mt, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mt, "*")):
+			sp = 1
+		case mt == "*/*":
+			sp = 0
+		}
+		if sp <= specificity {
+			continue
+		}
+		specificity, q = sp, 1
+		if v, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+	}
+	return q
+}
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrefersText(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"":                                   false,
+		"*/*":                                false,
+		"application/json":                   false,
+		"text/plain":                         true,
+		"text/*":                             true,
+		"text/plain;q=0.5, application/json": false,
+		"application/json;q=0.5, text/plain": true,
+		"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8": false,
+		"text/*, application/json;q=0":                                    true,
+	} {
+		if got := prefersText(accept); got != want {
+			t.Errorf("%q: expected %v, got %v", accept, want, got)
+		}
+	}
+}
+
+func TestLoadRejections(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "rejections.yaml")
+	if err := os.WriteFile(f, []byte("session_total:\n  message: Slow down\n  retryAfter: 30\nsession_ips:\n  retryAfter: 120\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := LoadRejections(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rej := rs.get(rejectSessionTotal); rej.Message != "Slow down" || rej.RetryAfter != 30 || rej.Code != rejectSessionTotal {
+		t.Errorf("unexpected override %+v", rej)
+	}
+	if rej := rs.get(rejectSessionIPs); rej.Message != defaultRejections[rejectSessionIPs].Message || rej.RetryAfter != 120 {
+		t.Errorf("expected default message, got %+v", rej)
+	}
+	if rej := rs.get(rejectSessionPath); rej != (Rejection{Code: rejectSessionPath, Message: defaultRejections[rejectSessionPath].Message, RetryAfter: 5}) {
+		t.Errorf("expected default, got %+v", rej)
+	}
+
+	if err := os.WriteFile(f, []byte("unknown:\n  message: x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadRejections(f); err == nil {
+		t.Error("expected error on unknown code")
+	}
+}
+
+func TestWeb_Reject(t *testing.T) {
+	s := &Web{}
+
+	w := httptest.NewRecorder()
+	s.reject(w, httptest.NewRequest("GET", "/", nil), http.StatusTooManyRequests, sessionRejectCode("bigfiles"), 0)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "10" {
+		t.Fatalf("expected 429 with retry after, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	var rej Rejection
+	if err := json.Unmarshal(w.Body.Bytes(), &rej); err != nil {
+		t.Fatal(err)
+	}
+	if rej.Code != rejectSessionBigFiles || rej.Message == "" || rej.RetryAfter != 10 {
+		t.Fatalf("unexpected body %+v", rej)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "text/plain")
+	w = httptest.NewRecorder()
+	s.reject(w, req, http.StatusPaymentRequired, rejectByteQuotaMonthly, 3600)
+	if w.Code != http.StatusPaymentRequired || w.Header().Get("Retry-After") != "3600" ||
+		!strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") ||
+		w.Body.String() != defaultRejections[rejectByteQuotaMonthly].Message+"\n" {
+		t.Fatalf("unexpected text rejection %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.reject(w, httptest.NewRequest("GET", "/", nil), http.StatusTooManyRequests, rejectSessionIP, 0)
+	if w.Header().Get("Retry-After") != "" {
+		t.Fatalf("ip mismatch should not be retried, got %q", w.Header().Get("Retry-After"))
+	}
+}
@@ -23,20 +23,65 @@ type Location struct {
 	Unavailable bool
 }
 
+// Endpoint is a single upstream address reported by an endpoints provider,
+// before distribution picks the one serving a request. Weight and NodeWeight
+// are only set for weighted services; nil means the default weight of 1,
+// zero means no traffic.
+type Endpoint struct {
+	Ports
+	IP         string
+	NodeName   string
+	Weight     *float64
+	NodeWeight *float64
+}
+
+// weight is the effective weight of the endpoint when endpoints are picked
+// from a flat list: a pod on a node twice as big takes twice the share.
+func (e *Endpoint) weight() float64 {
+	return weightOrDefault(e.Weight) * weightOrDefault(e.NodeWeight)
+}
+
+func weightOrDefault(w *float64) float64 {
+	if w == nil {
+		return 1
+	}
+	return *w
+}
+
+func (e *Endpoint) toLocation() *Location {
+	if e == nil {
+		return &Location{
+			Unavailable: true,
+		}
+	}
+	return &Location{
+		IP:    net.ParseIP(e.IP),
+		Ports: e.Ports,
+	}
+}
+
 type Resolver struct {
 	cfg    *ServicesConfig
 	svcLoc *ServiceLocation
 }
 
 func NewResolver(cfg *ServicesConfig, svcLoc *ServiceLocation) *Resolver {
+	// Static endpoints files push their changes the same way EndpointSlices
+	// do, so edits are served without waiting for the location cache.
+	for _, c := range *cfg {
+		if c.Static != nil && c.Static.endpoints != nil {
+			c.Static.endpoints.Subscribe(svcLoc.invalidate)
+		}
+	}
 	return &Resolver{
 		cfg:    cfg,
 		svcLoc: svcLoc,
 	}
 }
 
-func (s *Resolver) Resolve(src *Source, claims jwt.MapClaims, logger *logrus.Entry) (*Location, error) {
-	start := time.Now()
+// getConfig returns the config of the service serving src, a role specific
+// one comes first.
+func (s *Resolver) getConfig(src *Source, claims jwt.MapClaims) *ServiceConfig {
 	role, ok := claims["role"].(string)
 	var cfg *ServiceConfig
 	edgeType := src.GetEdgeType()
@@ -46,6 +91,12 @@ func (s *Resolver) Resolve(src *Source, claims jwt.MapClaims, logger *logrus.Ent
 	if cfg == nil {
 		cfg = s.cfg.GetMod(edgeType)
 	}
+	return cfg
+}
+
+func (s *Resolver) Resolve(src *Source, claims jwt.MapClaims, logger *logrus.Entry) (*Location, error) {
+	start := time.Now()
+	cfg := s.getConfig(src, claims)
 	l, err := s.svcLoc.Get(cfg, src, claims)
 	logger = logger.WithField("duration", time.Since(start).Milliseconds())
 	if err != nil {
@@ -55,3 +106,17 @@ func (s *Resolver) Resolve(src *Source, claims jwt.MapClaims, logger *logrus.Ent
 	logger.WithField("location", l.IP).Info("location resolved")
 	return l, nil
 }
+
+// ResolveFallback resolves a location of src other than excludeIP.
+func (s *Resolver) ResolveFallback(src *Source, claims jwt.MapClaims, excludeIP net.IP, logger *logrus.Entry) (*Location, error) {
+	cfg := s.getConfig(src, claims)
+	if cfg == nil {
+		return nil, errors.New("no service config found")
+	}
+	l, err := s.svcLoc.GetFallback(cfg, src, excludeIP, claims)
+	if err != nil {
+		return nil, err
+	}
+	logger.WithField("location", l.IP).WithField("excluded", excludeIP).Info("fallback location resolved")
+	return l, nil
+}
@@ -22,6 +22,10 @@ type ResponseWriterInterceptor struct {
 	// upstream's WriteHeader fires (which precedes the first body Write).
 	resolveSize func(statusCode int) prometheus.Counter
 	sizeCounter prometheus.Counter
+
+	// countBytes is called with the size of every Write before it goes
+	// out, an error aborts the response.
+	countBytes func(n int) error
 }
 
 func NewResponseWrtierInterceptor(w http.ResponseWriter) *ResponseWriterInterceptor {
@@ -48,6 +52,11 @@ func (w *ResponseWriterInterceptor) Write(p []byte) (int, error) {
 		}
 	}
 	n := len(p)
+	if w.countBytes != nil {
+		if err := w.countBytes(n); err != nil {
+			return 0, err
+		}
+	}
 	w.bytesWritten += n
 	if w.sizeCounter != nil {
 		w.sizeCounter.Add(float64(n))
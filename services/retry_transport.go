@@ -100,6 +100,7 @@ func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 		if failedIP == "" {
 			failedIP = failedHost
 		}
+		rc.SvcLoc.health.ReportError(failedIP)
 
 		// Resolve service config for this edge type.
 		edgeType := rc.Src.GetEdgeType()
@@ -136,6 +137,7 @@ func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 		innerTransport := &redirectFollowingTransport{rc.Transport, rc.ExternalTransport}
 		newResp, err := innerTransport.RoundTrip(newReq)
 		if err != nil {
+			rc.SvcLoc.health.ReportError(loc.IP.String())
 			return nil, errors.Wrap(err, "retry request failed")
 		}
 		if newResp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
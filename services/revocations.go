@@ -0,0 +1,231 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	revocationsRedisKey     = "thp:revocations"
+	revocationsRedisChannel = "thp:revocations"
+	revocationsSyncInterval = time.Minute
+)
+
+type RevocationKind string
+
+const (
+	RevokeJTI     RevocationKind = "jti"
+	RevokeSession RevocationKind = "session"
+	RevokeAPIKey  RevocationKind = "api_key"
+)
+
+// Revocation kills every token carrying Value in the claim of Kind until
+// ExpiresAt. Zero ExpiresAt revokes forever.
+type Revocation struct {
+	Kind      RevocationKind `json:"kind"`
+	Value     string         `json:"value"`
+	ExpiresAt time.Time      `json:"expires_at"`
+}
+
+func (s *Revocation) key() string {
+	return string(s.Kind) + ":" + s.Value
+}
+
+func (s *Revocation) expired(now time.Time) bool {
+	return !s.ExpiresAt.IsZero() && !now.Before(s.ExpiresAt)
+}
+
+func (s *Revocation) validate() error {
+	switch s.Kind {
+	case RevokeJTI, RevokeSession, RevokeAPIKey:
+	default:
+		return errors.Errorf("unknown revocation kind %q", s.Kind)
+	}
+	if s.Value == "" {
+		return errors.New("empty revocation value")
+	}
+	return nil
+}
+
+// Revocations is the token revocation list. Redis is the source of truth:
+// entries live in a hash and every new one is published, so all replicas
+// update their local mirror at once. The mirror is also re-read from the
+// hash periodically to catch messages missed while disconnected. Without
+// Redis the list is local to the process.
+type Revocations struct {
+	rc        redis.UniversalClient
+	mux       sync.RWMutex
+	entries   map[string]Revocation
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+func NewRevocations(rc redis.UniversalClient) *Revocations {
+	s := &Revocations{
+		rc:      rc,
+		entries: map[string]Revocation{},
+		cancel:  func() {},
+	}
+	if rc == nil {
+		return s
+	}
+	if err := s.sync(); err != nil {
+		log.WithError(err).Warn("failed to load revocations from redis")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	go s.run(ctx)
+	return s
+}
+
+func (s *Revocations) run(ctx context.Context) {
+	ps := s.rc.Subscribe(ctx, revocationsRedisChannel)
+	defer func(ps *redis.PubSub) {
+		_ = ps.Close()
+	}(ps)
+	ch := ps.Channel()
+	ticker := time.NewTicker(revocationsSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			var r Revocation
+			if err := json.Unmarshal([]byte(msg.Payload), &r); err != nil {
+				log.WithError(err).Warn("failed to parse revocation message")
+				continue
+			}
+			s.set(r)
+		case <-ticker.C:
+			if err := s.sync(); err != nil {
+				log.WithError(err).Warn("failed to sync revocations from redis")
+			}
+		}
+	}
+}
+
+// sync replaces the mirror with the content of the Redis hash and removes
+// expired entries from it.
+func (s *Revocations) sync() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	m, err := s.rc.HGetAll(ctx, revocationsRedisKey).Result()
+	if err != nil {
+		return errors.Wrap(err, "failed to get revocations")
+	}
+	now := time.Now()
+	entries := make(map[string]Revocation, len(m))
+	var expired []string
+	for k, v := range m {
+		var r Revocation
+		if err := json.Unmarshal([]byte(v), &r); err != nil {
+			log.WithError(err).Warnf("failed to parse revocation %s", k)
+			continue
+		}
+		if r.expired(now) {
+			expired = append(expired, k)
+			continue
+		}
+		entries[r.key()] = r
+	}
+	if len(expired) > 0 {
+		if err := s.rc.HDel(ctx, revocationsRedisKey, expired...).Err(); err != nil {
+			log.WithError(err).Warn("failed to remove expired revocations")
+		}
+	}
+	s.mux.Lock()
+	s.entries = entries
+	s.mux.Unlock()
+	return nil
+}
+
+func (s *Revocations) set(r Revocation) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.entries[r.key()] = r
+}
+
+// Add revokes tokens matching r on all replicas.
+func (s *Revocations) Add(r Revocation) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	if s.rc != nil {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.rc.HSet(ctx, revocationsRedisKey, r.key(), data).Err(); err != nil {
+			return errors.Wrap(err, "failed to store revocation")
+		}
+		if err := s.rc.Publish(ctx, revocationsRedisChannel, data).Err(); err != nil {
+			return errors.Wrap(err, "failed to publish revocation")
+		}
+	}
+	s.set(r)
+	return nil
+}
+
+// List returns revocations in effect sorted by kind and value.
+func (s *Revocations) List() []Revocation {
+	now := time.Now()
+	s.mux.RLock()
+	res := make([]Revocation, 0, len(s.entries))
+	for _, r := range s.entries {
+		if !r.expired(now) {
+			res = append(res, r)
+		}
+	}
+	s.mux.RUnlock()
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].key() < res[j].key()
+	})
+	return res
+}
+
+func (s *Revocations) isRevoked(kind RevocationKind, value string) bool {
+	if value == "" {
+		return false
+	}
+	r := Revocation{Kind: kind, Value: value}
+	s.mux.RLock()
+	e, ok := s.entries[r.key()]
+	s.mux.RUnlock()
+	return ok && !e.expired(time.Now())
+}
+
+// Check returns an error if the token with claims or its api key is revoked.
+func (s *Revocations) Check(claims jwt.MapClaims, apiKey string) error {
+	jti, _ := claims["jti"].(string)
+	if s.isRevoked(RevokeJTI, jti) {
+		return errors.Errorf("token %s is revoked", jti)
+	}
+	sessionID, _ := claims["sessionID"].(string)
+	if s.isRevoked(RevokeSession, sessionID) {
+		return errors.Errorf("session %s is revoked", sessionID)
+	}
+	if s.isRevoked(RevokeAPIKey, apiKey) {
+		return errors.Errorf("api key %s is revoked", apiKey)
+	}
+	return nil
+}
+
+func (s *Revocations) Close() {
+	s.closeOnce.Do(func() {
+		s.cancel()
+	})
+}
@@ -0,0 +1,180 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRevocations(t *testing.T, mr *miniredis.Miniredis) *Revocations {
+	t.Helper()
+	rc := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		_ = rc.Close()
+	})
+	r := NewRevocations(rc)
+	t.Cleanup(r.Close)
+	return r
+}
+
+func waitRevoked(t *testing.T, r *Revocations, kind RevocationKind, value string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !r.isRevoked(kind, value) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s %s was not revoked", kind, value)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRevocations_Check(t *testing.T) {
+	r := NewRevocations(nil)
+	claims := jwt.MapClaims{"jti": "t1", "sessionID": "s1"}
+	if err := r.Check(claims, "k1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, rev := range []Revocation{
+		{Kind: RevokeJTI, Value: "t1"},
+		{Kind: RevokeSession, Value: "s1"},
+		{Kind: RevokeAPIKey, Value: "k1"},
+	} {
+		r := NewRevocations(nil)
+		if err := r.Add(rev); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Check(claims, "k1"); err == nil {
+			t.Fatalf("%s: expected token to be revoked", rev.Kind)
+		}
+		if err := r.Check(jwt.MapClaims{"jti": "t2", "sessionID": "s2"}, "k2"); err != nil {
+			t.Fatalf("%s: unexpected error: %v", rev.Kind, err)
+		}
+	}
+
+	if err := r.Add(Revocation{Kind: RevokeJTI, Value: "t3", ExpiresAt: time.Now().Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Check(jwt.MapClaims{"jti": "t3"}, ""); err != nil {
+		t.Fatal("expected expired revocation to be ignored")
+	}
+	if err := r.Add(Revocation{Kind: "ip", Value: "10.0.0.1"}); err == nil {
+		t.Fatal("expected error for unknown kind")
+	}
+	if err := r.Add(Revocation{Kind: RevokeJTI}); err == nil {
+		t.Fatal("expected error for empty value")
+	}
+}
+
+func TestRevocations_Redis(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := newTestRevocations(t, mr)
+	b := newTestRevocations(t, mr)
+	// Wait for b to subscribe, messages published before are lost.
+	deadline := time.Now().Add(2 * time.Second)
+	for mr.PubSubNumSub(revocationsRedisChannel)[revocationsRedisChannel] < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("revocations did not subscribe")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := a.Add(Revocation{Kind: RevokeSession, Value: "s1"}); err != nil {
+		t.Fatal(err)
+	}
+	waitRevoked(t, b, RevokeSession, "s1")
+
+	// A new replica loads the list on start.
+	if err := a.Add(Revocation{Kind: RevokeJTI, Value: "t1", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Add(Revocation{Kind: RevokeJTI, Value: "t2", ExpiresAt: time.Now().Add(20 * time.Millisecond)}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	c := newTestRevocations(t, mr)
+	if !c.isRevoked(RevokeSession, "s1") || !c.isRevoked(RevokeJTI, "t1") || c.isRevoked(RevokeJTI, "t2") {
+		t.Fatalf("unexpected revocations: %+v", c.List())
+	}
+	if mr.HGet(revocationsRedisKey, "jti:t2") != "" {
+		t.Fatal("expected expired revocation to be removed from redis")
+	}
+}
+
+func TestClaims_Revoked(t *testing.T) {
+	c := &Claims{
+		apiKey:    "key",
+		apiSecret: "secret",
+		revoked:   NewRevocations(nil),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"jti": "t1"})
+	ts, err := token.SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ts, "key"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.revoked.Add(Revocation{Kind: RevokeJTI, Value: "t1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ts, "key"); err == nil {
+		t.Fatal("expected revoked token to be rejected")
+	}
+}
+
+func TestWeb_AdminRevocations(t *testing.T) {
+	s := &Web{
+		adminToken: "admin",
+		claims:     &Claims{revoked: NewRevocations(nil)},
+	}
+	mux := http.NewServeMux()
+	s.registerAdmin(mux)
+	do := func(method string, token string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/admin/revocations", bytes.NewBufferString(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	if w := do("GET", "", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", w.Code)
+	}
+	if w := do("GET", "wrong", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with wrong token, got %d", w.Code)
+	}
+	if w := do("POST", "admin", `{"kind":"session","value":"s1","ttl":60}`); w.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", w.Code, w.Body)
+	}
+	if w := do("POST", "admin", `{"kind":"ip","value":"10.0.0.1"}`); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unknown kind, got %d", w.Code)
+	}
+	w := do("GET", "admin", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var list []Revocation
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Kind != RevokeSession || list[0].Value != "s1" || time.Until(list[0].ExpiresAt) <= 0 {
+		t.Fatalf("unexpected revocations: %+v", list)
+	}
+
+	// Without a token the admin API isn't served at all.
+	mux = http.NewServeMux()
+	(&Web{}).registerAdmin(mux)
+	req := httptest.NewRequest("GET", "/admin/revocations", nil)
+	rw := httptest.NewRecorder()
+	mux.ServeHTTP(rw, req)
+	if rw.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rw.Code)
+	}
+}
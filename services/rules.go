@@ -11,6 +11,14 @@ type responseRuleHandler func(r *http.Response, rc *RulesContext) error
 // applyResponseRules. New rule kinds add themselves here instead of touching
 // the proxy hook directly.
 var responseRuleHandlers = []responseRuleHandler{
+	// Injection goes first, so that grace swaps find the primary token on
+	// every segment.
+	injectManifestTokens,
+	// Preview cuts playlists before grace swaps, which don't need to walk
+	// the segments past the cut.
+	applyPreview,
+	// Ads need the session offset, which grace rewriting strips.
+	insertAds,
 	rewriteManifestForGrace,
 }
 
@@ -1,15 +1,14 @@
 package services
 
 import (
-	"context"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/webtor-io/lazymap"
 	"github.com/webtor-io/torrent-http-proxy/services/k8s"
-	"io"
-	corev1 "k8s.io/api/core/v1"
+	"hash/fnv"
+	"math"
 	"math/rand"
 	"net"
 	"net/http"
@@ -18,6 +17,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/urfave/cli"
@@ -26,93 +26,58 @@ import (
 var sha1R = regexp.MustCompile("^[0-9a-f]{5,40}$")
 
 type ServiceLocation struct {
-	*lazymap.LazyMap[*Location]
-	ep           *k8s.Endpoints
-	nodes        *k8s.NodesStat
-	c            *cli.Context
-	nn           string
-	ignore       *EndpointIgnoreList
-	probeChecker *ProbeChecker
+	// locations caches resolved locations per service name, so changes of
+	// one service drop only its own entries.
+	locations map[string]*lazymap.LazyMap[*Location]
+	mux       sync.Mutex
+	ep        k8s.EndpointsGetter
+	nodes     *k8s.NodesStat
+	pods      *k8s.PodsStat
+	jobs      *k8s.Jobs
+	c         *cli.Context
+	nn        string
+	baseURL   string
+	health    *HealthChecker
 }
 
-type ProbeChecker struct {
-	*lazymap.LazyMap[bool]
-	cl *http.Client
-}
-
-func (s *ProbeChecker) Get(l *Location) (bool, error) {
-	return s.LazyMap.Get(l.IP.String(), func() (bool, error) {
-		probePort := l.Ports.Probe
-		if probePort == 0 {
-			probePort = l.Ports.HTTP
-		}
-		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		defer cancel()
-		req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%v:%v", l.IP, probePort), nil)
-		if err != nil {
-			return false, err
-		}
-		resp, err := s.cl.Do(req)
-		if err != nil {
-			return false, err
-		}
-		defer func(Body io.ReadCloser) {
-			_ = Body.Close()
-		}(resp.Body)
-		if resp.StatusCode >= 500 {
-			return false, errors.Errorf("unexpected status code: %d", resp.StatusCode)
-		}
-		return true, nil
-	})
-}
-
-type EndpointIgnoreList struct {
-	*lazymap.LazyMap[bool]
-}
-
-func (s *EndpointIgnoreList) Ignore(ip string) bool {
-	res, _ := s.Get(ip, func() (bool, error) {
-		return true, nil
+func NewServiceLocationPool(c *cli.Context, cl *http.Client, nodes *k8s.NodesStat, pods *k8s.PodsStat, ep k8s.EndpointsGetter, jobs *k8s.Jobs) *ServiceLocation {
+	s := &ServiceLocation{
+		c:         c,
+		ep:        ep,
+		nodes:     nodes,
+		pods:      pods,
+		jobs:      jobs,
+		nn:        c.String(myNodeNameFlag),
+		baseURL:   fmt.Sprintf("http://%s:%d", c.String(torrentHTTPProxyHostFlag), c.Int(torrentHTTPProxyPortFlag)),
+		locations: map[string]*lazymap.LazyMap[*Location]{},
+		health:    NewHealthChecker(c, cl),
+	}
+	// Ejected and re-admitted hosts change the result of every service they
+	// serve, so all cached locations go.
+	s.health.Subscribe(func(ip string) {
+		s.invalidateAll()
 	})
-	return res
-}
-
-func (s *EndpointIgnoreList) IsIgnored(ip string) bool {
-	_, ok := s.Status(ip)
-	return ok
-}
-
-func NewServiceLocationPool(c *cli.Context, cl *http.Client, nodes *k8s.NodesStat, ep *k8s.Endpoints) *ServiceLocation {
-	return &ServiceLocation{
-		c:     c,
-		ep:    ep,
-		nodes: nodes,
-		nn:    c.String(myNodeNameFlag),
-		LazyMap: lazymap.New[*Location](&lazymap.Config{
-			Expire: 15 * time.Second,
-		}),
-		ignore: &EndpointIgnoreList{lazymap.New[bool](&lazymap.Config{
-			Expire: 30 * time.Second,
-		})},
-		probeChecker: &ProbeChecker{
-			LazyMap: lazymap.New[bool](&lazymap.Config{
-				Expire:      30 * time.Second,
-				StoreErrors: true,
-			}),
-			cl: cl,
-		},
+	if sub, ok := ep.(k8s.EndpointsSubscriber); ok {
+		sub.Subscribe(s.invalidate)
 	}
+	return s
 }
 
 func (s *ServiceLocation) Get(cfg *ServiceConfig, src *Source, claims jwt.MapClaims) (*Location, error) {
-	key := cfg.Name + src.InfoHash
+	if cfg.EndpointsProvider == Job {
+		// Jobs cache ready pods on their own. Keeping the readiness wait out
+		// of the shared map means it never holds up other lookups, and a job
+		// that isn't ready yet is checked again on the next request.
+		return s.getJob(cfg, src)
+	}
+	key := src.InfoHash
 	role, ok := claims["role"].(string)
 	if ok {
 		key += role
 	}
-	return s.LazyMap.Get(key, func() (*Location, error) {
-		if cfg.EndpointsProvider == Kubernetes {
-			return s.getKubernetesWithProbeCheck(cfg, src, claims)
+	return s.getLocations(cfg.Name).Get(key, func() (*Location, error) {
+		if cfg.EndpointsProvider == Kubernetes || cfg.EndpointsProvider == Static || cfg.EndpointsProvider == DNS {
+			return s.resolve(cfg, src, claims, nil)
 		} else if cfg.EndpointsProvider == Environment {
 			return s.getEnvironment(cfg)
 		} else {
@@ -121,102 +86,164 @@ func (s *ServiceLocation) Get(cfg *ServiceConfig, src *Source, claims jwt.MapCla
 	})
 }
 
-func (s *ServiceLocation) getKubernetesWithProbeCheck(cfg *ServiceConfig, src *Source, claims jwt.MapClaims) (*Location, error) {
-	i := 0
-	for {
-		if i > 2 {
-			log.Warnf("failed to get location for %v after %v tries", cfg.Name, i)
-			return &Location{
-				Unavailable: true,
-			}, nil
-		}
-		l, err := s.getKubernetes(cfg, src, claims)
-		if err != nil {
-			return nil, err
-		}
-		if l.Unavailable {
-			return l, nil
-		}
-		_, err = s.probeChecker.Get(l)
+// resolve lists endpoints of a provider that reports several of them and
+// distributes src among them. The endpoint with the exclude IP, if any, is
+// left out.
+func (s *ServiceLocation) resolve(cfg *ServiceConfig, src *Source, claims jwt.MapClaims, exclude net.IP) (*Location, error) {
+	var es []Endpoint
+	var err error
+	if cfg.EndpointsProvider == Kubernetes {
+		es, err = s.getKubernetes(cfg)
+	} else if cfg.EndpointsProvider == Static {
+		es, err = s.getStatic(cfg)
+	} else if cfg.EndpointsProvider == DNS {
+		es, err = s.getDNS(cfg)
+	} else {
+		return nil, errors.Errorf("unknown endpoints provider: %s", cfg.EndpointsProvider)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if exclude != nil {
+		es = excludeEndpoint(es, exclude)
+	}
+	return s.distribute(cfg, src, claims, es)
+}
+
+func (s *ServiceLocation) getKubernetes(cfg *ServiceConfig) ([]Endpoint, error) {
+	as, err := s.ep.GetAddresses(cfg.Name)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get endpoints")
+	}
+	var nodeWeights map[string]*float64
+	var pods map[string]k8s.PodStat
+	if cfg.Weighted {
+		nodeWeights, pods, err = s.getWeights(as)
 		if err != nil {
-			log.WithError(err).Warnf("probe check failed for %v location %+v, add it to ignore", cfg.Name, l)
-			s.ignore.Ignore(l.IP.String())
-			i++
-			continue
+			log.WithError(err).Warnf("failed to get weights for %v, distributing unweighted", cfg.Name)
 		}
-		return l, nil
 	}
+	es := make([]Endpoint, 0, len(as))
+	for _, a := range as {
+		es = append(es, Endpoint{
+			IP:       a.IP,
+			NodeName: a.NodeName,
+			Ports: Ports{
+				HTTP:  a.Ports["http"],
+				Probe: a.Ports["httpprobe"],
+			},
+			Weight:     pods[a.PodName].Weight,
+			NodeWeight: nodeWeights[a.NodeName],
+		})
+	}
+	return es, nil
 }
 
-func (s *ServiceLocation) getKubernetes(cfg *ServiceConfig, src *Source, claims jwt.MapClaims) (*Location, error) {
-	endpoints, err := s.ep.Get(cfg.Name)
+func (s *ServiceLocation) getStatic(cfg *ServiceConfig) ([]Endpoint, error) {
+	if cfg.Static == nil || cfg.Static.endpoints == nil {
+		return nil, errors.Errorf("static endpoints are not configured for %s", cfg.Name)
+	}
+	return cfg.Static.endpoints.Get(), nil
+}
+
+func (s *ServiceLocation) getDNS(cfg *ServiceConfig) ([]Endpoint, error) {
+	if cfg.DNS == nil || cfg.DNS.endpoints == nil {
+		return nil, errors.Errorf("dns endpoints are not configured for %s", cfg.Name)
+	}
+	es, err := cfg.DNS.endpoints.Get()
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to get endpoints")
+		return nil, errors.Wrap(err, "failed to resolve dns records")
+	}
+	return es, nil
+}
+
+// getWeights returns node weights by node name and stats of the pods behind
+// as by pod name, both read from "<node-label-prefix>weight"
+// labels/annotations.
+func (s *ServiceLocation) getWeights(as []k8s.Address) (map[string]*float64, map[string]k8s.PodStat, error) {
+	if s.nodes == nil || s.pods == nil {
+		return nil, nil, errors.New("weights are not available without kubernetes")
+	}
+	ns, err := s.nodes.Get()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to get nodes")
+	}
+	nodeWeights := make(map[string]*float64, len(ns))
+	for _, n := range ns {
+		nodeWeights[n.Name] = n.Weight
+	}
+	names := make([]string, 0, len(as))
+	for _, a := range as {
+		names = append(names, a.PodName)
+	}
+	pods, err := s.pods.Get(names)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to get pods")
+	}
+	return nodeWeights, pods, nil
+}
+
+// distribute picks the endpoint serving src according to cfg.Distribution
+// and cfg.PreferLocalNode. Ejected endpoints and, for weighted services,
+// endpoints with zero weight are skipped; an empty set results in an
+// unavailable location.
+func (s *ServiceLocation) distribute(cfg *ServiceConfig, src *Source, claims jwt.MapClaims, es []Endpoint) (*Location, error) {
+	es = s.health.Filter(es)
+	if cfg.Weighted {
+		es = filterEndpointsByWeight(es)
 	}
-	subset := endpoints.Subsets[0]
-	as := subset.Addresses
-	as = s.filterAddressesByIgnore(as)
-	if len(as) == 0 {
+	if len(es) == 0 {
 		return &Location{
 			Unavailable: true,
 		}, nil
 	}
-	var a *corev1.EndpointAddress
+	var e *Endpoint
+	var err error
 	if !sha1R.Match([]byte(src.InfoHash)) {
-		a = &as[rand.Intn(len(as))]
+		e = &es[rand.Intn(len(es))]
+	} else if cfg.Distribution == Hash && cfg.Weighted {
+		e, err = s.distributeByWeightedHash(src, es)
 	} else if cfg.Distribution == Hash {
-		a, err = s.distributeByHash(src, as)
+		e, err = s.distributeByHash(src, es)
+	} else if cfg.Distribution == NodeHash && cfg.Weighted {
+		e, err = s.distributeByWeightedNodeHash(src, es, claims)
 	} else if cfg.Distribution == NodeHash {
-		a, err = s.distributeByNodeHash(src, as, claims)
+		e, err = s.distributeByNodeHash(src, es, claims)
+	} else if cfg.Distribution == Rendezvous {
+		e = s.distributeByRendezvous(src, es, cfg.Weighted)
+	} else if cfg.Distribution == NodeRendezvous {
+		e, err = s.distributeByNodeRendezvous(src, es, claims, cfg.Weighted)
 	}
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to distribute")
 	}
-	if a != nil && s.nn != "" && *a.NodeName != s.nn && cfg.PreferLocalNode {
-		var las []corev1.EndpointAddress
-		for _, a := range as {
-			if *a.NodeName == s.nn {
-				las = append(las, a)
+	if e != nil && s.nn != "" && e.NodeName != s.nn && cfg.PreferLocalNode {
+		var les []Endpoint
+		for _, e := range es {
+			if e.NodeName == s.nn {
+				les = append(les, e)
 			}
 		}
-		if len(las) > 0 {
-			a, err = s.distributeByHash(src, las)
+		if len(les) > 0 && (cfg.Distribution == Rendezvous || cfg.Distribution == NodeRendezvous) {
+			e = s.distributeByRendezvous(src, les, cfg.Weighted)
+		} else if len(les) > 0 && cfg.Weighted {
+			e, err = s.distributeByWeightedHash(src, les)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to distribute locally")
+			}
+		} else if len(les) > 0 {
+			e, err = s.distributeByHash(src, les)
 			if err != nil {
 				return nil, errors.Wrap(err, "failed to distribute locally")
 			}
 		}
 	}
-	return s.addressToLocation(a, &subset), nil
-}
-
-func (s *ServiceLocation) getPort(sub *corev1.EndpointSubset, name string) int {
-	for _, p := range sub.Ports {
-		if p.Name == name {
-			return int(p.Port)
-		}
-	}
-	return 0
-}
-
-func (s *ServiceLocation) addressToLocation(a *corev1.EndpointAddress, sub *corev1.EndpointSubset) *Location {
-	if a == nil {
-		return &Location{
-			Unavailable: true,
-		}
-	}
-	return &Location{
-		IP: net.ParseIP(a.IP),
-		Ports: Ports{
-			HTTP:  s.getPort(sub, "http"),
-			Probe: s.getPort(sub, "httpprobe"),
-		},
-		Unavailable: false,
-	}
+	return e.toLocation(), nil
 }
 
-func (s *ServiceLocation) distributeByHash(src *Source, as []corev1.EndpointAddress) (*corev1.EndpointAddress, error) {
-	sort.Slice(as, func(i, j int) bool {
-		return as[i].IP < as[j].IP
+func (s *ServiceLocation) distributeByHash(src *Source, es []Endpoint) (*Endpoint, error) {
+	sort.Slice(es, func(i, j int) bool {
+		return es[i].IP < es[j].IP
 	})
 	hex := src.InfoHash[0:5]
 	num64, err := strconv.ParseInt(hex, 16, 64)
@@ -225,23 +252,23 @@ func (s *ServiceLocation) distributeByHash(src *Source, as []corev1.EndpointAddr
 	}
 	num := int(num64 * 1000)
 	total := 1048575 * 1000
-	interval := total / len(as)
-	for i := 0; i < len(as); i++ {
+	interval := total / len(es)
+	for i := 0; i < len(es); i++ {
 		if num < (i+1)*interval {
-			return &as[i], nil
+			return &es[i], nil
 		}
 	}
 	return nil, nil
 }
 
-func (s *ServiceLocation) distributeByNodeHash(src *Source, as []corev1.EndpointAddress, claims jwt.MapClaims) (*corev1.EndpointAddress, error) {
-	sort.Slice(as, func(i, j int) bool {
-		return as[i].IP < as[j].IP
+func (s *ServiceLocation) distributeByNodeHash(src *Source, es []Endpoint, claims jwt.MapClaims) (*Endpoint, error) {
+	sort.Slice(es, func(i, j int) bool {
+		return es[i].IP < es[j].IP
 	})
 	nodesM := map[string]bool{}
 	var nodes []string
-	for _, a := range as {
-		nodesM[*a.NodeName] = true
+	for _, e := range es {
+		nodesM[e.NodeName] = true
 	}
 	for n := range nodesM {
 		nodes = append(nodes, n)
@@ -263,22 +290,200 @@ func (s *ServiceLocation) distributeByNodeHash(src *Source, as []corev1.Endpoint
 	}
 	nodeInterval := total / len(nodes)
 	for i := 0; i < len(nodes); i++ {
-		var nas []corev1.EndpointAddress
-		for _, a := range as {
-			if *a.NodeName == nodes[i] {
-				nas = append(nas, a)
+		var nes []Endpoint
+		for _, e := range es {
+			if e.NodeName == nodes[i] {
+				nes = append(nes, e)
 			}
 		}
-		aInterval := nodeInterval / len(nas)
-		for j := 0; j < len(nas); j++ {
-			if num < i*nodeInterval+(j+1)*aInterval {
-				return &nas[j], nil
+		eInterval := nodeInterval / len(nes)
+		for j := 0; j < len(nes); j++ {
+			if num < i*nodeInterval+(j+1)*eInterval {
+				return &nes[j], nil
 			}
 		}
 	}
 	return nil, nil
 }
 
+// hashFraction maps the first 5 hex chars of the infohash onto [0, 1), the
+// same key space distributeByHash splits into equal intervals.
+func hashFraction(src *Source) (float64, error) {
+	num64, err := strconv.ParseInt(src.InfoHash[0:5], 16, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to parse hex from infohash=%v", src.InfoHash)
+	}
+	return float64(num64) / 1048576, nil
+}
+
+// pickWeighted splits [0, 1) into intervals proportional to weights and
+// returns the index of the interval x falls into, along with the position
+// of x inside that interval scaled back to [0, 1).
+func pickWeighted(x float64, weights []float64) (int, float64) {
+	sum := 0.0
+	for _, w := range weights {
+		sum += w
+	}
+	t := x * sum
+	acc := 0.0
+	for i, w := range weights {
+		if t < acc+w {
+			return i, (t - acc) / w
+		}
+		acc += w
+	}
+	return len(weights) - 1, 0
+}
+
+// distributeByWeightedHash is distributeByHash with intervals proportional
+// to endpoint weights.
+func (s *ServiceLocation) distributeByWeightedHash(src *Source, es []Endpoint) (*Endpoint, error) {
+	sort.Slice(es, func(i, j int) bool {
+		return es[i].IP < es[j].IP
+	})
+	x, err := hashFraction(src)
+	if err != nil {
+		return nil, err
+	}
+	weights := make([]float64, len(es))
+	for i := range es {
+		weights[i] = es[i].weight()
+	}
+	i, _ := pickWeighted(x, weights)
+	return &es[i], nil
+}
+
+// distributeByWeightedNodeHash is distributeByNodeHash with node intervals
+// proportional to node weights and pod intervals inside a node proportional
+// to pod weights.
+func (s *ServiceLocation) distributeByWeightedNodeHash(src *Source, es []Endpoint, claims jwt.MapClaims) (*Endpoint, error) {
+	sort.Slice(es, func(i, j int) bool {
+		return es[i].IP < es[j].IP
+	})
+	nodesM := map[string]float64{}
+	var nodes []string
+	for _, e := range es {
+		nodesM[e.NodeName] = weightOrDefault(e.NodeWeight)
+	}
+	for n := range nodesM {
+		nodes = append(nodes, n)
+	}
+	sort.Strings(nodes)
+	nodes, err := s.filterNodesByRole(nodes, claims)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to filter nodes by role")
+	}
+	if len(nodes) == 0 {
+		return nil, errors.New("failed to distribute, no nodes found")
+	}
+	x, err := hashFraction(src)
+	if err != nil {
+		return nil, err
+	}
+	nodeWeights := make([]float64, len(nodes))
+	for i, n := range nodes {
+		nodeWeights[i] = nodesM[n]
+	}
+	i, y := pickWeighted(x, nodeWeights)
+	var nes []Endpoint
+	var weights []float64
+	for _, e := range es {
+		if e.NodeName == nodes[i] {
+			nes = append(nes, e)
+			weights = append(weights, weightOrDefault(e.Weight))
+		}
+	}
+	j, _ := pickWeighted(y, weights)
+	return &nes[j], nil
+}
+
+// rendezvousScore is the highest-random-weight score of member for key.
+// FNV-1a alone mixes poorly on inputs sharing long prefixes (IPs of one
+// subnet), so the sum goes through the murmur3 finalizer.
+func rendezvousScore(key string, member string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(member))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// weightedRendezvousScore turns the raw score into a uniform u in (0, 1)
+// and applies the logarithmic method: the member with the largest -w/ln(u)
+// wins with probability proportional to w. Since -1/ln(u) grows with u,
+// equal weights keep the unweighted ranking.
+func weightedRendezvousScore(key string, member string, w float64) float64 {
+	u := (float64(rendezvousScore(key, member)>>11) + 0.5) / (1 << 53)
+	return -w / math.Log(u)
+}
+
+// distributeByRendezvous picks the endpoint with the highest score for the
+// infohash. Removing an endpoint moves only the keys it owned, adding one
+// takes roughly 1/N of the keys from the others. Endpoint weights are only
+// applied when weighted is set.
+func (s *ServiceLocation) distributeByRendezvous(src *Source, es []Endpoint, weighted bool) *Endpoint {
+	var best *Endpoint
+	var bestScore float64
+	for i := range es {
+		w := 1.0
+		if weighted {
+			w = es[i].weight()
+		}
+		score := weightedRendezvousScore(src.InfoHash, es[i].IP, w)
+		if best == nil || score > bestScore || (score == bestScore && es[i].IP < best.IP) {
+			best = &es[i]
+			bestScore = score
+		}
+	}
+	return best
+}
+
+// distributeByNodeRendezvous is the two-level variant: the node is chosen
+// first among nodes allowed for the role, then the endpoint within it.
+// Pods coming and going on one node never move keys of other nodes.
+func (s *ServiceLocation) distributeByNodeRendezvous(src *Source, es []Endpoint, claims jwt.MapClaims, weighted bool) (*Endpoint, error) {
+	nodesM := map[string]float64{}
+	var nodes []string
+	for _, e := range es {
+		nodesM[e.NodeName] = 1
+		if weighted {
+			nodesM[e.NodeName] = weightOrDefault(e.NodeWeight)
+		}
+	}
+	for n := range nodesM {
+		nodes = append(nodes, n)
+	}
+	sort.Strings(nodes)
+	nodes, err := s.filterNodesByRole(nodes, claims)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to filter nodes by role")
+	}
+	if len(nodes) == 0 {
+		return nil, errors.New("failed to distribute, no nodes found")
+	}
+	node := nodes[0]
+	bestScore := weightedRendezvousScore(src.InfoHash, node, nodesM[node])
+	for _, n := range nodes[1:] {
+		if score := weightedRendezvousScore(src.InfoHash, n, nodesM[n]); score > bestScore {
+			node = n
+			bestScore = score
+		}
+	}
+	var nes []Endpoint
+	for _, e := range es {
+		if e.NodeName == node {
+			nes = append(nes, e)
+		}
+	}
+	return s.distributeByRendezvous(src, nes, weighted), nil
+}
+
 func (s *ServiceLocation) filterNodesByRole(nodes []string, claims jwt.MapClaims) ([]string, error) {
 	if claims == nil {
 		return nodes, nil
@@ -325,21 +530,78 @@ func (s *ServiceLocation) getEnvironment(cfg *ServiceConfig) (*Location, error)
 	}, nil
 }
 
+// getJob deploys (or reuses) the job serving src and returns its pod. The
+// job is shared by every request with the same Source.GetKey(), so chained
+// mods get their own job per origin path while plain torrent requests share
+// one seeder per infohash.
+func (s *ServiceLocation) getJob(cfg *ServiceConfig, src *Source) (*Location, error) {
+	if s.jobs == nil {
+		return nil, errors.New("job endpoints provider is not configured")
+	}
+	p, err := s.jobs.Get(&k8s.JobRequest{
+		Name:         cfg.Name,
+		Key:          src.GetKey(),
+		Template:     cfg.Job.template,
+		Env:          s.jobEnv(src),
+		ReadyTimeout: cfg.Job.ReadyTimeout,
+		TTL:          cfg.Job.TTL,
+	})
+	if errors.Is(err, k8s.ErrJobNotReady) || errors.Is(err, k8s.ErrJobFinished) {
+		log.WithError(err).Warnf("job for %v is not ready", cfg.Name)
+		return &Location{
+			Unavailable: true,
+		}, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get job")
+	}
+	return &Location{
+		IP: net.ParseIP(p.IP),
+		Ports: Ports{
+			HTTP:  p.Ports["http"],
+			Probe: p.Ports["httpprobe"],
+		},
+	}, nil
+}
+
+func (s *ServiceLocation) jobEnv(src *Source) map[string]string {
+	env := map[string]string{
+		"INFO_HASH": src.InfoHash,
+	}
+	if src.Mod != nil {
+		env["SOURCE_URL"] = s.baseURL + "/" + src.InfoHash + src.Path
+		env["FILE_PATH"] = src.Path
+		if src.Mod.Extra != "" {
+			env["EXTRA"] = src.Mod.Extra
+		}
+	}
+	return env
+}
+
 // GetFallback resolves a fallback location for retry.
-// For Kubernetes: adds excludeIP to ignore list and re-runs the same resolution
-// logic as getKubernetes. NodeHash distribution guarantees the same infohash
-// lands on the same node, so no extra node validation is needed.
+// For Kubernetes, Static and DNS: re-runs the same resolution logic as resolve
+// without excludeIP. The failure itself is reported to the HealthChecker by
+// the transport. NodeHash distribution guarantees the same
+// infohash lands on the same node, so no extra node validation is needed.
 // For Environment: returns the same static location (retry to same host).
+// For Job: returns the job's pod again, there is no other pod to go to.
 func (s *ServiceLocation) GetFallback(cfg *ServiceConfig, src *Source, excludeIP net.IP, claims jwt.MapClaims) (*Location, error) {
 	if cfg.EndpointsProvider == Environment {
 		return s.getEnvironment(cfg)
 	}
-
-	// Temporarily ignore the failed IP.
-	s.ignore.Ignore(excludeIP.String())
+	if cfg.EndpointsProvider == Job {
+		loc, err := s.getJob(cfg, src)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to resolve fallback")
+		}
+		if loc.Unavailable {
+			return nil, errors.Errorf("job for %s is not ready", cfg.Name)
+		}
+		return loc, nil
+	}
 
 	// Run the same resolution logic (without cache).
-	loc, err := s.getKubernetes(cfg, src, claims)
+	loc, err := s.resolve(cfg, src, claims, excludeIP)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to resolve fallback")
 	}
@@ -350,13 +612,58 @@ func (s *ServiceLocation) GetFallback(cfg *ServiceConfig, src *Source, excludeIP
 	return loc, nil
 }
 
-func (s *ServiceLocation) filterAddressesByIgnore(as []corev1.EndpointAddress) []corev1.EndpointAddress {
-	var res []corev1.EndpointAddress
-	for _, a := range as {
-		if s.ignore.IsIgnored(net.ParseIP(a.IP).String()) {
+// excludeEndpoint drops endpoints with the given IP.
+func excludeEndpoint(es []Endpoint, ip net.IP) []Endpoint {
+	var res []Endpoint
+	for _, e := range es {
+		if ip.Equal(net.ParseIP(e.IP)) {
 			continue
 		}
-		res = append(res, a)
+		res = append(res, e)
+	}
+	return res
+}
+
+func (s *ServiceLocation) getLocations(name string) *lazymap.LazyMap[*Location] {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	l, ok := s.locations[name]
+	if !ok {
+		l = lazymap.New[*Location](&lazymap.Config{
+			Expire: 15 * time.Second,
+		})
+		s.locations[name] = l
+	}
+	return l
+}
+
+// filterEndpointsByWeight drops drained endpoints: pods or nodes with an
+// explicit weight of 0.
+func filterEndpointsByWeight(es []Endpoint) []Endpoint {
+	var res []Endpoint
+	for _, e := range es {
+		if e.weight() > 0 {
+			res = append(res, e)
+		}
 	}
 	return res
 }
+
+// invalidate drops cached locations of the service, so the next request
+// resolves against the fresh set of endpoints.
+func (s *ServiceLocation) invalidate(name string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.locations, name)
+}
+
+// invalidateAll drops cached locations of all services.
+func (s *ServiceLocation) invalidateAll() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.locations = map[string]*lazymap.LazyMap[*Location]{}
+}
+
+func (s *ServiceLocation) Close() {
+	s.health.Close()
+}
@@ -0,0 +1,639 @@
+package services
+
+import (
+	"context"
+	"crypto/sha1"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+	"github.com/webtor-io/torrent-http-proxy/services/k8s"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// okClient answers every probe with 200 so tests don't need real upstreams.
+var okClient = &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+})}
+
+func newTestContext(register ...func([]cli.Flag) []cli.Flag) *cli.Context {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	var flags []cli.Flag
+	for _, r := range register {
+		flags = r(flags)
+	}
+	for _, f := range flags {
+		f.Apply(set)
+	}
+	return cli.NewContext(nil, set, nil)
+}
+
+func testSeederSlice(ips ...string) *discoveryv1.EndpointSlice {
+	portName := "http"
+	port := int32(8080)
+	ready := true
+	var endpoints []discoveryv1.Endpoint
+	for _, ip := range ips {
+		node := "node-1"
+		endpoints = append(endpoints, discoveryv1.Endpoint{
+			Addresses:  []string{ip},
+			NodeName:   &node,
+			Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+		})
+	}
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "torrent-web-seeder-abcde",
+			Namespace: "webtor",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "torrent-web-seeder"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   endpoints,
+		Ports:       []discoveryv1.EndpointPort{{Name: &portName, Port: &port}},
+	}
+}
+
+func TestServiceLocation_EndpointSlicesRemovalTakesEffect(t *testing.T) {
+	slice := testSeederSlice("10.0.0.1", "10.0.0.2")
+	cs := fake.NewClientset(slice)
+	c := newTestContext(k8s.RegisterEndpointsFlags)
+	es := k8s.NewEndpointSlices(c, k8s.NewClientFromInterface(cs))
+	defer es.Close()
+	sl := NewServiceLocationPool(c, okClient, nil, nil, es, nil)
+
+	cfg := &ServiceConfig{
+		Name:              "torrent-web-seeder",
+		Distribution:      Hash,
+		EndpointsProvider: Kubernetes,
+	}
+	src := &Source{InfoHash: "08ada5a7a6183aae1e09d831df6748d566095a10"}
+	loc, err := sl.Get(cfg, src, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first := loc.IP.String()
+
+	updated := slice.DeepCopy()
+	updated.Endpoints = nil
+	for _, e := range slice.Endpoints {
+		if e.Addresses[0] != first {
+			updated.Endpoints = append(updated.Endpoints, e)
+		}
+	}
+	if _, err := cs.DiscoveryV1().EndpointSlices("webtor").Update(context.Background(), updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update slice: %v", err)
+	}
+
+	// Location cache lives for 15s; the removal must be visible well before.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		loc, err = sl.Get(cfg, src, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if loc.IP.String() != first {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("removed endpoint %s is still served", first)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testInfoHashes returns n deterministic pseudo-random infohashes.
+func testInfoHashes(n int) []string {
+	res := make([]string, n)
+	for i := range res {
+		res[i] = fmt.Sprintf("%x", sha1.Sum([]byte(strconv.Itoa(i))))
+	}
+	return res
+}
+
+func testEndpoints(nodes int, podsPerNode int) []Endpoint {
+	var es []Endpoint
+	for n := 0; n < nodes; n++ {
+		for p := 0; p < podsPerNode; p++ {
+			es = append(es, Endpoint{
+				IP:       fmt.Sprintf("10.0.%d.%d", n, p+1),
+				NodeName: fmt.Sprintf("node-%d", n),
+				Ports:    Ports{HTTP: 8080},
+			})
+		}
+	}
+	return es
+}
+
+// placement maps every infohash to the IP chosen by the distribution.
+func placement(t *testing.T, sl *ServiceLocation, d Distribution, hashes []string, es []Endpoint) map[string]string {
+	t.Helper()
+	cfg := &ServiceConfig{Name: "torrent-web-seeder", Distribution: d}
+	res := make(map[string]string, len(hashes))
+	for _, h := range hashes {
+		cp := append([]Endpoint(nil), es...)
+		loc, err := sl.distribute(cfg, &Source{InfoHash: h}, nil, cp)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if loc.Unavailable {
+			t.Fatalf("no endpoint for %s", h)
+		}
+		res[h] = loc.IP.String()
+	}
+	return res
+}
+
+func moved(a map[string]string, b map[string]string) float64 {
+	n := 0
+	for k, v := range a {
+		if b[k] != v {
+			n++
+		}
+	}
+	return float64(n) / float64(len(a))
+}
+
+func TestDistributeByRendezvous_KeyMovement(t *testing.T) {
+	sl := NewServiceLocationPool(newTestContext(), okClient, nil, nil, nil, nil)
+	hashes := testInfoHashes(20000)
+	es := testEndpoints(1, 10)
+	before := placement(t, sl, Rendezvous, hashes, es)
+
+	// Balanced: every endpoint gets about 1/N of the keys.
+	counts := map[string]int{}
+	for _, ip := range before {
+		counts[ip]++
+	}
+	for ip, c := range counts {
+		share := float64(c) / float64(len(hashes))
+		if share < 0.07 || share > 0.13 {
+			t.Errorf("endpoint %s got %.3f of keys, expected about 0.1", ip, share)
+		}
+	}
+
+	// Removing one endpoint moves only the keys it owned.
+	removed := es[3].IP
+	afterRemove := placement(t, sl, Rendezvous, hashes, append(append([]Endpoint(nil), es[:3]...), es[4:]...))
+	for h, ip := range before {
+		if ip != removed && afterRemove[h] != ip {
+			t.Fatalf("key %s moved from surviving endpoint %s to %s", h, ip, afterRemove[h])
+		}
+	}
+	if m := moved(before, afterRemove); m > 0.13 {
+		t.Errorf("removing 1 of 10 endpoints moved %.3f of keys", m)
+	}
+
+	// Adding one endpoint takes about 1/(N+1) of the keys, all to itself.
+	added := Endpoint{IP: "10.0.0.100", NodeName: "node-0", Ports: Ports{HTTP: 8080}}
+	afterAdd := placement(t, sl, Rendezvous, hashes, append(append([]Endpoint(nil), es...), added))
+	for h, ip := range before {
+		if afterAdd[h] != ip && afterAdd[h] != added.IP {
+			t.Fatalf("key %s moved between existing endpoints %s -> %s", h, ip, afterAdd[h])
+		}
+	}
+	m := moved(before, afterAdd)
+	if m < 0.05 || m > 0.13 {
+		t.Errorf("adding 1 endpoint to 10 moved %.3f of keys, expected about 0.09", m)
+	}
+
+	hashMoved := moved(placement(t, sl, Hash, hashes, es), placement(t, sl, Hash, hashes, append(append([]Endpoint(nil), es...), added)))
+	t.Logf("adding 1 endpoint to 10: Rendezvous moved %.3f, Hash moved %.3f", m, hashMoved)
+}
+
+func TestDistributeByNodeRendezvous_KeyMovement(t *testing.T) {
+	sl := NewServiceLocationPool(newTestContext(), okClient, nil, nil, nil, nil)
+	hashes := testInfoHashes(20000)
+	es := testEndpoints(4, 3)
+	before := placement(t, sl, NodeRendezvous, hashes, es)
+
+	// A new pod on node-1 only takes keys that node-1 already served.
+	added := Endpoint{IP: "10.0.1.100", NodeName: "node-1", Ports: Ports{HTTP: 8080}}
+	afterAdd := placement(t, sl, NodeRendezvous, hashes, append(append([]Endpoint(nil), es...), added))
+	for h, ip := range before {
+		if afterAdd[h] == ip {
+			continue
+		}
+		if afterAdd[h] != added.IP || !strings.HasPrefix(ip, "10.0.1.") {
+			t.Fatalf("key %s moved %s -> %s outside of node-1", h, ip, afterAdd[h])
+		}
+	}
+	// node-1 holds ~1/4 of the keys, the new pod takes ~1/4 of those.
+	if m := moved(before, afterAdd); m > 0.09 {
+		t.Errorf("adding 1 pod to a node moved %.3f of keys", m)
+	}
+
+	// Losing a whole node moves only that node's keys.
+	var withoutNode []Endpoint
+	for _, e := range es {
+		if e.NodeName != "node-2" {
+			withoutNode = append(withoutNode, e)
+		}
+	}
+	afterRemove := placement(t, sl, NodeRendezvous, hashes, withoutNode)
+	for h, ip := range before {
+		if !strings.HasPrefix(ip, "10.0.2.") && afterRemove[h] != ip {
+			t.Fatalf("key %s moved from surviving node endpoint %s to %s", h, ip, afterRemove[h])
+		}
+	}
+	if m := moved(before, afterRemove); m > 0.32 {
+		t.Errorf("removing 1 of 4 nodes moved %.3f of keys", m)
+	}
+}
+
+// shares returns the fraction of hashes each endpoint IP got under cfg.
+func shares(t *testing.T, sl *ServiceLocation, cfg *ServiceConfig, hashes []string, es []Endpoint) map[string]float64 {
+	t.Helper()
+	res := map[string]float64{}
+	for _, h := range hashes {
+		cp := append([]Endpoint(nil), es...)
+		loc, err := sl.distribute(cfg, &Source{InfoHash: h}, nil, cp)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		res[loc.IP.String()] += 1 / float64(len(hashes))
+	}
+	return res
+}
+
+func TestDistribute_Weighted(t *testing.T) {
+	sl := NewServiceLocationPool(newTestContext(), okClient, nil, nil, nil, nil)
+	hashes := testInfoHashes(20000)
+
+	// Pod weights 1:3 on a single node.
+	pods := testEndpoints(1, 2)
+	pods[1].Weight = weightPtr(3)
+	// Two nodes with two pods each, node-1 is twice as big.
+	nodes := testEndpoints(2, 2)
+	for i := range nodes {
+		if nodes[i].NodeName == "node-1" {
+			nodes[i].NodeWeight = weightPtr(2)
+		}
+	}
+
+	for _, d := range []Distribution{Hash, Rendezvous} {
+		cfg := &ServiceConfig{Name: "torrent-web-seeder", Distribution: d, Weighted: true}
+		got := shares(t, sl, cfg, hashes, pods)
+		if s := got["10.0.0.2"]; s < 0.72 || s > 0.78 {
+			t.Errorf("%v: pod with weight 3 of 4 got %.3f of keys", d, s)
+		}
+		got = shares(t, sl, cfg, hashes, nodes)
+		if s := got["10.0.1.1"] + got["10.0.1.2"]; s < 0.63 || s > 0.70 {
+			t.Errorf("%v: node with weight 2 of 3 got %.3f of keys", d, s)
+		}
+	}
+	for _, d := range []Distribution{NodeHash, NodeRendezvous} {
+		cfg := &ServiceConfig{Name: "torrent-web-seeder", Distribution: d, Weighted: true}
+		got := shares(t, sl, cfg, hashes, nodes)
+		if s := got["10.0.1.1"] + got["10.0.1.2"]; s < 0.63 || s > 0.70 {
+			t.Errorf("%v: node with weight 2 of 3 got %.3f of keys", d, s)
+		}
+		got = shares(t, sl, cfg, hashes, pods)
+		if s := got["10.0.0.2"]; s < 0.72 || s > 0.78 {
+			t.Errorf("%v: pod with weight 3 of 4 got %.3f of keys", d, s)
+		}
+	}
+
+	// Without the flag weights are ignored.
+	for _, d := range []Distribution{Hash, NodeHash, Rendezvous, NodeRendezvous} {
+		cfg := &ServiceConfig{Name: "torrent-web-seeder", Distribution: d}
+		got := shares(t, sl, cfg, hashes, pods)
+		if s := got["10.0.0.2"]; s < 0.45 || s > 0.55 {
+			t.Errorf("%v: unweighted pod got %.3f of keys", d, s)
+		}
+		got = shares(t, sl, cfg, hashes, nodes)
+		if s := got["10.0.1.1"] + got["10.0.1.2"]; s < 0.45 || s > 0.55 {
+			t.Errorf("%v: unweighted node got %.3f of keys", d, s)
+		}
+	}
+}
+
+func weightPtr(w float64) *float64 {
+	return &w
+}
+
+func TestDistribute_ZeroWeightDrains(t *testing.T) {
+	sl := NewServiceLocationPool(newTestContext(), okClient, nil, nil, nil, nil)
+	hashes := testInfoHashes(1000)
+	es := testEndpoints(2, 2)
+	es[0].Weight = weightPtr(0)
+	for i := range es {
+		if es[i].NodeName == "node-1" {
+			es[i].NodeWeight = weightPtr(0)
+		}
+	}
+	for _, d := range []Distribution{Hash, NodeHash, Rendezvous, NodeRendezvous} {
+		cfg := &ServiceConfig{Name: "torrent-web-seeder", Distribution: d, Weighted: true}
+		got := shares(t, sl, cfg, hashes, es)
+		if len(got) != 1 || got["10.0.0.2"] < 0.999 {
+			t.Errorf("%v: drained endpoints still get keys: %v", d, got)
+		}
+	}
+
+	for i := range es {
+		es[i].Weight = weightPtr(0)
+	}
+	loc, err := sl.distribute(&ServiceConfig{Name: "torrent-web-seeder", Distribution: Hash, Weighted: true}, &Source{InfoHash: hashes[0]}, nil, es)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !loc.Unavailable {
+		t.Fatalf("expected unavailable location when everything is drained, got %+v", loc)
+	}
+}
+
+func TestServiceLocation_WeightsFromKubernetes(t *testing.T) {
+	podRef := func(name string) *corev1.ObjectReference {
+		return &corev1.ObjectReference{Kind: "Pod", Name: name, Namespace: "webtor"}
+	}
+	slice := testSeederSlice("10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4")
+	for i, node := range []string{"node-1", "node-1", "node-2", "node-3"} {
+		slice.Endpoints[i].NodeName = &node
+		slice.Endpoints[i].TargetRef = podRef(fmt.Sprintf("seeder-%d", i+1))
+	}
+	readyNode := func(name string, labels map[string]string) *corev1.Node {
+		return &corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+			Status: corev1.NodeStatus{
+				Conditions: []corev1.NodeCondition{{Type: corev1.NodeReady, Status: corev1.ConditionTrue}},
+			},
+		}
+	}
+	pod := func(name string, annotations map[string]string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "webtor", Annotations: annotations}}
+	}
+	cs := fake.NewClientset(slice,
+		readyNode("node-1", map[string]string{"webtor.io/weight": "2"}),
+		readyNode("node-2", nil),
+		readyNode("node-3", map[string]string{"webtor.io/weight": "0"}),
+		pod("seeder-1", map[string]string{"webtor.io/weight": "3"}),
+		pod("seeder-2", nil),
+		pod("seeder-3", nil),
+		pod("seeder-4", nil),
+	)
+	c := newTestContext(k8s.RegisterEndpointsFlags, k8s.RegisterNodesStatFlags)
+	kcl := k8s.NewClientFromInterface(cs)
+	es := k8s.NewEndpointSlices(c, kcl)
+	defer es.Close()
+	sl := NewServiceLocationPool(c, okClient, k8s.NewNodesStat(c, kcl), k8s.NewPodsStat(c, kcl), es, nil)
+
+	hashes := testInfoHashes(4000)
+	// Node modes split keys between nodes 2:1 and then 3:1 between pods of
+	// node-1. Flat modes weigh every pod by pod*node weight: 6, 2 and 1. The
+	// drained node-3 gets nothing either way.
+	expected := map[Distribution][2]float64{
+		NodeHash:       {0.5, 1.0 / 3},
+		NodeRendezvous: {0.5, 1.0 / 3},
+		Hash:           {6.0 / 9, 1.0 / 9},
+		Rendezvous:     {6.0 / 9, 1.0 / 9},
+	}
+	for _, d := range []Distribution{Hash, NodeHash, Rendezvous, NodeRendezvous} {
+		cfg := &ServiceConfig{
+			Name:              "torrent-web-seeder",
+			Distribution:      d,
+			EndpointsProvider: Kubernetes,
+			Weighted:          true,
+		}
+		got := map[string]float64{}
+		for _, h := range hashes {
+			loc, err := sl.Get(cfg, &Source{InfoHash: h}, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got[loc.IP.String()] += 1 / float64(len(hashes))
+		}
+		sl.invalidate(cfg.Name)
+		if s, e := got["10.0.0.1"], expected[d][0]; math.Abs(s-e) > 0.04 {
+			t.Errorf("%v: pod with weight 3 on node with weight 2 got %.3f of keys, expected %.3f", d, s, e)
+		}
+		if s, e := got["10.0.0.3"], expected[d][1]; math.Abs(s-e) > 0.04 {
+			t.Errorf("%v: pod on default node got %.3f of keys, expected %.3f", d, s, e)
+		}
+		if s := got["10.0.0.4"]; s != 0 {
+			t.Errorf("%v: pod on drained node got %.3f of keys", d, s)
+		}
+	}
+}
+
+// serveJobs emulates the job controller: every job created in the fake
+// clientset gets a ready pod with the next IP of 10.0.1.0/24.
+func serveJobs(t *testing.T, cs *fake.Clientset, stop <-chan struct{}) {
+	t.Helper()
+	ctx := context.Background()
+	served := map[string]bool{}
+	for n := 1; ; {
+		select {
+		case <-stop:
+			return
+		case <-time.After(5 * time.Millisecond):
+		}
+		list, err := cs.BatchV1().Jobs("webtor").List(ctx, metav1.ListOptions{})
+		if err != nil {
+			t.Errorf("failed to list jobs: %v", err)
+			return
+		}
+		for _, job := range list.Items {
+			if served[job.Name] {
+				continue
+			}
+			served[job.Name] = true
+			_, err := cs.CoreV1().Pods("webtor").Create(ctx, &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   job.Name + "-abcde",
+					Labels: map[string]string{"job-name": job.Name},
+				},
+				Spec: *job.Spec.Template.Spec.DeepCopy(),
+				Status: corev1.PodStatus{
+					PodIP: fmt.Sprintf("10.0.1.%d", n),
+					Conditions: []corev1.PodCondition{
+						{Type: corev1.PodReady, Status: corev1.ConditionTrue},
+					},
+				},
+			}, metav1.CreateOptions{})
+			if err != nil {
+				t.Errorf("failed to create pod: %v", err)
+			}
+			n++
+		}
+	}
+}
+
+func testJobConfig() *ServiceConfig {
+	return &ServiceConfig{
+		Name:              "torrent-web-seeder",
+		EndpointsProvider: Job,
+		Job: &JobConfig{
+			ReadyTimeout: 5 * time.Second,
+			template: &batchv1.Job{
+				Spec: batchv1.JobSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{
+							Containers: []corev1.Container{{
+								Name:  "seeder",
+								Image: "webtor/torrent-web-seeder",
+								Ports: []corev1.ContainerPort{
+									{Name: "http", ContainerPort: 8080},
+									{Name: "httpprobe", ContainerPort: 8081},
+								},
+							}},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func jobEnvOf(t *testing.T, cs *fake.Clientset, cfg *ServiceConfig, src *Source) map[string]string {
+	t.Helper()
+	name := k8s.JobName(cfg.Name, src.GetKey())
+	job, err := cs.BatchV1().Jobs("webtor").Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("job %s not found: %v", name, err)
+	}
+	env := map[string]string{}
+	for _, e := range job.Spec.Template.Spec.Containers[0].Env {
+		env[e.Name] = e.Value
+	}
+	return env
+}
+
+func TestServiceLocation_Job(t *testing.T) {
+	cs := fake.NewClientset()
+	stop := make(chan struct{})
+	defer close(stop)
+	go serveJobs(t, cs, stop)
+	c := newTestContext(RegisterWebFlags, k8s.RegisterJobsFlags)
+	if err := c.Set(torrentHTTPProxyHostFlag, "torrent-http-proxy"); err != nil {
+		t.Fatal(err)
+	}
+	jobs := k8s.NewJobs(c, k8s.NewClientFromInterface(cs))
+	sl := NewServiceLocationPool(c, okClient, nil, nil, nil, jobs)
+	cfg := testJobConfig()
+
+	src := &Source{InfoHash: "08ada5a7a6183aae1e09d831df6748d566095a10", Type: "default"}
+	loc, err := sl.Get(cfg, src, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if loc.Unavailable || loc.HTTP != 8080 || loc.Probe != 8081 {
+		t.Fatalf("unexpected location: %+v", loc)
+	}
+	env := jobEnvOf(t, cs, cfg, src)
+	if len(env) != 1 || env["INFO_HASH"] != src.InfoHash {
+		t.Fatalf("unexpected env for plain request: %+v", env)
+	}
+
+	// Chained mods get their own job pointed back at the proxy.
+	mod := &Source{
+		InfoHash: src.InfoHash,
+		Type:     "default",
+		Path:     "/Sintel/Sintel.mkv",
+		Mod:      &Mod{Type: "hls", Extra: "720p"},
+	}
+	modLoc, err := sl.Get(cfg, mod, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if modLoc.IP.Equal(loc.IP) {
+		t.Fatalf("mod request should get its own job, got %v", modLoc.IP)
+	}
+	env = jobEnvOf(t, cs, cfg, mod)
+	if env["SOURCE_URL"] != "http://torrent-http-proxy:8080/08ada5a7a6183aae1e09d831df6748d566095a10/Sintel/Sintel.mkv" {
+		t.Errorf("unexpected SOURCE_URL: %v", env["SOURCE_URL"])
+	}
+	if env["FILE_PATH"] != mod.Path || env["EXTRA"] != "720p" {
+		t.Errorf("unexpected env for mod request: %+v", env)
+	}
+
+	// There is no other pod to fall back to, the job's pod is returned again.
+	fb, err := sl.GetFallback(cfg, src, loc.IP, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !fb.IP.Equal(loc.IP) {
+		t.Fatalf("fallback should return the job's pod %v, got %v", loc.IP, fb.IP)
+	}
+}
+
+func TestServiceLocation_JobNotReadyIsNotCached(t *testing.T) {
+	cs := fake.NewClientset()
+	c := newTestContext(RegisterWebFlags, k8s.RegisterJobsFlags)
+	jobs := k8s.NewJobs(c, k8s.NewClientFromInterface(cs))
+	sl := NewServiceLocationPool(c, okClient, nil, nil, nil, jobs)
+	cfg := testJobConfig()
+	cfg.Job.ReadyTimeout = 50 * time.Millisecond
+	src := &Source{InfoHash: "08ada5a7a6183aae1e09d831df6748d566095a10", Type: "default"}
+
+	loc, err := sl.Get(cfg, src, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !loc.Unavailable {
+		t.Fatalf("expected unavailable location, got %+v", loc)
+	}
+	if _, err := sl.GetFallback(cfg, src, nil, nil); err == nil {
+		t.Fatal("fallback to a job that is not ready should fail")
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go serveJobs(t, cs, stop)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		loc, err = sl.Get(cfg, src, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !loc.Unavailable {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("job stays unavailable after its pod became ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServiceLocation_InvalidateExactService(t *testing.T) {
+	sl := NewServiceLocationPool(newTestContext(), okClient, nil, nil, nil, nil)
+	t.Setenv("TORRENT_WEB_SEEDER_SERVICE_HOST", "10.0.0.1")
+	t.Setenv("TORRENT_WEB_SEEDER_SERVICE_PORT", "8080")
+	t.Setenv("TORRENT_WEB_SEEDER_FOO_SERVICE_HOST", "10.0.0.2")
+	t.Setenv("TORRENT_WEB_SEEDER_FOO_SERVICE_PORT", "8080")
+	src := &Source{InfoHash: "08ada5a7a6183aae1e09d831df6748d566095a10"}
+	for _, name := range []string{"torrent-web-seeder", "torrent-web-seeder-foo"} {
+		if _, err := sl.Get(&ServiceConfig{Name: name, EndpointsProvider: Environment}, src, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	sl.invalidate("torrent-web-seeder")
+
+	if _, ok := sl.getLocations("torrent-web-seeder").Status(src.InfoHash); ok {
+		t.Error("location of the updated service should be dropped")
+	}
+	if _, ok := sl.getLocations("torrent-web-seeder-foo").Status(src.InfoHash); !ok {
+		t.Error("location of a service sharing the name prefix should be kept")
+	}
+}
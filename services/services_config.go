@@ -3,8 +3,11 @@ package services
 import (
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
+	"github.com/webtor-io/torrent-http-proxy/services/k8s"
 	"gopkg.in/yaml.v3"
+	batchv1 "k8s.io/api/batch/v1"
 	"os"
+	"time"
 )
 
 const (
@@ -16,6 +19,12 @@ type Distribution string
 const (
 	Hash     Distribution = "Hash"
 	NodeHash Distribution = "NodeHash"
+	// Rendezvous and NodeRendezvous are the highest-random-weight
+	// counterparts of Hash and NodeHash: adding or removing one endpoint
+	// (or node) moves only the keys it owned instead of remapping almost
+	// everything.
+	Rendezvous     Distribution = "Rendezvous"
+	NodeRendezvous Distribution = "NodeRendezvous"
 )
 
 type EndpointsProvider string
@@ -23,14 +32,26 @@ type EndpointsProvider string
 const (
 	Kubernetes  EndpointsProvider = "Kubernetes"
 	Environment EndpointsProvider = "Environment"
+	Job         EndpointsProvider = "Job"
+	// Static serves a fixed list of endpoints from the services config or
+	// a watched file, for deployments without Kubernetes.
+	Static EndpointsProvider = "Static"
+	// DNS resolves SRV or A records, e.g. of headless services or Consul.
+	DNS EndpointsProvider = "DNS"
+)
+
+const (
+	defaultJobReadyTimeout = 60 * time.Second
+	defaultJobTTL          = 10 * time.Minute
 )
 
 func RegisterServicesConfigFlags(flags []cli.Flag) []cli.Flag {
+	// Not marked required so that subcommands run without it, serving fails
+	// in LoadServicesConfigFromYAML.
 	return append(flags, &cli.StringFlag{
-		Name:     configFlag,
-		Usage:    "Path to the services configuration YAML file",
-		EnvVar:   "CONFIG_PATH",
-		Required: true,
+		Name:   configFlag,
+		Usage:  "Path to the services configuration YAML file",
+		EnvVar: "CONFIG_PATH",
 	})
 }
 
@@ -39,7 +60,21 @@ type ServiceConfig struct {
 	Distribution      Distribution      `yaml:"distribution"`
 	EndpointsProvider EndpointsProvider `yaml:"endpointsProvider"`
 	PreferLocalNode   bool              `yaml:"preferLocalNode"`
+	Weighted          bool              `yaml:"weighted"`
 	Headers           map[string]string `yaml:"headers"`
+	Job               *JobConfig        `yaml:"job"`
+	Static            *StaticConfig     `yaml:"static"`
+	DNS               *DNSConfig        `yaml:"dns"`
+}
+
+// JobConfig configures the Job endpoints provider. Template is a path to a
+// batch/v1 Job manifest used as the base for every on-demand job; the job is
+// deleted after TTL without requests.
+type JobConfig struct {
+	Template     string        `yaml:"template"`
+	ReadyTimeout time.Duration `yaml:"readyTimeout"`
+	TTL          time.Duration `yaml:"ttl"`
+	template     *batchv1.Job
 }
 
 type ServicesConfig map[string]*ServiceConfig
@@ -80,13 +115,82 @@ func LoadServicesConfigFromYAML(c *cli.Context) (*ServicesConfig, error) {
 	if err := yaml.Unmarshal(data, s); err != nil {
 		return nil, err
 	}
-	for _, cfg := range *s {
+	for name, cfg := range *s {
 		if cfg.Distribution == "" {
 			cfg.Distribution = Hash
 		}
 		if cfg.EndpointsProvider == "" {
 			cfg.EndpointsProvider = Kubernetes
 		}
+		if cfg.EndpointsProvider == Job {
+			if err := loadJobConfig(cfg); err != nil {
+				s.Close()
+				return nil, errors.Wrapf(err, "failed to load job config for %s", name)
+			}
+		}
+		if cfg.EndpointsProvider == Static {
+			if err := loadStaticConfig(cfg); err != nil {
+				s.Close()
+				return nil, errors.Wrapf(err, "failed to load static config for %s", name)
+			}
+		}
+		if cfg.EndpointsProvider == DNS {
+			if err := loadDNSConfig(cfg); err != nil {
+				s.Close()
+				return nil, errors.Wrapf(err, "failed to load dns config for %s", name)
+			}
+		}
 	}
 	return s, nil
 }
+
+// Close stops watching static endpoints files.
+func (s ServicesConfig) Close() {
+	for _, cfg := range s {
+		if cfg.Static != nil && cfg.Static.endpoints != nil {
+			cfg.Static.endpoints.Close()
+		}
+	}
+}
+
+func loadStaticConfig(cfg *ServiceConfig) error {
+	if cfg.Static == nil || (len(cfg.Static.Endpoints) == 0 && cfg.Static.File == "") {
+		return errors.New("endpoints or file are required for Static endpoints provider")
+	}
+	es, err := NewStaticEndpoints(cfg.Name, cfg.Static)
+	if err != nil {
+		return err
+	}
+	cfg.Static.endpoints = es
+	return nil
+}
+
+func loadDNSConfig(cfg *ServiceConfig) error {
+	if cfg.DNS == nil {
+		cfg.DNS = &DNSConfig{}
+	}
+	es, err := NewDNSEndpoints(cfg.Name, cfg.DNS)
+	if err != nil {
+		return err
+	}
+	cfg.DNS.endpoints = es
+	return nil
+}
+
+func loadJobConfig(cfg *ServiceConfig) error {
+	if cfg.Job == nil || cfg.Job.Template == "" {
+		return errors.New("job template is required for Job endpoints provider")
+	}
+	if cfg.Job.ReadyTimeout == 0 {
+		cfg.Job.ReadyTimeout = defaultJobReadyTimeout
+	}
+	if cfg.Job.TTL == 0 {
+		cfg.Job.TTL = defaultJobTTL
+	}
+	t, err := k8s.LoadJobTemplate(cfg.Job.Template)
+	if err != nil {
+		return err
+	}
+	cfg.Job.template = t
+	return nil
+}
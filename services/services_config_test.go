@@ -0,0 +1,84 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testJobTemplateYAML = `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: torrent-web-seeder
+spec:
+  template:
+    spec:
+      containers:
+        - name: seeder
+          image: webtor/torrent-web-seeder
+          ports:
+            - name: http
+              containerPort: 8080
+`
+
+func loadTestServicesConfig(t *testing.T, config string) (*ServicesConfig, error) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "job.yaml"), []byte(testJobTemplateYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "services.yaml")
+	config = strings.ReplaceAll(config, "$DIR", dir)
+	if err := os.WriteFile(filename, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestContext(RegisterServicesConfigFlags)
+	if err := c.Set(configFlag, filename); err != nil {
+		t.Fatal(err)
+	}
+	return LoadServicesConfigFromYAML(c)
+}
+
+func TestLoadServicesConfigFromYAML_Job(t *testing.T) {
+	s, err := loadTestServicesConfig(t, `
+default:
+  name: torrent-web-seeder
+  endpointsProvider: Job
+  job:
+    template: $DIR/job.yaml
+    ttl: 5m
+`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cfg := s.GetDefault()
+	if cfg.Distribution != Hash {
+		t.Errorf("expected default distribution, got %v", cfg.Distribution)
+	}
+	if cfg.Job.ReadyTimeout != defaultJobReadyTimeout || cfg.Job.TTL != 5*time.Minute {
+		t.Errorf("unexpected job timeouts: %+v", cfg.Job)
+	}
+	if cfg.Job.template == nil || cfg.Job.template.Spec.Template.Spec.Containers[0].Image != "webtor/torrent-web-seeder" {
+		t.Fatalf("job template not loaded: %+v", cfg.Job.template)
+	}
+}
+
+func TestLoadServicesConfigFromYAML_JobRequiresTemplate(t *testing.T) {
+	for _, config := range []string{`
+default:
+  name: torrent-web-seeder
+  endpointsProvider: Job
+`, `
+default:
+  name: torrent-web-seeder
+  endpointsProvider: Job
+  job:
+    template: $DIR/missing.yaml
+`} {
+		if _, err := loadTestServicesConfig(t, config); err == nil {
+			t.Errorf("expected error for config %s", config)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const (
+	sessionCookieFlag        = "session-cookie"
+	sessionCookieTTLFlag     = "session-cookie-ttl"
+	sessionCookieOriginsFlag = "session-cookie-origins"
+	sessionCookieName        = "thp-session"
+)
+
+// getSessionCookie returns the token and api key stored in the session
+// cookie of the request, along with the primary token it was minted from.
+func getSessionCookie(r *http.Request) (token string, apiKey string, primary string, ok bool) {
+	c, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return "", "", "", false
+	}
+	v, err := url.ParseQuery(c.Value)
+	if err != nil || v.Get("token") == "" {
+		return "", "", "", false
+	}
+	return v.Get("token"), v.Get("api-key"), v.Get("primary"), true
+}
+
+// setSessionCookie lets players request segments of the infohash without a
+// token in the url. The cookie holds a token minted from claims the way the
+// exchange endpoint does, bound to the infohash and the client subnet, so it
+// is authorized by Claims.Get like any other token. The primary token is kept
+// too, manifests of the session are rewritten against it the way they are for
+// requests carrying it, see RulesContext.PrimaryToken.
+func (s *Web) setSessionCookie(w http.ResponseWriter, r *http.Request, claims jwt.MapClaims, apiKey string, primary string, src *Source) error {
+	token, exp, err := s.claims.mint(claims, apiKey, jwt.MapClaims{
+		"hash": src.InfoHash,
+	}, s.getIP(r), s.sessionCookieTTL)
+	if err != nil {
+		return err
+	}
+	secure := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+	c := &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    url.Values{"token": {token}, "api-key": {apiKey}, "primary": {primary}}.Encode(),
+		Path:     "/" + src.InfoHash + "/",
+		Expires:  exp,
+		MaxAge:   int(time.Until(exp).Seconds()),
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	// Players are embedded into pages of other sites, their requests are
+	// cross-site ones.
+	if secure {
+		c.SameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(w, c)
+	return nil
+}
+
+// parseOrigins builds the set of origins allowed to send the session cookie
+// from a comma-separated string, e.g. "https://player.example.com".
+func parseOrigins(raw string) map[string]struct{} {
+	out := make(map[string]struct{})
+	for _, o := range strings.Split(raw, ",") {
+		o = strings.TrimSuffix(strings.TrimSpace(strings.ToLower(o)), "/")
+		if o == "" {
+			continue
+		}
+		out[o] = struct{}{}
+	}
+	return out
+}
+
+// allowCredentials makes browsers send the session cookie with XHR requests
+// of players, which a wildcard origin doesn't allow. Only the configured
+// origins are reflected, any other site could read the content with the
+// cookie of the viewer otherwise.
+func (s *Web) allowCredentials(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if _, ok := s.sessionCookieOrigins[strings.ToLower(origin)]; !ok || origin == "" {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+}
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestWeb_SessionCookie(t *testing.T) {
+	hash := "08ada5a7a6183aae1e09d831df6748d566095a10"
+	c := &Claims{apiKey: "key", apiSecret: "secret"}
+	s := &Web{
+		claims:           c,
+		enforceSessionIP: true,
+		sessionCookie:    true,
+		sessionCookieTTL: time.Hour,
+	}
+	primaryExp := time.Now().Add(10 * time.Minute).Unix()
+	primary := jwt.MapClaims{"exp": float64(primaryExp), "role": "free", "sessionID": "s1"}
+	src := &Source{InfoHash: hash, Path: "/e01.mkv", OriginPath: "/e01.mkv", Mod: &Mod{Type: "hls"}}
+
+	req := httptest.NewRequest("GET", "/index.m3u8", nil)
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	w := httptest.NewRecorder()
+	if err := s.setSessionCookie(w, req, primary, "key", "primary-token", src); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected session cookie, got %v", cookies)
+	}
+	ck := cookies[0]
+	if ck.Name != sessionCookieName || ck.Path != "/"+hash+"/" || !ck.HttpOnly || !ck.Secure || ck.SameSite != http.SameSiteNoneMode {
+		t.Fatalf("unexpected cookie %+v", ck)
+	}
+	// The cookie doesn't outlive the token.
+	if ck.Expires.Unix() != primaryExp {
+		t.Fatalf("expected cookie to expire with token at %v, got %v", primaryExp, ck.Expires.Unix())
+	}
+
+	seg := httptest.NewRequest("GET", "/720/seg-1.ts", nil)
+	seg.AddCookie(ck)
+	token, apiKey, primaryToken, ok := getSessionCookie(seg)
+	if !ok || apiKey != "key" || primaryToken != "primary-token" {
+		t.Fatalf("expected tokens of cookie, got %v %v %v", apiKey, primaryToken, ok)
+	}
+	claims, err := c.Get(token, apiKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["role"] != "free" || claims["sessionID"] != "s1" || claims["hash"] != hash {
+		t.Fatalf("unexpected claims %v", claims)
+	}
+	if _, err := checkTokenScope(claims, &Source{InfoHash: hash, Path: "/e02.mkv", OriginPath: "/e02.mkv"}, seg); err != nil {
+		t.Fatalf("expected other file of the infohash to be allowed, got %v", err)
+	}
+	if reason, _ := checkTokenScope(claims, &Source{InfoHash: "0000000000000000000000000000000000000000"}, seg); reason != rejectHash {
+		t.Fatalf("expected hash mismatch, got %q", reason)
+	}
+	seg.Header.Set("X-Forwarded-For", "5.6.7.8")
+	if _, _, ok := s.checkSessionIP(claims, seg); ok {
+		t.Fatal("expected cookie from other subnet to be rejected")
+	}
+
+	bad := httptest.NewRequest("GET", "/720/seg-1.ts", nil)
+	bad.AddCookie(&http.Cookie{Name: sessionCookieName, Value: "%zz"})
+	if _, _, _, ok := getSessionCookie(bad); ok {
+		t.Fatal("expected malformed cookie to be ignored")
+	}
+}
+
+func TestAllowCredentials(t *testing.T) {
+	s := &Web{sessionCookieOrigins: parseOrigins("https://player.example.com/, https://Other.example.com")}
+	req := httptest.NewRequest("GET", "/index.m3u8", nil)
+	w := httptest.NewRecorder()
+	s.allowCredentials(w, req)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("expected no origin without origin, got %v", w.Header())
+	}
+	for _, origin := range []string{"https://player.example.com", "https://other.example.com"} {
+		req.Header.Set("Origin", origin)
+		w = httptest.NewRecorder()
+		s.allowCredentials(w, req)
+		if w.Header().Get("Access-Control-Allow-Origin") != origin ||
+			w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+			t.Fatalf("%s: unexpected headers %v", origin, w.Header())
+		}
+	}
+	req.Header.Set("Origin", "https://evil.example.com")
+	w = httptest.NewRecorder()
+	s.allowCredentials(w, req)
+	if w.Header().Get("Access-Control-Allow-Origin") != "" || w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Fatalf("expected unlisted origin to be refused, got %v", w.Header())
+	}
+}
@@ -2,21 +2,26 @@ package services
 
 import (
 	"net"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
 
 const (
-	MaxConcPerPathFlag     = "max-conc-per-path"
-	MaxBigFilesPerHashFlag = "max-big-files-per-hash"
-	BigFileThresholdFlag   = "big-file-threshold-bytes"
-	LightExtsFlag          = "light-exts"
-	MaxConcTotalFlag       = "max-conc-total"
-	MaxIPsPerSessionFlag   = "max-ips-per-session"
+	MaxConcPerPathFlag         = "max-conc-per-path"
+	MaxBigFilesPerHashFlag     = "max-big-files-per-hash"
+	BigFileThresholdFlag       = "big-file-threshold-bytes"
+	LightExtsFlag              = "light-exts"
+	MaxConcTotalFlag           = "max-conc-total"
+	MaxIPsPerSessionFlag       = "max-ips-per-session"
+	SessionLimiterRedisFlag    = "session-limiter-redis"
+	SessionLimiterLeaseTTLFlag = "session-limiter-lease-ttl"
 )
 
 // defaultLightExts is the built-in fast-path whitelist used when --light-exts
@@ -69,6 +74,17 @@ func RegisterSessionLimiterFlags(f []cli.Flag) []cli.Flag {
 			Value:  5,
 			EnvVar: "MAX_IPS_PER_SESSION",
 		},
+		cli.BoolFlag{
+			Name:   SessionLimiterRedisFlag,
+			Usage:  "share session limits and api key quotas across replicas in redis, falls back to local limits while redis is down",
+			EnvVar: "SESSION_LIMITER_REDIS",
+		},
+		cli.IntFlag{
+			Name:   SessionLimiterLeaseTTLFlag,
+			Usage:  "time in seconds after which redis slots of a replica that stopped heartbeating expire",
+			Value:  30,
+			EnvVar: "SESSION_LIMITER_LEASE_TTL",
+		},
 	)
 }
 
@@ -112,6 +128,8 @@ type SizeLookup func(infoHash, path string) (sizeBytes int64, known bool)
 // a single file or players loading several language tracks.
 // A rolling-window distinct-IP cap per (session, torrent, path) catches
 // shared-token abuse where the same token/file is fetched from many IPs.
+// With Redis the counters are shared by all replicas as leases, the
+// in-process state is used while Redis is down.
 type SessionLimiter struct {
 	maxPerPath         int
 	maxBigFilesPerHash int
@@ -121,9 +139,16 @@ type SessionLimiter struct {
 	maxIPsPerSession   int
 
 	sizeLookup SizeLookup
+	redis      *redisLeases
 
 	mu       sync.Mutex
 	sessions map[string]*sessionState
+
+	// cancels holds cancel funcs of in-flight requests by session, called
+	// on eviction.
+	cancelMu  sync.Mutex
+	cancelSeq uint64
+	cancels   map[string]map[uint64]func()
 }
 
 type pathState struct {
@@ -149,8 +174,8 @@ type sessionState struct {
 	hashes map[string]*hashState
 }
 
-func NewSessionLimiter(c *cli.Context) *SessionLimiter {
-	return &SessionLimiter{
+func NewSessionLimiter(c *cli.Context, rc redis.UniversalClient) *SessionLimiter {
+	l := &SessionLimiter{
 		maxPerPath:         c.Int(MaxConcPerPathFlag),
 		maxBigFilesPerHash: c.Int(MaxBigFilesPerHashFlag),
 		bigFileThreshold:   c.Int64(BigFileThresholdFlag),
@@ -158,7 +183,12 @@ func NewSessionLimiter(c *cli.Context) *SessionLimiter {
 		maxTotal:           c.Int(MaxConcTotalFlag),
 		maxIPsPerSession:   c.Int(MaxIPsPerSessionFlag),
 		sessions:           make(map[string]*sessionState),
+		cancels:            make(map[string]map[uint64]func()),
 	}
+	if ttl := c.Int(SessionLimiterLeaseTTLFlag); rc != nil && c.Bool(SessionLimiterRedisFlag) && ttl > 0 && l.Enabled() {
+		l.redis = newRedisLeases(rc, time.Duration(ttl)*time.Second, sessionLimiterKeyPrefix, l.cancelSession)
+	}
+	return l
 }
 
 // isLightExt looks up the request path's extension in the configured
@@ -307,6 +337,20 @@ func (l *SessionLimiter) Acquire(sessionID string, infoHash string, path string,
 		return func() {}, ""
 	}
 
+	big := l.isBigFile(infoHash, path)
+
+	if l.redis != nil && l.redis.available() {
+		release, reason, err := l.redis.acquire(leaseLimits{
+			maxTotal:   l.maxTotal,
+			maxPerPath: l.maxPerPath,
+			maxBig:     l.maxBigFilesPerHash,
+			maxIPs:     l.maxIPsPerSession,
+		}, sessionID, infoHash, path, ip, big)
+		if err == nil {
+			return release, reason
+		}
+	}
+
 	s := l.getSession(sessionID)
 
 	if l.maxTotal > 0 && int(s.total.Load()) >= l.maxTotal {
@@ -314,7 +358,7 @@ func (l *SessionLimiter) Acquire(sessionID string, infoHash string, path string,
 	}
 
 	var releaseHash func()
-	if l.isBigFile(infoHash, path) {
+	if big {
 		hs := s.getHash(infoHash)
 		var ok bool
 		releaseHash, ok = hs.tryAddBig(path, l.maxBigFilesPerHash)
@@ -348,10 +392,192 @@ func (l *SessionLimiter) Acquire(sessionID string, infoHash string, path string,
 		newTotal := s.total.Add(-1)
 		if newTotal <= 0 {
 			l.mu.Lock()
-			if s.total.Load() <= 0 {
+			// The session may have been reset and started over meanwhile.
+			if s.total.Load() <= 0 && l.sessions[sessionID] == s {
 				delete(l.sessions, sessionID)
 			}
 			l.mu.Unlock()
 		}
 	}, ""
 }
+
+// SessionPathInfo is the state of a (torrent, path) of a session: in-flight
+// requests, whether it counts toward the big-files cap and the subnets seen
+// within the IP window.
+type SessionPathInfo struct {
+	InfoHash    string   `json:"info_hash"`
+	Path        string   `json:"path"`
+	Concurrency int      `json:"concurrency"`
+	Big         bool     `json:"big"`
+	Subnets     []string `json:"subnets,omitempty"`
+}
+
+// SessionInfo is the state of a session served by the admin API.
+type SessionInfo struct {
+	ID    string            `json:"id"`
+	Total int               `json:"total"`
+	Paths []SessionPathInfo `json:"paths"`
+}
+
+// Sessions returns the active sessions, or the one with id if it's not
+// empty, along with where they come from: "redis" for sessions of all
+// replicas, "local" for those of this one.
+func (l *SessionLimiter) Sessions(id string) ([]SessionInfo, string) {
+	if l.redis != nil && l.redis.available() {
+		res, err := l.redis.sessions(id)
+		if err == nil {
+			return res, "redis"
+		}
+		logrus.WithError(err).Warn("failed to get sessions from redis, falling back to local")
+	}
+	return l.localSessions(id), "local"
+}
+
+func (l *SessionLimiter) localSessions(id string) []SessionInfo {
+	l.mu.Lock()
+	states := map[string]*sessionState{}
+	for sid, s := range l.sessions {
+		if id == "" || sid == id {
+			states[sid] = s
+		}
+	}
+	l.mu.Unlock()
+	res := []SessionInfo{}
+	for sid, s := range states {
+		res = append(res, s.info(sid))
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
+
+func (s *sessionState) info(id string) SessionInfo {
+	s.mu.Lock()
+	paths := make(map[string]*pathState, len(s.paths))
+	for k, p := range s.paths {
+		paths[k] = p
+	}
+	hashes := make(map[string]*hashState, len(s.hashes))
+	for k, h := range s.hashes {
+		hashes[k] = h
+	}
+	s.mu.Unlock()
+	res := map[string]*SessionPathInfo{}
+	for k, p := range paths {
+		infoHash, path, _ := strings.Cut(k, "|")
+		res[k] = &SessionPathInfo{
+			InfoHash:    infoHash,
+			Path:        path,
+			Concurrency: int(p.conc.Load()),
+			Subnets:     p.subnets(ipWindow),
+		}
+	}
+	for infoHash, h := range hashes {
+		h.mu.Lock()
+		for path := range h.activeBigPaths {
+			if p, ok := res[infoHash+"|"+path]; ok {
+				p.Big = true
+			}
+		}
+		h.mu.Unlock()
+	}
+	return SessionInfo{
+		ID:    id,
+		Total: int(s.total.Load()),
+		Paths: sortedPaths(res),
+	}
+}
+
+func sortedPaths(paths map[string]*SessionPathInfo) []SessionPathInfo {
+	res := make([]SessionPathInfo, 0, len(paths))
+	for _, p := range paths {
+		res = append(res, *p)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].InfoHash != res[j].InfoHash {
+			return res[i].InfoHash < res[j].InfoHash
+		}
+		return res[i].Path < res[j].Path
+	})
+	return res
+}
+
+// subnets returns the subnets seen within the window.
+func (p *pathState) subnets(window time.Duration) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cutoff := time.Now().Add(-window)
+	var res []string
+	for k, t := range p.ips {
+		if !t.Before(cutoff) {
+			res = append(res, k)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Reset drops the counters of the session, in-flight requests go on but
+// don't count anymore.
+func (l *SessionLimiter) Reset(sessionID string) error {
+	l.mu.Lock()
+	delete(l.sessions, sessionID)
+	l.mu.Unlock()
+	if l.redis != nil && l.redis.available() {
+		return l.redis.reset(sessionID)
+	}
+	return nil
+}
+
+// Evict cancels in-flight requests of the session on all replicas and drops
+// its counters. It doesn't keep the session from coming back, revoke it for
+// that.
+func (l *SessionLimiter) Evict(sessionID string) error {
+	l.cancelSession(sessionID)
+	if err := l.Reset(sessionID); err != nil {
+		return err
+	}
+	if l.redis != nil && l.redis.available() {
+		return l.redis.evict(sessionID)
+	}
+	return nil
+}
+
+// OnEvict registers cancel of an in-flight request of the session, the
+// returned func unregisters it.
+func (l *SessionLimiter) OnEvict(sessionID string, cancel func()) (remove func()) {
+	l.cancelMu.Lock()
+	defer l.cancelMu.Unlock()
+	l.cancelSeq++
+	n := l.cancelSeq
+	if l.cancels[sessionID] == nil {
+		l.cancels[sessionID] = make(map[uint64]func())
+	}
+	l.cancels[sessionID][n] = cancel
+	return func() {
+		l.cancelMu.Lock()
+		defer l.cancelMu.Unlock()
+		delete(l.cancels[sessionID], n)
+		if len(l.cancels[sessionID]) == 0 {
+			delete(l.cancels, sessionID)
+		}
+	}
+}
+
+// cancelSession cancels in-flight requests of the session on this replica.
+func (l *SessionLimiter) cancelSession(sessionID string) {
+	l.cancelMu.Lock()
+	cancels := l.cancels[sessionID]
+	delete(l.cancels, sessionID)
+	l.cancelMu.Unlock()
+	for _, cancel := range cancels {
+		cancel()
+	}
+}
+
+func (l *SessionLimiter) Close() {
+	if l.redis != nil {
+		l.redis.Close()
+	}
+}
@@ -0,0 +1,486 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// luaAcquireLease is the Redis counterpart of SessionLimiter.Acquire. Slots
+// are leases: members of sorted sets scored by their expiry, so the slots of
+// a replica that stopped heartbeating expire on their own.
+// KEYS: [1] total zset, [2] path zset, [3] big files zset (members are
+// "<lease>|<path>"), [4] ips zset (members are subnets scored by last seen).
+// ARGV: [1] now_ms, [2] expiry_ms, [3] lease, [4] max total, [5] max per
+// path, [6] max big files, [7] max ips, [8] big (0/1), [9] path, [10] subnet,
+// [11] ip window ms, [12] key ttl ms.
+// Returns: rejection reason, empty on success.
+var luaAcquireLease = redis.NewScript(`
+local now      = tonumber(ARGV[1])
+local exp      = tonumber(ARGV[2])
+local lease    = ARGV[3]
+local maxTotal = tonumber(ARGV[4])
+local maxPath  = tonumber(ARGV[5])
+local maxBig   = tonumber(ARGV[6])
+local maxIPs   = tonumber(ARGV[7])
+local big      = ARGV[8] == "1"
+local path     = ARGV[9]
+local subnet   = ARGV[10]
+local window   = tonumber(ARGV[11])
+local ttl      = tonumber(ARGV[12])
+
+for i = 1, 3 do
+    redis.call("ZREMRANGEBYSCORE", KEYS[i], "-inf", now)
+end
+
+if maxTotal > 0 and redis.call("ZCARD", KEYS[1]) >= maxTotal then
+    return "total"
+end
+
+if big and maxBig > 0 then
+    local paths  = {}
+    local n      = 0
+    local active = false
+    for _, m in ipairs(redis.call("ZRANGE", KEYS[3], 0, -1)) do
+        local p = string.sub(m, string.find(m, "|", 1, true) + 1)
+        if p == path then active = true end
+        if not paths[p] then
+            paths[p] = true
+            n = n + 1
+        end
+    end
+    if not active and n >= maxBig then
+        return "bigfiles"
+    end
+end
+
+if maxPath > 0 and redis.call("ZCARD", KEYS[2]) >= maxPath then
+    return "path"
+end
+
+if maxIPs > 0 and subnet ~= "" then
+    redis.call("ZREMRANGEBYSCORE", KEYS[4], "-inf", now - window)
+    redis.call("ZADD", KEYS[4], now, subnet)
+    redis.call("PEXPIRE", KEYS[4], window)
+    if redis.call("ZCARD", KEYS[4]) > maxIPs then
+        return "ips"
+    end
+end
+
+redis.call("ZADD", KEYS[1], exp, lease)
+redis.call("ZADD", KEYS[2], exp, lease)
+if big then
+    redis.call("ZADD", KEYS[3], exp, lease .. "|" .. path)
+end
+for i = 1, 3 do
+    redis.call("PEXPIRE", KEYS[i], ttl)
+end
+return ""
+`)
+
+const (
+	sessionLimiterKeyPrefix    = "thp:sl:"
+	sessionLimiterEvictChannel = "thp:sl:evict"
+)
+
+// leaseLimits are the limits checked by luaAcquireLease, zero values mean
+// unlimited.
+type leaseLimits struct {
+	maxTotal   int
+	maxPerPath int
+	maxBig     int
+	maxIPs     int
+}
+
+// leaseMember is a member of a sorted set holding a lease.
+type leaseMember struct {
+	key    string
+	member string
+}
+
+// redisLeases keeps SessionLimiter slots in Redis, shared by all replicas.
+// Leases of the replica are heartbeated every third of the TTL.
+type redisLeases struct {
+	rc      redis.UniversalClient
+	ttl     time.Duration
+	prefix  string
+	replica string
+	seq     atomic.Uint64
+
+	mu      sync.Mutex
+	redisOK bool
+	probing bool
+	active  map[string][]leaseMember
+
+	onEvict func(sessionID string)
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// newRedisLeases starts heartbeating leases of keys under prefix. Unless
+// onEvict is nil, it's called with sessions evicted by any replica.
+func newRedisLeases(rc redis.UniversalClient, ttl time.Duration, prefix string, onEvict func(sessionID string)) *redisLeases {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &redisLeases{
+		rc:      rc,
+		ttl:     ttl,
+		prefix:  prefix,
+		replica: hex.EncodeToString(b),
+		redisOK: true,
+		active:  make(map[string][]leaseMember),
+		onEvict: onEvict,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	go s.heartbeat()
+	if onEvict != nil {
+		go s.run()
+	}
+	return s
+}
+
+// key groups keys of a session in one hash slot, so that the script runs on
+// Redis Cluster.
+func (s *redisLeases) key(sessionID string, kind string) string {
+	return s.prefix + "{" + sessionID + "}:" + kind
+}
+
+func (s *redisLeases) available() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.redisOK
+}
+
+// acquire takes a slot in Redis. An error means Redis is unavailable and
+// the caller has to fall back to local state.
+func (s *redisLeases) acquire(lim leaseLimits, sessionID string, infoHash string, path string, ip string, big bool) (release func(), reason string, err error) {
+	lease := s.replica + ":" + strconv.FormatUint(s.seq.Add(1), 10)
+	pathKey := infoHash + "|" + path
+	keys := []string{
+		s.key(sessionID, "total"),
+		s.key(sessionID, "path:"+pathKey),
+		s.key(sessionID, "big:"+infoHash),
+		s.key(sessionID, "ips:"+pathKey),
+	}
+	subnet := ""
+	if ip != "" {
+		subnet = subnetKey(ip)
+	}
+	bigArg := "0"
+	if big {
+		bigArg = "1"
+	}
+	now := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	reason, err = luaAcquireLease.Run(ctx, s.rc, keys,
+		now.UnixMilli(),
+		now.Add(s.ttl).UnixMilli(),
+		lease,
+		lim.maxTotal,
+		lim.maxPerPath,
+		lim.maxBig,
+		lim.maxIPs,
+		bigArg,
+		path,
+		subnet,
+		ipWindow.Milliseconds(),
+		(2 * s.ttl).Milliseconds(),
+	).Text()
+	if err != nil {
+		s.markDown(err)
+		return nil, "", errors.Wrap(err, "failed to acquire session lease")
+	}
+	if reason != "" {
+		return nil, reason, nil
+	}
+	members := []leaseMember{{keys[0], lease}, {keys[1], lease}}
+	if big {
+		members = append(members, leaseMember{keys[2], lease + "|" + path})
+	}
+	s.mu.Lock()
+	s.active[lease] = members
+	s.mu.Unlock()
+	return func() {
+		s.release(lease, members)
+	}, "", nil
+}
+
+// release removes the lease. If Redis is unavailable the lease is left to
+// expire.
+func (s *redisLeases) release(lease string, members []leaseMember) {
+	s.mu.Lock()
+	delete(s.active, lease)
+	s.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := s.rc.Pipelined(ctx, func(p redis.Pipeliner) error {
+		for _, m := range members {
+			p.ZRem(ctx, m.key, m.member)
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Warn("failed to release session lease, leaving it to expire")
+	}
+}
+
+func (s *redisLeases) heartbeat() {
+	ticker := time.NewTicker(s.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !s.available() {
+			continue
+		}
+		if err := s.refresh(); err != nil {
+			s.markDown(err)
+		}
+	}
+}
+
+// refresh extends leases of the replica. Leases which already expired are
+// not brought back.
+func (s *redisLeases) refresh() error {
+	s.mu.Lock()
+	var members []leaseMember
+	for _, ms := range s.active {
+		members = append(members, ms...)
+	}
+	s.mu.Unlock()
+	if len(members) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	exp := float64(time.Now().Add(s.ttl).UnixMilli())
+	_, err := s.rc.Pipelined(ctx, func(p redis.Pipeliner) error {
+		keys := map[string]bool{}
+		for _, m := range members {
+			p.ZAddXX(ctx, m.key, redis.Z{Score: exp, Member: m.member})
+			keys[m.key] = true
+		}
+		for k := range keys {
+			p.PExpire(ctx, k, 2*s.ttl)
+		}
+		return nil
+	})
+	return err
+}
+
+// markDown switches the limiter to local state and starts probing Redis.
+func (s *redisLeases) markDown(err error) {
+	logrus.WithError(err).Warn("Redis session limiter call failed, falling back to local")
+	s.mu.Lock()
+	s.redisOK = false
+	shouldProbe := !s.probing
+	s.probing = true
+	s.mu.Unlock()
+	if shouldProbe {
+		go s.probeRedis()
+	}
+}
+
+// probeRedis pings Redis every 5 seconds until it responds, then re-enables it.
+func (s *redisLeases) probeRedis() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err := s.rc.Ping(ctx).Err()
+		cancel()
+		if err == nil {
+			s.mu.Lock()
+			s.redisOK = true
+			s.probing = false
+			s.mu.Unlock()
+			logrus.Info("Redis connection restored for session limiting")
+			return
+		}
+	}
+}
+
+func (s *redisLeases) run() {
+	ps := s.rc.Subscribe(s.ctx, sessionLimiterEvictChannel)
+	defer func(ps *redis.PubSub) {
+		_ = ps.Close()
+	}(ps)
+	ch := ps.Channel()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			s.onEvict(msg.Payload)
+		}
+	}
+}
+
+// sessions returns the state of sessions with slots in Redis, or of the one
+// with id if it's not empty. Keys are scanned, on Redis Cluster only those
+// of a single node are.
+func (s *redisLeases) sessions(id string) ([]SessionInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ids := []string{id}
+	if id == "" {
+		ids = nil
+		prefix, suffix := s.prefix+"{", "}:total"
+		iter := s.rc.Scan(ctx, 0, escapeGlob(prefix)+"*"+suffix, 1000).Iterator()
+		for iter.Next(ctx) {
+			k := iter.Val()
+			ids = append(ids, k[len(prefix):len(k)-len(suffix)])
+		}
+		if err := iter.Err(); err != nil {
+			return nil, errors.Wrap(err, "failed to scan sessions")
+		}
+	}
+	res := []SessionInfo{}
+	for _, sid := range ids {
+		info, err := s.session(ctx, sid)
+		if err != nil {
+			return nil, err
+		}
+		if info.Total > 0 {
+			res = append(res, *info)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ID < res[j].ID
+	})
+	return res, nil
+}
+
+func (s *redisLeases) session(ctx context.Context, sessionID string) (*SessionInfo, error) {
+	keys, err := s.keys(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UnixMilli()
+	live := &redis.ZRangeBy{Min: "(" + strconv.FormatInt(now, 10), Max: "+inf"}
+	recent := &redis.ZRangeBy{Min: strconv.FormatInt(now-ipWindow.Milliseconds(), 10), Max: "+inf"}
+	info := &SessionInfo{ID: sessionID}
+	paths := map[string]*SessionPathInfo{}
+	path := func(key string) *SessionPathInfo {
+		p, ok := paths[key]
+		if !ok {
+			infoHash, path, _ := strings.Cut(key, "|")
+			p = &SessionPathInfo{InfoHash: infoHash, Path: path}
+			paths[key] = p
+		}
+		return p
+	}
+	prefix := s.key(sessionID, "")
+	for _, k := range keys {
+		kind := strings.TrimPrefix(k, prefix)
+		switch {
+		case kind == "total":
+			n, err := s.rc.ZCount(ctx, k, live.Min, live.Max).Result()
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to count %s", k)
+			}
+			info.Total = int(n)
+		case strings.HasPrefix(kind, "path:"):
+			n, err := s.rc.ZCount(ctx, k, live.Min, live.Max).Result()
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to count %s", k)
+			}
+			path(strings.TrimPrefix(kind, "path:")).Concurrency = int(n)
+		case strings.HasPrefix(kind, "big:"):
+			ms, err := s.rc.ZRangeByScore(ctx, k, live).Result()
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to get %s", k)
+			}
+			for _, m := range ms {
+				_, p, _ := strings.Cut(m, "|")
+				path(strings.TrimPrefix(kind, "big:") + "|" + p).Big = true
+			}
+		case strings.HasPrefix(kind, "ips:"):
+			ms, err := s.rc.ZRangeByScore(ctx, k, recent).Result()
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to get %s", k)
+			}
+			sort.Strings(ms)
+			path(strings.TrimPrefix(kind, "ips:")).Subnets = ms
+		}
+	}
+	info.Paths = sortedPaths(paths)
+	return info, nil
+}
+
+// keys returns the Redis keys of the session.
+func (s *redisLeases) keys(ctx context.Context, sessionID string) ([]string, error) {
+	var keys []string
+	iter := s.rc.Scan(ctx, 0, escapeGlob(s.key(sessionID, ""))+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to scan keys of session %s", sessionID)
+	}
+	return keys, nil
+}
+
+// reset drops all slots of the session.
+func (s *redisLeases) reset(sessionID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	keys, err := s.keys(ctx, sessionID)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	if err := s.rc.Del(ctx, keys...).Err(); err != nil {
+		return errors.Wrapf(err, "failed to delete keys of session %s", sessionID)
+	}
+	return nil
+}
+
+// evict tells all replicas to cancel requests of the session.
+func (s *redisLeases) evict(sessionID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.rc.Publish(ctx, sessionLimiterEvictChannel, sessionID).Err(); err != nil {
+		return errors.Wrapf(err, "failed to publish eviction of session %s", sessionID)
+	}
+	return nil
+}
+
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *redisLeases) Close() {
+	s.cancel()
+}
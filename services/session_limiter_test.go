@@ -0,0 +1,291 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestReplica is a SessionLimiter of one proxy replica sharing mr with
+// the others.
+func newTestReplica(t *testing.T, mr *miniredis.Miniredis, ttl time.Duration) *SessionLimiter {
+	t.Helper()
+	rc := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = rc.Close() })
+	l := &SessionLimiter{
+		maxPerPath:         2,
+		maxBigFilesPerHash: 1,
+		maxTotal:           3,
+		maxIPsPerSession:   1,
+		lightExts:          parseLightExts(defaultLightExts),
+		sessions:           make(map[string]*sessionState),
+		cancels:            make(map[string]map[uint64]func()),
+	}
+	l.redis = newRedisLeases(rc, ttl, sessionLimiterKeyPrefix, l.cancelSession)
+	t.Cleanup(l.Close)
+	return l
+}
+
+func TestSessionLimiterRedis_SharedAcrossReplicas(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := newTestReplica(t, mr, time.Minute)
+	b := newTestReplica(t, mr, time.Minute)
+
+	r1, reason := a.Acquire("s1", "h", "/a.mkv", "1.2.3.4")
+	if r1 == nil {
+		t.Fatalf("expected slot, got %s", reason)
+	}
+	r2, _ := b.Acquire("s1", "h", "/a.mkv", "1.2.3.5")
+	if r2 == nil {
+		t.Fatal("expected slot on the second replica")
+	}
+	if r, reason := a.Acquire("s1", "h", "/a.mkv", "1.2.3.4"); r != nil || reason != "path" {
+		t.Fatalf("expected path rejection, got %q", reason)
+	}
+	if r, reason := b.Acquire("s1", "h", "/b.mkv", "1.2.3.4"); r != nil || reason != "bigfiles" {
+		t.Fatalf("expected bigfiles rejection, got %q", reason)
+	}
+	r3, _ := b.Acquire("s1", "h", "/a.srt", "1.2.3.4")
+	if r3 == nil {
+		t.Fatal("expected slot for a light file")
+	}
+	if r, reason := a.Acquire("s1", "h", "/b.srt", "1.2.3.4"); r != nil || reason != "total" {
+		t.Fatalf("expected total rejection, got %q", reason)
+	}
+	r1()
+	if r, reason := b.Acquire("s1", "h", "/b.srt", "1.2.3.4"); r == nil {
+		t.Fatalf("expected released slot to be free, got %q", reason)
+	}
+	if r, _ := a.Acquire("s2", "h", "/a.mkv", "1.2.3.4"); r == nil {
+		t.Fatal("expected other sessions to be unaffected")
+	}
+}
+
+func TestSessionLimiterRedis_IPs(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := newTestReplica(t, mr, time.Minute)
+	b := newTestReplica(t, mr, time.Minute)
+
+	if r, _ := a.Acquire("s1", "h", "/a.mkv", "1.2.3.4"); r == nil {
+		t.Fatal("expected slot")
+	}
+	if r, reason := b.Acquire("s1", "h", "/a.mkv", "5.6.7.8"); r != nil || reason != "ips" {
+		t.Fatalf("expected ips rejection, got %q", reason)
+	}
+}
+
+func TestSessionLimiterRedis_LeaseExpiry(t *testing.T) {
+	mr := miniredis.RunT(t)
+	ttl := 300 * time.Millisecond
+	a := newTestReplica(t, mr, ttl)
+	crashed := newTestReplica(t, mr, ttl)
+	b := newTestReplica(t, mr, ttl)
+
+	if r, _ := a.Acquire("s1", "h", "/a.srt", ""); r == nil {
+		t.Fatal("expected slot")
+	}
+	if r, _ := crashed.Acquire("s1", "h", "/b.srt", ""); r == nil {
+		t.Fatal("expected slot")
+	}
+	if r, _ := b.Acquire("s1", "h", "/c.srt", ""); r == nil {
+		t.Fatal("expected slot")
+	}
+	// The crashed replica stops heartbeating, the others keep their slots.
+	crashed.Close()
+	time.Sleep(3 * ttl)
+	if r, reason := b.Acquire("s1", "h", "/d.srt", ""); r == nil {
+		t.Fatalf("expected slot of the crashed replica to expire, got %q", reason)
+	}
+	if r, reason := b.Acquire("s1", "h", "/e.srt", ""); r != nil || reason != "total" {
+		t.Fatalf("expected heartbeated slots to be kept, got %q", reason)
+	}
+}
+
+func TestSessionLimiterRedis_FallsBackToLocal(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := newTestReplica(t, mr, time.Minute)
+	mr.Close()
+
+	r1, reason := a.Acquire("s1", "h", "/a.mkv", "1.2.3.4")
+	if r1 == nil {
+		t.Fatalf("expected local slot, got %q", reason)
+	}
+	if a.redis.available() {
+		t.Fatal("expected redis to be marked unavailable")
+	}
+	a.Acquire("s1", "h", "/a.mkv", "1.2.3.4")
+	if r, reason := a.Acquire("s1", "h", "/a.mkv", "1.2.3.4"); r != nil || reason != "path" {
+		t.Fatalf("expected local limits to apply, got %q", reason)
+	}
+	r1()
+}
+
+func newTestLocalLimiter() *SessionLimiter {
+	return &SessionLimiter{
+		maxPerPath:         2,
+		maxBigFilesPerHash: 1,
+		maxTotal:           3,
+		maxIPsPerSession:   2,
+		lightExts:          parseLightExts(defaultLightExts),
+		sessions:           make(map[string]*sessionState),
+		cancels:            make(map[string]map[uint64]func()),
+	}
+}
+
+func TestSessionLimiter_Sessions(t *testing.T) {
+	for name, l := range map[string]*SessionLimiter{
+		"local": newTestLocalLimiter(),
+		"redis": newTestReplica(t, miniredis.RunT(t), time.Minute),
+	} {
+		t.Run(name, func(t *testing.T) {
+			l.maxIPsPerSession = 2
+			l.Acquire("s1", "h", "/a.mkv", "1.2.3.4")
+			l.Acquire("s1", "h", "/a.mkv", "5.6.7.8")
+			l.Acquire("s1", "h", "/a.srt", "1.2.3.4")
+			l.Acquire("s2", "h", "/a.srt", "1.2.3.4")
+
+			sessions, source := l.Sessions("")
+			if source != name || len(sessions) != 2 {
+				t.Fatalf("expected 2 %s sessions, got %s %+v", name, source, sessions)
+			}
+			s1 := sessions[0]
+			if s1.ID != "s1" || s1.Total != 3 || len(s1.Paths) != 2 {
+				t.Fatalf("unexpected session: %+v", s1)
+			}
+			mkv, srt := s1.Paths[0], s1.Paths[1]
+			if mkv.Path != "/a.mkv" || mkv.Concurrency != 2 || !mkv.Big || len(mkv.Subnets) != 2 || mkv.Subnets[0] != "1.2.3.0" {
+				t.Errorf("unexpected big path: %+v", mkv)
+			}
+			if srt.Path != "/a.srt" || srt.Concurrency != 1 || srt.Big {
+				t.Errorf("unexpected light path: %+v", srt)
+			}
+			if sessions, _ := l.Sessions("s2"); len(sessions) != 1 || sessions[0].ID != "s2" {
+				t.Errorf("expected s2 only, got %+v", sessions)
+			}
+
+			if err := l.Reset("s1"); err != nil {
+				t.Fatal(err)
+			}
+			if sessions, _ := l.Sessions("s1"); len(sessions) != 0 {
+				t.Fatalf("expected reset session to be gone, got %+v", sessions)
+			}
+			if r, reason := l.Acquire("s1", "h", "/b.mkv", "1.2.3.4"); r == nil {
+				t.Fatalf("expected counters to be reset, got %q", reason)
+			}
+		})
+	}
+}
+
+func TestSessionLimiter_ReleaseAfterReset(t *testing.T) {
+	l := newTestLocalLimiter()
+	old, _ := l.Acquire("s1", "h", "/a.srt", "")
+	_ = l.Reset("s1")
+	if r, _ := l.Acquire("s1", "h", "/b.srt", ""); r == nil {
+		t.Fatal("expected slot")
+	}
+	old()
+	if sessions, _ := l.Sessions("s1"); len(sessions) != 1 || sessions[0].Total != 1 {
+		t.Fatalf("release of a reset slot must not touch the new session, got %+v", sessions)
+	}
+}
+
+func TestSessionLimiter_Evict(t *testing.T) {
+	l := newTestLocalLimiter()
+	l.Acquire("s1", "h", "/a.srt", "")
+	cancelled := 0
+	remove := l.OnEvict("s1", func() { cancelled++ })
+	l.OnEvict("s2", func() { t.Error("other sessions must not be cancelled") })
+	if err := l.Evict("s1"); err != nil {
+		t.Fatal(err)
+	}
+	remove()
+	if cancelled != 1 {
+		t.Fatalf("expected in-flight request to be cancelled, got %d", cancelled)
+	}
+	if sessions, _ := l.Sessions("s1"); len(sessions) != 0 {
+		t.Fatalf("expected evicted session to be gone, got %+v", sessions)
+	}
+}
+
+func TestSessionLimiterRedis_EvictAcrossReplicas(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := newTestReplica(t, mr, time.Minute)
+	b := newTestReplica(t, mr, time.Minute)
+	deadline := time.Now().Add(2 * time.Second)
+	for mr.PubSubNumSub(sessionLimiterEvictChannel)[sessionLimiterEvictChannel] < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("replicas didn't subscribe")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b.Acquire("s1", "h", "/a.srt", "")
+	cancelled := make(chan struct{})
+	defer b.OnEvict("s1", func() { close(cancelled) })()
+	if err := a.Evict("s1"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected request on the other replica to be cancelled")
+	}
+	if sessions, _ := b.Sessions("s1"); len(sessions) != 0 {
+		t.Fatalf("expected evicted session to be gone, got %+v", sessions)
+	}
+}
+
+func TestWeb_AdminSessions(t *testing.T) {
+	l := newTestLocalLimiter()
+	s := &Web{adminToken: "admin", sl: l}
+	mux := http.NewServeMux()
+	s.registerAdmin(mux)
+	do := func(method string, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer admin")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	l.Acquire("s1", "h", "/a.mkv", "1.2.3.4")
+	cancelled := false
+	defer l.OnEvict("s1", func() { cancelled = true })()
+
+	w := do("GET", "/admin/sessions")
+	var res sessionsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected sessions, got %d: %s", w.Code, w.Body)
+	}
+	if res.Source != "local" || len(res.Sessions) != 1 || res.Sessions[0].Paths[0].Path != "/a.mkv" {
+		t.Fatalf("unexpected sessions: %+v", res)
+	}
+	if w := do("GET", "/admin/sessions/s1"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if w := do("GET", "/admin/sessions/s2"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	if w := do("GET", "/admin/sessions/s1/reset"); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", w.Code)
+	}
+	if w := do("POST", "/admin/sessions/s1/reset"); w.Code != http.StatusNoContent || cancelled {
+		t.Fatalf("expected reset without cancellation, got %d", w.Code)
+	}
+	if w := do("GET", "/admin/sessions/s1"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected reset session to be gone, got %d", w.Code)
+	}
+	if w := do("DELETE", "/admin/sessions/s1"); w.Code != http.StatusNoContent || !cancelled {
+		t.Fatalf("expected eviction, got %d", w.Code)
+	}
+	req := httptest.NewRequest("GET", "/admin/sessions", nil)
+	rw := httptest.NewRecorder()
+	mux.ServeHTTP(rw, req)
+	if rw.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", rw.Code)
+	}
+}
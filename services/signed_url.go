@@ -0,0 +1,108 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// Query params of signed URLs. Signed URLs are for clients that can't carry
+// a JWT: the claims go into plain query params and the signature covers them
+// together with the path.
+const (
+	SignedURLSigParam        = "sig"
+	SignedURLExpiresParam    = "expires"
+	SignedURLPathPrefixParam = "path-prefix"
+	signedURLAPIKeyParam     = "api-key"
+)
+
+// signedURLClaims maps query params covered by the signature to the claims
+// they produce.
+var signedURLClaims = map[string]string{
+	"role":       "role",
+	"rate":       "rate",
+	"session-id": "sessionID",
+	"domain":     "domain",
+}
+
+// IsSignedURL reports whether the query carries a URL signature instead of a
+// token.
+func IsSignedURL(q url.Values) bool {
+	return q.Get(SignedURLSigParam) != "" && q.Get("token") == ""
+}
+
+// signedURLPayload is the string to sign: the path (or the signed path
+// prefix, so that one signature serves all files under it, e.g. HLS
+// segments) followed by the signed params sorted by name.
+func signedURLPayload(path string, q url.Values) string {
+	if p := q.Get(SignedURLPathPrefixParam); p != "" {
+		path = p
+	}
+	names := []string{signedURLAPIKeyParam, SignedURLExpiresParam, SignedURLPathPrefixParam}
+	for n := range signedURLClaims {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString(path)
+	for _, n := range names {
+		if v := q.Get(n); v != "" {
+			b.WriteString("\n" + n + "=" + v)
+		}
+	}
+	return b.String()
+}
+
+func signURLPayload(payload string, secret string) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+// SignURL sets expires and sig of u. Params to be signed (api-key, role,
+// rate, session-id, domain, path-prefix) must be set before.
+func SignURL(u *url.URL, secret string, expires time.Time) {
+	q := u.Query()
+	q.Del(SignedURLSigParam)
+	q.Set(SignedURLExpiresParam, strconv.FormatInt(expires.Unix(), 10))
+	q.Set(SignedURLSigParam, signURLPayload(signedURLPayload(u.Path, q), secret))
+	u.RawQuery = q.Encode()
+}
+
+// verifySignedURL checks the signature of a request to path and returns the
+// claims equivalent to the signed params.
+func verifySignedURL(path string, q url.Values, secret string, now time.Time) (jwt.MapClaims, error) {
+	if secret == "" {
+		return nil, errors.New("no secret for signed url")
+	}
+	sig := q.Get(SignedURLSigParam)
+	if !hmac.Equal([]byte(sig), []byte(signURLPayload(signedURLPayload(path, q), secret))) {
+		return nil, errors.New("wrong url signature")
+	}
+	if p := q.Get(SignedURLPathPrefixParam); p != "" && !hasPathPrefix(path, p) {
+		return nil, errors.Errorf("path %s is out of signed prefix %s", path, p)
+	}
+	exp, err := strconv.ParseInt(q.Get(SignedURLExpiresParam), 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse expires of signed url")
+	}
+	if now.Unix() > exp {
+		return nil, jwt.NewValidationError("signed url is expired", jwt.ValidationErrorExpired)
+	}
+	// Numbers as float64, the way they come out of a parsed token.
+	claims := jwt.MapClaims{"exp": float64(exp)}
+	for p, c := range signedURLClaims {
+		if v := q.Get(p); v != "" {
+			claims[c] = v
+		}
+	}
+	return claims, nil
+}
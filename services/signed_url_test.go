@@ -0,0 +1,78 @@
+package services
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func signTestURL(t *testing.T, raw string, secret string, expires time.Time) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SignURL(u, secret, expires)
+	return u
+}
+
+func TestClaims_GetSigned(t *testing.T) {
+	c, _ := newTestAPIKeysClaims(t)
+	hash := "08ada5a7a6183aae1e09d831df6748d566095a10"
+	u := signTestURL(t, "http://webtor.io/"+hash+"/Season%201/e01.mkv?api-key=tenant-a&role=free&rate=2M&session-id=abc&download-id=1",
+		"secret-a", time.Now().Add(time.Hour))
+	q := u.Query()
+	if !IsSignedURL(q) {
+		t.Fatal("expected signed url")
+	}
+	claims, err := c.GetSigned(u.Path, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["role"] != "free" || claims["rate"] != "2M" || claims["sessionID"] != "abc" {
+		t.Fatalf("unexpected claims %v", claims)
+	}
+	if _, ok := claims["exp"].(float64); !ok {
+		t.Fatalf("expected exp claim, got %v", claims)
+	}
+
+	// Unsigned params may change, signed ones and the path may not.
+	q.Set("download-id", "2")
+	if _, err := c.GetSigned(u.Path, q); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	q.Set("role", "paid")
+	if _, err := c.GetSigned(u.Path, q); err == nil {
+		t.Fatal("expected tampered role to be rejected")
+	}
+	if _, err := c.GetSigned("/"+hash+"/Season 1/e02.mkv", u.Query()); err == nil {
+		t.Fatal("expected other path to be rejected")
+	}
+	if _, err := c.GetSigned(u.Path, signTestURL(t, u.String(), "secret-b", time.Now().Add(time.Hour)).Query()); err == nil {
+		t.Fatal("expected secret of another tenant to be rejected")
+	}
+
+	expired := signTestURL(t, "http://webtor.io/"+hash+"/a.mkv?api-key=tenant-a", "secret-a", time.Now().Add(-time.Minute))
+	_, err = c.GetSigned(expired.Path, expired.Query())
+	if err == nil {
+		t.Fatal("expected expired url to be rejected")
+	}
+	if got := claimsErrorReason(err); got != rejectExpired {
+		t.Fatalf("expected reason %s, got %s", rejectExpired, got)
+	}
+}
+
+func TestClaims_GetSignedPathPrefix(t *testing.T) {
+	c, _ := newTestAPIKeysClaims(t)
+	prefix := "/08ada5a7a6183aae1e09d831df6748d566095a10/e01.mkv~hls"
+	u := signTestURL(t, "http://webtor.io"+prefix+"/index.m3u8?api-key=tenant-a&path-prefix="+url.QueryEscape(prefix),
+		"secret-a", time.Now().Add(time.Hour))
+	for _, p := range []string{prefix + "/index.m3u8", prefix + "/720/seg-1.ts"} {
+		if _, err := c.GetSigned(p, u.Query()); err != nil {
+			t.Fatalf("unexpected error for %s: %v", p, err)
+		}
+	}
+	if _, err := c.GetSigned("/08ada5a7a6183aae1e09d831df6748d566095a10/e01.mkv", u.Query()); err == nil {
+		t.Fatal("expected path outside of prefix to be rejected")
+	}
+}
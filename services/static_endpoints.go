@@ -0,0 +1,196 @@
+package services
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const staticFileCheckInterval = 5 * time.Second
+
+// StaticConfig configures the Static endpoints provider. Endpoints are listed
+// inline, File points to a YAML file with the same list that is re-read when
+// it changes. Both may be set, entries of the file come after inline ones.
+type StaticConfig struct {
+	Endpoints []StaticEndpoint `yaml:"endpoints"`
+	File      string           `yaml:"file"`
+	endpoints *StaticEndpoints
+}
+
+// StaticEndpoint is a single "host:port" upstream. It can be written as a
+// plain string or as a mapping with an optional node name and probe port.
+type StaticEndpoint struct {
+	Address   string `yaml:"address"`
+	Node      string `yaml:"node"`
+	ProbePort int    `yaml:"probePort"`
+}
+
+func (s *StaticEndpoint) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		s.Address = value.Value
+		return nil
+	}
+	type plain StaticEndpoint
+	return value.Decode((*plain)(s))
+}
+
+// StaticEndpoints holds the resolved endpoints of a Static service and
+// notifies subscribers when its file changes.
+type StaticEndpoints struct {
+	name        string
+	inline      []Endpoint
+	file        string
+	interval    time.Duration
+	mux         sync.RWMutex
+	es          []Endpoint
+	modTime     time.Time
+	subscribers []func(name string)
+	closeCh     chan struct{}
+	closeOnce   sync.Once
+}
+
+func NewStaticEndpoints(name string, cfg *StaticConfig) (*StaticEndpoints, error) {
+	inline, err := parseStaticEndpoints(cfg.Endpoints)
+	if err != nil {
+		return nil, err
+	}
+	s := &StaticEndpoints{
+		name:     name,
+		inline:   inline,
+		file:     cfg.File,
+		interval: staticFileCheckInterval,
+		es:       inline,
+		closeCh:  make(chan struct{}),
+	}
+	if s.file == "" {
+		return s, nil
+	}
+	if _, err := s.reload(); err != nil {
+		return nil, err
+	}
+	go s.watch()
+	return s, nil
+}
+
+func parseStaticEndpoints(ses []StaticEndpoint) ([]Endpoint, error) {
+	res := make([]Endpoint, 0, len(ses))
+	for _, se := range ses {
+		host, portStr, err := net.SplitHostPort(se.Address)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse static endpoint %q", se.Address)
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse port of static endpoint %q", se.Address)
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			ips, err := net.LookupIP(host)
+			if err != nil || len(ips) == 0 {
+				return nil, errors.Wrapf(err, "failed to resolve static endpoint %q", se.Address)
+			}
+			ip = ips[0]
+		}
+		res = append(res, Endpoint{
+			IP:       ip.String(),
+			NodeName: se.Node,
+			Ports: Ports{
+				HTTP:  port,
+				Probe: se.ProbePort,
+			},
+		})
+	}
+	return res, nil
+}
+
+// reload re-reads the file if it was modified since the last read. It
+// reports whether the endpoints changed.
+func (s *StaticEndpoints) reload() (bool, error) {
+	st, err := os.Stat(s.file)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to stat static endpoints file %s", s.file)
+	}
+	s.mux.RLock()
+	modTime := s.modTime
+	s.mux.RUnlock()
+	if st.ModTime().Equal(modTime) {
+		return false, nil
+	}
+	data, err := os.ReadFile(s.file)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to read static endpoints file %s", s.file)
+	}
+	var ses []StaticEndpoint
+	if err := yaml.Unmarshal(data, &ses); err != nil {
+		return false, errors.Wrapf(err, "failed to parse static endpoints file %s", s.file)
+	}
+	fes, err := parseStaticEndpoints(ses)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to load static endpoints file %s", s.file)
+	}
+	es := make([]Endpoint, 0, len(s.inline)+len(fes))
+	es = append(es, s.inline...)
+	es = append(es, fes...)
+	s.mux.Lock()
+	s.es = es
+	s.modTime = st.ModTime()
+	s.mux.Unlock()
+	return true, nil
+}
+
+func (s *StaticEndpoints) watch() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case <-ticker.C:
+		}
+		changed, err := s.reload()
+		if err != nil {
+			// Keep serving the last good list, a half-written file must not
+			// take the service down.
+			log.WithError(err).Warnf("failed to reload static endpoints for %s", s.name)
+			continue
+		}
+		if changed {
+			log.Infof("static endpoints for %s reloaded", s.name)
+			s.notify()
+		}
+	}
+}
+
+func (s *StaticEndpoints) notify() {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	for _, f := range s.subscribers {
+		f(s.name)
+	}
+}
+
+func (s *StaticEndpoints) Subscribe(f func(name string)) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.subscribers = append(s.subscribers, f)
+}
+
+// Get returns a copy of the current endpoints, distribution sorts it in
+// place.
+func (s *StaticEndpoints) Get() []Endpoint {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return append([]Endpoint(nil), s.es...)
+}
+
+func (s *StaticEndpoints) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+	})
+}
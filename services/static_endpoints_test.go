@@ -0,0 +1,178 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadServicesConfigFromYAML_Static(t *testing.T) {
+	s, err := loadTestServicesConfig(t, `
+default:
+  name: torrent-web-seeder
+  endpointsProvider: Static
+  distribution: NodeHash
+  static:
+    endpoints:
+      - 10.0.0.1:8080
+      - address: 10.0.0.2:8080
+        node: vm-2
+        probePort: 8081
+`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s.Close()
+	es := s.GetDefault().Static.endpoints.Get()
+	if len(es) != 2 {
+		t.Fatalf("expected 2 endpoints, got %+v", es)
+	}
+	if es[0].IP != "10.0.0.1" || es[0].HTTP != 8080 || es[0].NodeName != "" {
+		t.Errorf("unexpected plain endpoint: %+v", es[0])
+	}
+	if es[1].IP != "10.0.0.2" || es[1].NodeName != "vm-2" || es[1].Probe != 8081 {
+		t.Errorf("unexpected endpoint with node: %+v", es[1])
+	}
+}
+
+func TestLoadServicesConfigFromYAML_StaticErrors(t *testing.T) {
+	for _, config := range []string{`
+default:
+  name: torrent-web-seeder
+  endpointsProvider: Static
+`, `
+default:
+  name: torrent-web-seeder
+  endpointsProvider: Static
+  static:
+    endpoints:
+      - 10.0.0.1
+`, `
+default:
+  name: torrent-web-seeder
+  endpointsProvider: Static
+  static:
+    file: $DIR/missing.yaml
+`} {
+		if _, err := loadTestServicesConfig(t, config); err == nil {
+			t.Errorf("expected error for config %s", config)
+		}
+	}
+}
+
+func TestStaticEndpoints_FileReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "endpoints.yaml")
+	if err := os.WriteFile(file, []byte("- 10.0.0.2:8080\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewStaticEndpoints("torrent-web-seeder", &StaticConfig{
+		Endpoints: []StaticEndpoint{{Address: "10.0.0.1:8080"}},
+		File:      file,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer s.Close()
+	if got := s.Get(); len(got) != 2 || got[1].IP != "10.0.0.2" {
+		t.Fatalf("unexpected endpoints: %+v", got)
+	}
+	changed := make(chan string, 10)
+	s.Subscribe(func(name string) {
+		changed <- name
+	})
+
+	if err := os.WriteFile(file, []byte("- address: 10.0.0.3:8080\n  node: vm-3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the change is visible even on filesystems with coarse mtime.
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := s.reload(); err != nil || !changed {
+		t.Fatalf("expected reload, got changed=%v err=%v", changed, err)
+	}
+	s.notify()
+	if name := <-changed; name != "torrent-web-seeder" {
+		t.Fatalf("unexpected service notified: %s", name)
+	}
+	if got := s.Get(); len(got) != 2 || got[1].IP != "10.0.0.3" || got[1].NodeName != "vm-3" {
+		t.Fatalf("unexpected endpoints after reload: %+v", got)
+	}
+
+	// A broken file keeps the last good list.
+	if err := os.WriteFile(file, []byte("- not an address\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.reload(); err == nil {
+		t.Fatal("expected error for broken file")
+	}
+	if got := s.Get(); len(got) != 2 || got[1].IP != "10.0.0.3" {
+		t.Fatalf("broken file replaced endpoints: %+v", got)
+	}
+}
+
+func testStaticConfig(t *testing.T, d Distribution, ses ...StaticEndpoint) *ServiceConfig {
+	t.Helper()
+	cfg := &ServiceConfig{
+		Name:              "torrent-web-seeder",
+		Distribution:      d,
+		EndpointsProvider: Static,
+		Static:            &StaticConfig{Endpoints: ses},
+	}
+	if err := loadStaticConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestServiceLocation_Static(t *testing.T) {
+	ses := []StaticEndpoint{
+		{Address: "10.0.0.1:8080", Node: "vm-1"},
+		{Address: "10.0.0.2:8080", Node: "vm-1"},
+		{Address: "10.0.1.1:8080", Node: "vm-2"},
+	}
+	src := &Source{InfoHash: "08ada5a7a6183aae1e09d831df6748d566095a10"}
+	for _, d := range []Distribution{Hash, NodeHash} {
+		sl := NewServiceLocationPool(newTestContext(), okClient, nil, nil, nil, nil)
+		cfg := testStaticConfig(t, d, ses...)
+		loc, err := sl.Get(cfg, src, nil)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %v", d, err)
+		}
+		if loc.Unavailable || loc.HTTP != 8080 {
+			t.Fatalf("%v: unexpected location: %+v", d, loc)
+		}
+
+		fb, err := sl.GetFallback(cfg, src, loc.IP, nil)
+		if err != nil {
+			t.Fatalf("%v: unexpected fallback error: %v", d, err)
+		}
+		if fb.IP.Equal(loc.IP) {
+			t.Fatalf("%v: fallback returned the failed endpoint %v", d, loc.IP)
+		}
+	}
+
+	// PreferLocalNode keeps requests on endpoints of my node.
+	c := newTestContext(RegisterCommonFlags)
+	if err := c.Set(myNodeNameFlag, "vm-2"); err != nil {
+		t.Fatal(err)
+	}
+	sl := NewServiceLocationPool(c, okClient, nil, nil, nil, nil)
+	cfg := testStaticConfig(t, Hash, ses...)
+	cfg.PreferLocalNode = true
+	for _, h := range testInfoHashes(20) {
+		loc, err := sl.Get(cfg, &Source{InfoHash: h}, nil)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if loc.IP.String() != "10.0.1.1" {
+			t.Fatalf("expected local endpoint, got %v", loc.IP)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const tokenExchangeTTLFlag = "token-exchange-ttl"
+
+// exchangedClaim marks tokens minted by the exchange endpoint, they are
+// always bound to the client subnet.
+const exchangedClaim = "exchanged"
+
+type tokenExchangeResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// handleTokenExchange trades a primary token for a short-lived one bound to a
+// single file and the client subnet, so that the primary token doesn't have
+// to be embedded in player pages. Params are token, api-key and path, the
+// latter being the url path of the file, e.g. /<hash>/<file>.
+func (s *Web) handleTokenExchange(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	apiKey := r.FormValue("api-key")
+	logger := logrus.WithFields(logrus.Fields{
+		"path":    r.FormValue("path"),
+		"api_key": apiKey,
+	})
+	claims, err := s.claims.Get(r.FormValue("token"), apiKey)
+	if err != nil {
+		reason := claimsErrorReason(err)
+		promTokenRejections.WithLabelValues(reason).Inc()
+		logger.WithError(err).WithField("reason", reason).Warn("failed to get claims for token exchange")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	src, err := s.parser.Parse(&url.URL{Path: r.FormValue("path")})
+	if err != nil {
+		http.Error(w, "bad path", http.StatusBadRequest)
+		return
+	}
+	// The minted token can't be wider than the primary one.
+	if reason, err := checkTokenScope(claims, src, r); err != nil {
+		promTokenRejections.WithLabelValues(reason).Inc()
+		logger.WithError(err).WithField("reason", reason).Warn("token scope mismatch on token exchange")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if bound, reqIP, ok := s.checkSessionIP(claims, r); !ok {
+		logger.WithFields(logrus.Fields{
+			"session_ip": bound,
+			"request_ip": reqIP,
+		}).Warn("session IP mismatch on token exchange")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if k := s.claims.GetAPIKey(apiKey); k != nil {
+		if err := k.Apply(claims, src); err != nil {
+			logger.WithError(err).Warn("api key policy rejected token exchange")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	token, exp, err := s.claims.Exchange(claims, apiKey, src, s.getIP(r), s.exchangeTTL)
+	if err != nil {
+		logger.WithError(err).Error("failed to exchange token")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, tokenExchangeResponse{
+		Token:     token,
+		ExpiresAt: exp,
+	})
+}
+
+// Exchange mints a token with the claims of the primary one, bound to the
+// file of src and the subnet of ip. It expires after ttl, but not later than
+// the primary token. The jti and sessionID are kept, so revoking the primary
+// token or its session revokes the minted ones too.
+func (s *Claims) Exchange(primary jwt.MapClaims, apiKey string, src *Source, ip string, ttl time.Duration) (string, time.Time, error) {
+	return s.mint(primary, apiKey, jwt.MapClaims{
+		"hash": src.InfoHash,
+		"path": src.OriginPath,
+	}, ip, ttl)
+}
+
+// mint signs a copy of primary with bind claims on top, bound to the subnet
+// of ip and expiring after ttl or with the primary token, whichever is first.
+func (s *Claims) mint(primary jwt.MapClaims, apiKey string, bind jwt.MapClaims, ip string, ttl time.Duration) (string, time.Time, error) {
+	secret, err := s.secret(apiKey)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if secret == "" {
+		return "", time.Time{}, errors.New("no secret to sign token")
+	}
+	now := time.Now()
+	exp := now.Add(ttl).Unix()
+	if pexp, ok := primary["exp"].(float64); ok && int64(pexp) < exp {
+		exp = int64(pexp)
+	}
+	claims := jwt.MapClaims{}
+	for k, v := range primary {
+		claims[k] = v
+	}
+	for k, v := range bind {
+		claims[k] = v
+	}
+	claims["exp"] = exp
+	claims["iat"] = now.Unix()
+	claims[exchangedClaim] = true
+	if cip := parseClientIP(ip); cip != nil {
+		claims["remoteAddress"] = cip.String()
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "failed to sign token")
+	}
+	return token, time.Unix(exp, 0).UTC(), nil
+}
@@ -0,0 +1,134 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestWeb_TokenExchange(t *testing.T) {
+	hash := "08ada5a7a6183aae1e09d831df6748d566095a10"
+	c := &Claims{apiKey: "key", apiSecret: "secret"}
+	s := &Web{
+		claims: c,
+		parser: NewURLParser(&ServicesConfig{
+			"default": &ServiceConfig{Name: "torrent-web-seeder"},
+			"hls":     &ServiceConfig{Name: "content-transcoder"},
+		}),
+		enforceSessionIP: true,
+		exchangeTTL:      5 * time.Minute,
+	}
+	primaryExp := time.Now().Add(time.Hour).Unix()
+	primary, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"exp":           primaryExp,
+		"role":          "free",
+		"sessionID":     "s1",
+		"remoteAddress": "1.2.3.4",
+	}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange := func(token string, path string, ip string) *httptest.ResponseRecorder {
+		q := url.Values{"token": {token}, "api-key": {"key"}, "path": {path}}
+		req := httptest.NewRequest("GET", "/token/exchange?"+q.Encode(), nil)
+		req.Header.Set("X-Forwarded-For", ip)
+		w := httptest.NewRecorder()
+		s.handleTokenExchange(w, req)
+		return w
+	}
+
+	w := exchange(primary, "/"+hash+"/e01.mkv", "1.2.3.100")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var res tokenExchangeResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(res.ExpiresAt); d <= 0 || d > s.exchangeTTL {
+		t.Fatalf("expected short-lived token, got expiry %v", res.ExpiresAt)
+	}
+	claims, err := c.Get(res.Token, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["hash"] != hash || claims["path"] != "/e01.mkv" || claims["role"] != "free" ||
+		claims["remoteAddress"] != "1.2.3.100" || claims[exchangedClaim] != true {
+		t.Fatalf("unexpected claims %v", claims)
+	}
+
+	// The minted token serves its file and mods of it, from the same
+	// subnet only.
+	src, err := s.parser.Parse(&url.URL{Path: "/" + hash + "/e01.mkv~hls/index.m3u8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/index.m3u8", nil)
+	if _, err := checkTokenScope(claims, src, r); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	other := &Source{InfoHash: hash, Path: "/e02.mkv", OriginPath: "/e02.mkv"}
+	if reason, _ := checkTokenScope(claims, other, r); reason != rejectPath {
+		t.Fatalf("expected path mismatch, got %q", reason)
+	}
+	r.Header.Set("X-Forwarded-For", "5.6.7.8")
+	if _, _, ok := s.checkSessionIP(claims, r); ok {
+		t.Fatal("expected other subnet to be rejected")
+	}
+
+	// Exchanged tokens are bound even without a session.
+	delete(claims, "sessionID")
+	if _, _, ok := s.checkSessionIP(claims, r); ok {
+		t.Fatal("expected other subnet to be rejected without session")
+	}
+
+	// A minted token can't outlive or widen the primary one.
+	if w := exchange(primary, "/"+hash+"/e01.mkv", "5.6.7.8"); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 from other subnet, got %d", w.Code)
+	}
+	if w := exchange(res.Token, "/"+hash+"/e02.mkv", "1.2.3.100"); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for other file, got %d", w.Code)
+	}
+	if w := exchange(res.Token, "/0000000000000000000000000000000000000000/e01.mkv", "1.2.3.100"); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for other hash, got %d", w.Code)
+	}
+	if w := exchange("garbage", "/"+hash+"/e01.mkv", "1.2.3.100"); w.Code != http.StatusForbidden {
+		t.Fatalf("expected 403 for bad token, got %d", w.Code)
+	}
+	if w := exchange(primary, "", "1.2.3.100"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without path, got %d", w.Code)
+	}
+}
+
+func TestWeb_CheckSessionIP_ExchangedAlwaysBound(t *testing.T) {
+	s := &Web{enforceSessionIP: false}
+	exchanged := jwt.MapClaims{exchangedClaim: true, "remoteAddress": "1.2.3.4"}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "1.2.3.100:1234"
+	if _, _, ok := s.checkSessionIP(exchanged, r); !ok {
+		t.Fatal("expected same subnet to pass")
+	}
+	r.RemoteAddr = "5.6.7.8:1234"
+	if _, _, ok := s.checkSessionIP(exchanged, r); ok {
+		t.Fatal("expected other subnet to be rejected without X-Forwarded-For")
+	}
+	r.Header.Set("X-Forwarded-For", "5.6.7.8")
+	if _, _, ok := s.checkSessionIP(exchanged, r); ok {
+		t.Fatal("expected other subnet to be rejected with enforce-session-ip off")
+	}
+	if _, _, ok := s.checkSessionIP(jwt.MapClaims{exchangedClaim: true}, r); ok {
+		t.Fatal("expected exchanged token without binding to be rejected")
+	}
+
+	// Tokens of a session are checked only with enforce-session-ip on.
+	session := jwt.MapClaims{"sessionID": "s1", "remoteAddress": "1.2.3.4"}
+	if _, _, ok := s.checkSessionIP(session, r); !ok {
+		t.Fatal("expected session token to pass with enforce-session-ip off")
+	}
+}
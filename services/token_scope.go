@@ -0,0 +1,187 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons of token rejections, each gets its own log line and metric label.
+const (
+	rejectInvalid = "invalid"
+	rejectExpired = "expired"
+	rejectNbf     = "nbf"
+	rejectHash    = "hash"
+	rejectAud     = "aud"
+	rejectPath    = "path"
+	rejectMod     = "mod"
+	rejectRange   = "range"
+)
+
+var promTokenRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "webtor_http_proxy_token_rejections_total",
+	Help: "Total number of requests rejected by token validation or scope",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(promTokenRejections)
+}
+
+// claimsErrorReason classifies an error of Claims.Get.
+func claimsErrorReason(err error) string {
+	var ve *jwt.ValidationError
+	if errors.As(err, &ve) {
+		switch {
+		case ve.Errors&jwt.ValidationErrorExpired != 0:
+			return rejectExpired
+		case ve.Errors&jwt.ValidationErrorNotValidYet != 0:
+			return rejectNbf
+		}
+	}
+	return rejectInvalid
+}
+
+// checkTokenScope checks the request against the optional scope claims of
+// its token and returns the reason of the first mismatch:
+//
+//	hash     - infohash the token is bound to
+//	aud      - host (or list of hosts) the token may be served from
+//	nbf      - time the token becomes valid
+//	path     - path prefix inside the torrent
+//	mods     - allowed mods, e.g. ["hls"]; an empty entry allows the file itself
+//	maxRange - bytes of the file that may be read, as a number or "10M"
+//
+// The maxRange applies to the file itself only, mods transform the content
+// so their offsets mean nothing. Requests without a range end are clamped to
+// the limit by rewriting the Range header.
+func checkTokenScope(claims jwt.MapClaims, src *Source, r *http.Request) (string, error) {
+	if h, _ := claims["hash"].(string); h != "" && h != src.InfoHash {
+		return rejectHash, errors.Errorf("token is bound to hash %s", h)
+	}
+	if aud, ok := claims["aud"]; ok {
+		if err := checkAudience(aud, r.Host); err != nil {
+			return rejectAud, err
+		}
+	}
+	// jwt.Parse already checks nbf, this keeps scope checks self-contained
+	// for claims that didn't come through it.
+	if !claims.VerifyNotBefore(time.Now().Unix(), false) {
+		return rejectNbf, errors.New("token is not valid yet")
+	}
+	if p, _ := claims["path"].(string); p != "" && !hasPathPrefix(src.OriginPath, p) {
+		return rejectPath, errors.Errorf("path %s is out of token scope %s", src.OriginPath, p)
+	}
+	if mods, ok := claims["mods"].([]interface{}); ok {
+		if err := checkMods(mods, src); err != nil {
+			return rejectMod, err
+		}
+	}
+	if mr, ok := claims["maxRange"]; ok && src.Mod == nil {
+		max, err := parseMaxRange(mr)
+		if err != nil {
+			return rejectRange, err
+		}
+		if err := clampRange(r, max); err != nil {
+			return rejectRange, err
+		}
+	}
+	return "", nil
+}
+
+func checkAudience(aud interface{}, host string) error {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	var auds []string
+	switch v := aud.(type) {
+	case string:
+		auds = []string{v}
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				auds = append(auds, s)
+			}
+		}
+	}
+	for _, a := range auds {
+		if strings.EqualFold(a, host) {
+			return nil
+		}
+	}
+	return errors.Errorf("host %s is not in token audience", host)
+}
+
+// hasPathPrefix reports whether path is prefix itself or lies under it.
+func hasPathPrefix(path string, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func checkMods(mods []interface{}, src *Source) error {
+	// Intermediate mods (e.g. a file inside an archive) can't be named by
+	// the token, so scoped tokens don't allow chains.
+	if src.Path != src.OriginPath {
+		return errors.Errorf("mod chain %s is out of token scope", src.Path)
+	}
+	t := ""
+	if src.Mod != nil {
+		t = src.Mod.Type
+	}
+	for _, m := range mods {
+		if s, ok := m.(string); ok && strings.TrimPrefix(s, "~") == t {
+			return nil
+		}
+	}
+	if t == "" {
+		return errors.New("file itself is out of token scope")
+	}
+	return errors.Errorf("mod %s is out of token scope", t)
+}
+
+func parseMaxRange(v interface{}) (int64, error) {
+	switch m := v.(type) {
+	case float64:
+		if m > 0 {
+			return int64(m), nil
+		}
+	case string:
+		b, err := bytefmt.ToBytes(m)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to parse maxRange %s", m)
+		}
+		if b > 0 {
+			return int64(b), nil
+		}
+	}
+	return 0, errors.Errorf("bad maxRange %v", v)
+}
+
+// clampRange rejects ranges reaching beyond max bytes and limits open ones.
+func clampRange(r *http.Request, max int64) error {
+	h := r.Header.Get("Range")
+	if h == "" {
+		r.Header.Set("Range", fmt.Sprintf("bytes=0-%d", max-1))
+		return nil
+	}
+	start, end, hasEnd, ok := parseRange(h)
+	if !ok {
+		return errors.Errorf("unsupported range %s with maxRange", h)
+	}
+	if start >= max || (hasEnd && end >= max) {
+		return errors.Errorf("range %s is beyond maxRange %d", h, max)
+	}
+	if !hasEnd {
+		r.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, max-1))
+	}
+	return nil
+}
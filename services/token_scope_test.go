@@ -0,0 +1,107 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+func TestCheckTokenScope(t *testing.T) {
+	hash := "08ada5a7a6183aae1e09d831df6748d566095a10"
+	file := &Source{InfoHash: hash, Path: "/Season 1/e01.mkv", OriginPath: "/Season 1/e01.mkv"}
+	hls := &Source{InfoHash: hash, Path: "/Season 1/e01.mkv", OriginPath: "/Season 1/e01.mkv", Mod: &Mod{Type: "hls"}}
+	chain := &Source{InfoHash: hash, Path: "/a.zip~arch/e01.mkv", OriginPath: "/a.zip", Mod: &Mod{Type: "hls"}}
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		src    *Source
+		rng    string
+		reason string
+	}{
+		{"no scope", jwt.MapClaims{}, file, "", ""},
+		{"hash", jwt.MapClaims{"hash": "0000000000000000000000000000000000000000"}, file, "", rejectHash},
+		{"aud", jwt.MapClaims{"aud": "webtor.io"}, file, "", ""},
+		{"aud list", jwt.MapClaims{"aud": []interface{}{"a.webtor.io", "WEBTOR.io"}}, file, "", ""},
+		{"aud mismatch", jwt.MapClaims{"aud": "other.io"}, file, "", rejectAud},
+		{"nbf", jwt.MapClaims{"nbf": float64(time.Now().Add(time.Hour).Unix())}, file, "", rejectNbf},
+		{"path", jwt.MapClaims{"path": "/Season 1/"}, file, "", ""},
+		{"path exact", jwt.MapClaims{"path": "/Season 1/e01.mkv"}, hls, "", ""},
+		{"path sibling", jwt.MapClaims{"path": "/Season"}, file, "", rejectPath},
+		{"mods", jwt.MapClaims{"mods": []interface{}{"~hls"}}, hls, "", ""},
+		{"mods file", jwt.MapClaims{"mods": []interface{}{"hls"}}, file, "", rejectMod},
+		{"mods file allowed", jwt.MapClaims{"mods": []interface{}{"hls", ""}}, file, "", ""},
+		{"mods chain", jwt.MapClaims{"mods": []interface{}{"hls"}}, chain, "", rejectMod},
+		{"range", jwt.MapClaims{"maxRange": float64(1000)}, file, "bytes=0-999", ""},
+		{"range beyond", jwt.MapClaims{"maxRange": "1K"}, file, "bytes=500-1024", rejectRange},
+		{"range start beyond", jwt.MapClaims{"maxRange": float64(1000)}, file, "bytes=1000-", rejectRange},
+		{"range suffix", jwt.MapClaims{"maxRange": float64(1000)}, file, "bytes=-100", rejectRange},
+		{"range bad claim", jwt.MapClaims{"maxRange": "lots"}, file, "", rejectRange},
+		{"range on mod", jwt.MapClaims{"maxRange": float64(1000)}, hls, "bytes=0-", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest("GET", "http://webtor.io:8080/", nil)
+			if tt.rng != "" {
+				r.Header.Set("Range", tt.rng)
+			}
+			reason, err := checkTokenScope(tt.claims, tt.src, r)
+			if reason != tt.reason {
+				t.Fatalf("expected reason %q, got %q (%v)", tt.reason, reason, err)
+			}
+			if (err != nil) != (reason != "") {
+				t.Fatalf("expected error with reason, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckTokenScope_ClampsOpenRange(t *testing.T) {
+	src := &Source{Path: "/e01.mkv", OriginPath: "/e01.mkv"}
+	claims := jwt.MapClaims{"maxRange": float64(1000)}
+	for rng, expected := range map[string]string{
+		"":           "bytes=0-999",
+		"bytes=100-": "bytes=100-999",
+	} {
+		r, _ := http.NewRequest("GET", "http://webtor.io/", nil)
+		if rng != "" {
+			r.Header.Set("Range", rng)
+		}
+		if _, err := checkTokenScope(claims, src, r); err != nil {
+			t.Fatal(err)
+		}
+		if got := r.Header.Get("Range"); got != expected {
+			t.Fatalf("expected range %q for %q, got %q", expected, rng, got)
+		}
+	}
+}
+
+func TestClaimsErrorReason(t *testing.T) {
+	secret := []byte("secret")
+	sign := func(claims jwt.MapClaims) string {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	c := &Claims{apiKey: "key", apiSecret: string(secret)}
+	for token, expected := range map[string]string{
+		sign(jwt.MapClaims{"exp": float64(time.Now().Add(-time.Hour).Unix())}): rejectExpired,
+		sign(jwt.MapClaims{"nbf": float64(time.Now().Add(time.Hour).Unix())}):  rejectNbf,
+		"garbage": rejectInvalid,
+	} {
+		_, err := c.Get(token, "key")
+		if err == nil {
+			t.Fatalf("expected error for %s", expected)
+		}
+		if got := claimsErrorReason(err); got != expected {
+			t.Fatalf("expected reason %s, got %s (%v)", expected, got, err)
+		}
+	}
+	if got := claimsErrorReason(errors.New("wrong api key")); got != rejectInvalid {
+		t.Fatalf("expected reason %s, got %s", rejectInvalid, got)
+	}
+}
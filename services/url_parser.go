@@ -24,6 +24,7 @@ type Source struct {
 	Type       string `json:"type"`
 	Name       string `json:"name"`
 	InfoHash   string `json:"info_hash"`
+	URLPath    string `json:"url_path"`
 	Path       string `json:"path"`
 	OriginPath string `json:"origin_path"`
 	Token      string `json:"token"`
@@ -170,6 +171,7 @@ func (s *URLParser) Parse(url *url.URL) (*Source, error) {
 	}
 	ss := &Source{
 		InfoHash:   hash,
+		URLPath:    urlPath,
 		Path:       newPath,
 		OriginPath: originPath,
 		Token:      url.Query().Get("token"),
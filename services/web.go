@@ -1,6 +1,7 @@
 package services
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -9,6 +10,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 
@@ -37,7 +39,17 @@ type Web struct {
 	ah               *AccessHistory
 	bandwidthLimit   bool
 	sl               *SessionLimiter
+	ql               *QuotaLimiter
+	bq               *ByteQuotas
+	rejections       *Rejections
 	enforceSessionIP bool
+	adminToken       string
+	exchangeTTL      time.Duration
+	sessionCookie    bool
+	sessionCookieTTL time.Duration
+	ads              *AdsConfig
+
+	sessionCookieOrigins map[string]struct{}
 }
 
 const (
@@ -80,7 +92,7 @@ func init() {
 	prometheus.MustRegister(promHTTPProxyRequestTotal)
 }
 
-func NewWeb(c *cli.Context, parser *URLParser, r *Resolver, pr *HTTPProxy, claims *Claims, bp *HybridBucketPool, ch *ClickHouse, ah *AccessHistory, sl *SessionLimiter) *Web {
+func NewWeb(c *cli.Context, parser *URLParser, r *Resolver, pr *HTTPProxy, claims *Claims, bp *HybridBucketPool, ch *ClickHouse, ah *AccessHistory, sl *SessionLimiter, ql *QuotaLimiter, bq *ByteQuotas, rejections *Rejections, ads *AdsConfig) *Web {
 	return &Web{
 		host:           c.String(webHostFlag),
 		port:           c.Int(webPortFlag),
@@ -94,7 +106,17 @@ func NewWeb(c *cli.Context, parser *URLParser, r *Resolver, pr *HTTPProxy, claim
 		ah:             ah,
 		bandwidthLimit:   c.Bool(useBandwidthLimitFlag),
 		sl:               sl,
+		ql:               ql,
+		bq:               bq,
+		rejections:       rejections,
 		enforceSessionIP: c.Bool(enforceSessionIPFlag),
+		adminToken:       c.String(adminTokenFlag),
+		exchangeTTL:      time.Duration(c.Int(tokenExchangeTTLFlag)) * time.Second,
+		sessionCookie:    c.Bool(sessionCookieFlag),
+		sessionCookieTTL: time.Duration(c.Int(sessionCookieTTLFlag)) * time.Second,
+		ads:              ads,
+
+		sessionCookieOrigins: parseOrigins(c.String(sessionCookieOriginsFlag)),
 	}
 }
 
@@ -133,6 +155,33 @@ func RegisterWebFlags(f []cli.Flag) []cli.Flag {
 			Usage:  "reject requests whose client IP doesn't match the remoteAddress claim in the JWT (normalized to /24 for v4, /64 for v6). Disable to unblock mobile users if false positives appear.",
 			EnvVar: "ENFORCE_SESSION_IP",
 		},
+		cli.StringFlag{
+			Name:   adminTokenFlag,
+			Usage:  "bearer token of the admin API, the API is off without it",
+			EnvVar: "ADMIN_TOKEN",
+		},
+		cli.IntFlag{
+			Name:   tokenExchangeTTLFlag,
+			Usage:  "lifetime in seconds of tokens minted by the token exchange endpoint",
+			Value:  300,
+			EnvVar: "TOKEN_EXCHANGE_TTL",
+		},
+		cli.BoolFlag{
+			Name:   sessionCookieFlag,
+			Usage:  "set a session cookie on authorized manifest requests, so that segments under the same infohash don't need a token",
+			EnvVar: "SESSION_COOKIE",
+		},
+		cli.IntFlag{
+			Name:   sessionCookieTTLFlag,
+			Usage:  "max lifetime in seconds of the session cookie, it never outlives the token",
+			Value:  14400,
+			EnvVar: "SESSION_COOKIE_TTL",
+		},
+		cli.StringFlag{
+			Name:   sessionCookieOriginsFlag,
+			Usage:  "comma-separated origins of player pages allowed to send the session cookie with cross-origin requests",
+			EnvVar: "SESSION_COOKIE_ORIGINS",
+		},
 	)
 }
 
@@ -170,11 +219,49 @@ func (s *Web) getIP(r *http.Request) string {
 	return r.RemoteAddr
 }
 
+// checkSessionIP reports whether an external request comes from the subnet
+// its token is bound to by remoteAddress. Tokens of a session are checked
+// when enforce-session-ip is on and the request comes through a proxy,
+// exchanged ones always are, as the binding is what makes them safe to embed.
+func (s *Web) checkSessionIP(claims jwt.MapClaims, r *http.Request) (bound string, reqIP string, ok bool) {
+	bound, _ = claims["remoteAddress"].(string)
+	if exchanged, _ := claims[exchangedClaim].(bool); exchanged {
+		reqIP = s.getIP(r)
+		return bound, reqIP, parseClientIP(bound) != nil && parseClientIP(reqIP) != nil && sameSubnet(bound, reqIP)
+	}
+	if !s.enforceSessionIP || r.Header.Get("X-FORWARDED-FOR") == "" {
+		return "", "", true
+	}
+	if sessionID, _ := claims["sessionID"].(string); sessionID == "" || bound == "" {
+		return "", "", true
+	}
+	reqIP = s.getIP(r)
+	return bound, reqIP, sameSubnet(bound, reqIP)
+}
+
 func (s *Web) proxyHTTP(w http.ResponseWriter, r *http.Request, src *Source, logger *logrus.Entry) {
 	wi := NewResponseWrtierInterceptor(w)
 	w = wi
-	apiKey := r.URL.Query().Get("api-key")
-	claims, err := s.claims.Get(r.URL.Query().Get("token"), apiKey)
+	q := r.URL.Query()
+	apiKey := q.Get("api-key")
+	token := q.Get("token")
+	primaryToken := token
+	fromCookie := false
+	if s.sessionCookie {
+		s.allowCredentials(w, r)
+		if token == "" && !IsSignedURL(q) {
+			if t, k, p, ok := getSessionCookie(r); ok {
+				token, apiKey, primaryToken, fromCookie = t, k, p, true
+			}
+		}
+	}
+	var claims jwt.MapClaims
+	var err error
+	if IsSignedURL(q) {
+		claims, err = s.claims.GetSigned(src.URLPath, q)
+	} else {
+		claims, err = s.claims.Get(token, apiKey)
+	}
 	if err != nil {
 		// Demote the two known-noisy classes to Debug so dashboards aren't
 		// dominated by stale-embed traffic (cosmic-crab.buzz and similar
@@ -183,23 +270,26 @@ func (s *Web) proxyHTTP(w http.ResponseWriter, r *http.Request, src *Source, log
 		// 403 still goes back to the client; we just stop shouting about
 		// it.
 		errMsg := err.Error()
+		reason := claimsErrorReason(err)
+		promTokenRejections.WithLabelValues(reason).Inc()
 		if strings.Contains(errMsg, "Token is expired") ||
 			strings.Contains(errMsg, "invalid number of segments") {
 			logger.WithError(err).Debug("failed to get claims (expired/malformed)")
 		} else {
-			logger.WithError(err).Warn("failed to get claims")
+			logger.WithError(err).WithField("reason", reason).Warn("failed to get claims")
 		}
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
-	// If the token carries a `hash` claim, it's bound to that specific torrent
-	// and any mismatch is treated as forgery (prevents replay across content).
-	if boundHash, _ := claims["hash"].(string); boundHash != "" && boundHash != src.InfoHash {
-		logger.WithFields(logrus.Fields{
-			"infohash":   src.InfoHash,
-			"bound_hash": boundHash,
-		}).Warn("token hash mismatch")
+	// Scope claims bind the token to a torrent (`hash`, any mismatch is
+	// treated as forgery), host, path, mods and byte range.
+	if reason, err := checkTokenScope(claims, src, r); err != nil {
+		promTokenRejections.WithLabelValues(reason).Inc()
+		logger.WithError(err).WithFields(logrus.Fields{
+			"infohash": src.InfoHash,
+			"reason":   reason,
+		}).Warn("token scope mismatch")
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
@@ -209,6 +299,18 @@ func (s *Web) proxyHTTP(w http.ResponseWriter, r *http.Request, src *Source, log
 		source = External
 	}
 
+	var quotas []QuotaScope
+	if k := s.claims.GetAPIKey(apiKey); k != nil {
+		if err := k.Apply(claims, src); err != nil {
+			logger.WithError(err).WithField("api_key", apiKey).Warn("api key policy rejected")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if source == External {
+			quotas = k.Quotas(apiKey, claims)
+		}
+	}
+
 	ads := false
 
 	role := "nobody"
@@ -228,20 +330,21 @@ func (s *Web) proxyHTTP(w http.ResponseWriter, r *http.Request, src *Source, log
 		sessionID = sid
 	}
 
-	if s.enforceSessionIP && source == External && sessionID != "" {
-		if bound, ok := claims["remoteAddress"].(string); ok && bound != "" {
-			reqIP := s.getIP(r)
-			if !sameSubnet(bound, reqIP) {
-				logger.WithFields(logrus.Fields{
-					"session_id": sessionID,
-					"session_ip": bound,
-					"request_ip": reqIP,
-					"infohash":   src.InfoHash,
-					"path":       src.Path,
-				}).Warn("session IP mismatch")
-				w.WriteHeader(http.StatusTooManyRequests)
-				return
-			}
+	if bound, reqIP, ok := s.checkSessionIP(claims, r); !ok {
+		logger.WithFields(logrus.Fields{
+			"session_id": sessionID,
+			"session_ip": bound,
+			"request_ip": reqIP,
+			"infohash":   src.InfoHash,
+			"path":       src.Path,
+		}).Warn("session IP mismatch")
+		s.reject(w, r, http.StatusTooManyRequests, rejectSessionIP, 0)
+		return
+	}
+
+	if s.sessionCookie && !fromCookie && isManifest(r.URL.Path) {
+		if err := s.setSessionCookie(w, r, claims, apiKey, primaryToken, src); err != nil {
+			logger.WithError(err).Warn("failed to set session cookie")
 		}
 	}
 
@@ -255,10 +358,52 @@ func (s *Web) proxyHTTP(w http.ResponseWriter, r *http.Request, src *Source, log
 				"request_ip": s.getIP(r),
 				"reason":     reason,
 			}).Warn("session limiter rejected")
-			w.WriteHeader(http.StatusTooManyRequests)
+			s.reject(w, r, http.StatusTooManyRequests, sessionRejectCode(reason), 0)
 			return
 		}
 		defer release()
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		defer s.sl.OnEvict(sessionID, cancel)()
+		r = r.WithContext(ctx)
+	}
+
+	if s.ql != nil && len(quotas) > 0 {
+		release, scope, reason := s.ql.Acquire(quotas, src.InfoHash)
+		if release == nil {
+			logger.WithFields(logrus.Fields{
+				"api_key":  apiKey,
+				"scope":    scope,
+				"infohash": src.InfoHash,
+				"reason":   reason,
+			}).Warn("quota exceeded")
+			s.reject(w, r, http.StatusTooManyRequests, quotaRejectCode(reason), 0)
+			return
+		}
+		defer release()
+	}
+
+	if scopes := byteQuotaScopes(claims, quotas); s.bq != nil && len(scopes) > 0 && source == External {
+		usage, err := s.bq.Usage(r.Context(), scopes)
+		if err != nil {
+			// Serve rather than lock every tenant out while Redis is down.
+			logger.WithError(err).Warn("failed to check byte quotas")
+		} else {
+			exhausted, remaining := exhaustedByteQuota(usage)
+			if exhausted != nil {
+				logger.WithFields(logrus.Fields{
+					"api_key": apiKey,
+					"scope":   exhausted.Scope,
+					"window":  exhausted.Window,
+				}).Warn("byte quota exhausted")
+				s.reject(w, r, byteQuotaStatus(exhausted), byteQuotaRejectCode(exhausted), exhausted.RetryAfter)
+				return
+			}
+			w.Header().Set(byteQuotaRemainingHeader, strconv.FormatInt(remaining, 10))
+			c := s.bq.newCounter(scopes)
+			defer c.Close()
+			wi.countBytes = c.add
+		}
 	}
 
 	wi.resolveSize = func(statusCode int) prometheus.Counter {
@@ -355,6 +500,20 @@ func (s *Web) proxyHTTP(w http.ResponseWriter, r *http.Request, src *Source, log
 		}
 	}
 
+	// Aggregate rates of quotas apply on top of the session rate.
+	for _, q := range quotas {
+		if q.Quota.MaxRate == "" {
+			continue
+		}
+		b, err := s.bucket.GetShared("quota:"+q.Scope, q.Quota.MaxRate)
+		if err != nil {
+			logger.WithError(err).Errorf("failed to get quota bucket")
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w = NewThrottledRequestWrtier(w, b)
+	}
+
 	for k, v := range headers {
 		r.Header.Set(k, v)
 	}
@@ -383,10 +542,19 @@ func (s *Web) proxyHTTP(w http.ResponseWriter, r *http.Request, src *Source, log
 			RetryDelay:        s.pr.retryDelay,
 		})
 	}
+	previewKey := ""
+	if isAnonymous(claims) && findPreviewRule(claims) != nil {
+		// Without a secret segments of previews aren't served.
+		previewKey, _ = s.claims.secret(apiKey)
+	}
 	r = WithRulesContext(r, &RulesContext{
 		Claims:       claims,
-		PrimaryToken: r.URL.Query().Get("token"),
+		PrimaryToken: primaryToken,
+		APIKey:       apiKey,
 		InfoHash:     src.InfoHash,
+		Mod:          src.Mod,
+		Ads:          s.ads,
+		PreviewKey:   previewKey,
 	})
 	r = WithFileKey(r, src.InfoHash, src.Path)
 	pr.ServeHTTP(w, r)
@@ -420,8 +588,23 @@ func (s *Web) Serve() error {
 		_, _ = fmt.Fprintf(w, "Remote addr:\t%v\n", r.RemoteAddr)
 	})
 
+	mux.HandleFunc("/debug/breakers", func(w http.ResponseWriter, r *http.Request) {
+		for _, st := range s.pr.breakers.Status() {
+			_, _ = fmt.Fprintf(w, "%v\t%v\tfailures=%v", st.Key, st.State, st.Failures)
+			if st.State != BreakerClosed {
+				_, _ = fmt.Fprintf(w, "\topened=%v", st.OpenedAt.Format(time.RFC3339))
+			}
+			_, _ = fmt.Fprintln(w)
+		}
+	})
+
 	mux.HandleFunc("/speedtest", s.handleSpeedtest)
 
+	mux.HandleFunc("/token/exchange", s.handleTokenExchange)
+	mux.HandleFunc("/quota", s.handleByteQuota)
+
+	s.registerAdmin(mux)
+
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/" ||
 			strings.HasPrefix(r.URL.Path, "/favicon") ||
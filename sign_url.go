@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	s "github.com/webtor-io/torrent-http-proxy/services"
+)
+
+const (
+	signURLFlag        = "url"
+	signAPIKeyFlag     = "api-key"
+	signAPISecretFlag  = "api-secret"
+	signTTLFlag        = "ttl"
+	signPathPrefixFlag = "path-prefix"
+	signRoleFlag       = "role"
+	signRateFlag       = "rate"
+	signSessionIDFlag  = "session-id"
+	signDomainFlag     = "domain"
+)
+
+func makeSignURLCMD() cli.Command {
+	return cli.Command{
+		Name:      "sign-url",
+		Usage:     "generates a signed url for clients that can't carry a token",
+		ArgsUsage: " ",
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  signURLFlag,
+				Usage: "url to sign",
+			},
+			cli.StringFlag{
+				Name:   signAPIKeyFlag,
+				Usage:  "API key",
+				EnvVar: "API_KEY",
+			},
+			cli.StringFlag{
+				Name:   signAPISecretFlag,
+				Usage:  "secret of the API key",
+				EnvVar: "API_SECRET",
+			},
+			cli.IntFlag{
+				Name:  signTTLFlag,
+				Usage: "time in seconds the url stays valid",
+				Value: 3600,
+			},
+			cli.StringFlag{
+				Name:  signPathPrefixFlag,
+				Usage: "sign path prefix instead of the path, so the url can be used for everything under it",
+			},
+			cli.StringFlag{
+				Name:  signRoleFlag,
+				Usage: "role claim",
+			},
+			cli.StringFlag{
+				Name:  signRateFlag,
+				Usage: "rate claim",
+			},
+			cli.StringFlag{
+				Name:  signSessionIDFlag,
+				Usage: "sessionID claim",
+			},
+			cli.StringFlag{
+				Name:  signDomainFlag,
+				Usage: "domain claim",
+			},
+		},
+		Action: signURL,
+	}
+}
+
+func signURL(c *cli.Context) error {
+	if c.String(signURLFlag) == "" {
+		return errors.New("url is required")
+	}
+	if c.String(signAPISecretFlag) == "" {
+		return errors.New("api secret is required")
+	}
+	u, err := url.Parse(c.String(signURLFlag))
+	if err != nil {
+		return errors.Wrap(err, "failed to parse url")
+	}
+	q := u.Query()
+	for _, f := range []string{signAPIKeyFlag, signPathPrefixFlag, signRoleFlag, signRateFlag, signSessionIDFlag, signDomainFlag} {
+		if v := c.String(f); v != "" {
+			q.Set(f, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	s.SignURL(u, c.String(signAPISecretFlag), time.Now().Add(time.Duration(c.Int(signTTLFlag))*time.Second))
+	fmt.Println(u.String())
+	return nil
+}